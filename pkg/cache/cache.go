@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+const (
+	// sha256Dir has files by their sha256
+	sha256Dir = "sha256"
+	// imagesDir has saved images by their digest
+	imagesDir = "images"
+	// tmpExt is for files being added to the cache
+	tmpExt = ".tmp"
+	// metaExt is for what's recorded about a cached file e.g. an image ID
+	metaExt = ".meta"
+)
+
+// Cache is a user level content addressed store of downloads shared by archive
+// dirs. A nil cache is disabled.
+type Cache struct {
+	Dir string
+}
+
+// Entry is a file in the cache
+type Entry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// DefaultDir is $XDG_CACHE_HOME/artefactor (or ~/.cache/artefactor)
+func DefaultDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); len(dir) > 0 {
+		return filepath.Join(dir, "artefactor")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "artefactor")
+}
+
+// New will create the cache dir (returns a nil cache if dir is empty)
+func New(dir string) (*Cache, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("problem creating cache dir %s:%s", dir, err)
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// SHA256Key is the key for a file by its sha256
+func SHA256Key(sha256 string) string {
+	return filepath.Join(sha256Dir, strings.ToLower(sha256))
+}
+
+// ImageKey is the key for a saved image by its digest and platform (a digest
+// can be for a list of images for each platform). The file name is kept as the
+// image name is saved in the archive
+func ImageKey(digest string, platform string, fileName string) string {
+	return filepath.Join(
+		imagesDir, strings.TrimPrefix(digest, "sha256:")+"_"+platform, filepath.Base(fileName))
+}
+
+// Get will hard link (or copy) a cached file to dst and report if it was found
+func (uc *Cache) Get(key string, dst string) (bool, error) {
+	if uc == nil {
+		return false, nil
+	}
+	file := filepath.Join(uc.Dir, key)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := util.Link(file, dst); err != nil {
+		return false, fmt.Errorf("problem copying %s from cache:%s", dst, err)
+	}
+	// record the use for pruning
+	now := time.Now()
+	if err := os.Chtimes(file, now, now); err != nil {
+		return false, err
+	}
+	fmt.Printf("using %s from cache %s\n", dst, uc.Dir)
+	return true, nil
+}
+
+// Put will hard link (or copy) a file into the cache (if not already present)
+func (uc *Cache) Put(key string, src string) error {
+	if uc == nil {
+		return nil
+	}
+	file := filepath.Join(uc.Dir, key)
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmpFile := file + tmpExt
+	if err := util.Link(src, tmpFile); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("problem copying %s to cache:%s", src, err)
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(file, now, now)
+}
+
+// PutMeta will record something about a cached file e.g. the image ID of a
+// saved image
+func (uc *Cache) PutMeta(key string, meta string) error {
+	if uc == nil {
+		return nil
+	}
+	file := filepath.Join(uc.Dir, key) + metaExt
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(meta), 0644)
+}
+
+// GetMeta will return what was recorded about a cached file (empty if nothing
+// was)
+func (uc *Cache) GetMeta(key string) string {
+	if uc == nil {
+		return ""
+	}
+	b, err := ioutil.ReadFile(filepath.Join(uc.Dir, key) + metaExt)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Remove will remove a file (and what was recorded about it) from the cache
+// e.g. if it isn't as expected
+func (uc *Cache) Remove(key string) error {
+	if uc == nil {
+		return nil
+	}
+	for _, file := range []string{key, key + metaExt} {
+		if err := os.Remove(filepath.Join(uc.Dir, file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Entries will list the cached files (without what's recorded about them),
+// least recently used first
+func (uc *Cache) Entries() ([]Entry, error) {
+	var entries []Entry
+	if uc == nil {
+		return entries, nil
+	}
+	err := filepath.Walk(uc.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && !strings.HasSuffix(path, metaExt) {
+			entries = append(entries, Entry{Path: path, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+	return entries, nil
+}
+
+// Prune will remove the least recently used files until the cache is no larger
+// than maxSize and returns the files removed
+func (uc *Cache) Prune(maxSize int64) ([]Entry, error) {
+	entries, err := uc.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	var removed []Entry
+	for _, e := range entries {
+		if size <= maxSize {
+			break
+		}
+		if err := os.Remove(e.Path); err != nil {
+			return removed, fmt.Errorf("problem removing %s from cache:%s", e.Path, err)
+		}
+		os.Remove(e.Path + metaExt)
+		// remove an image dir once it's empty
+		if dir := filepath.Dir(e.Path); filepath.Dir(dir) == filepath.Join(uc.Dir, imagesDir) {
+			os.Remove(dir)
+		}
+		size -= e.Size
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
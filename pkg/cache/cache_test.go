@@ -0,0 +1,100 @@
+package cache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appvia/artefactor/pkg/cache"
+	"gotest.tools/assert"
+)
+
+func TestGetPutPrune(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_cache")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	uc, err := cache.New(filepath.Join(tmp, "cache"))
+	assert.NilError(t, err)
+	bundle := filepath.Join(tmp, "bundle")
+	assert.NilError(t, os.MkdirAll(bundle, 0755))
+
+	// a nil cache is disabled
+	var disabled *cache.Cache
+	ok, err := disabled.Get(cache.SHA256Key("abc"), filepath.Join(bundle, "a"))
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.NilError(t, disabled.Put(cache.SHA256Key("abc"), filepath.Join(bundle, "a")))
+
+	keys := []string{
+		cache.SHA256Key("aaa"),
+		cache.SHA256Key("bbb"),
+		cache.ImageKey("sha256:ccc", "linux_amd64", "/downloads/alpine.docker.tar"),
+	}
+	for i, key := range keys {
+		src := filepath.Join(bundle, filepath.Base(key))
+		assert.NilError(t, ioutil.WriteFile(src, []byte("0123456789"), 0644))
+		assert.NilError(t, uc.Put(key, src))
+		// the least recently used is the first
+		old := time.Now().Add(time.Duration(i-len(keys)) * time.Hour)
+		assert.NilError(t, os.Chtimes(filepath.Join(uc.Dir, key), old, old))
+	}
+
+	dst := filepath.Join(tmp, "other", "aaa")
+	assert.NilError(t, os.MkdirAll(filepath.Dir(dst), 0755))
+	ok, err = uc.Get(keys[0], dst)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	b, err := ioutil.ReadFile(dst)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "0123456789")
+	ok, err = uc.Get(cache.SHA256Key("missing"), dst)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	// aaa was just used so bbb then the image are removed
+	removed, err := uc.Prune(10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(removed), 2)
+	assert.Equal(t, removed[0].Path, filepath.Join(uc.Dir, keys[1]))
+	assert.Equal(t, removed[1].Path, filepath.Join(uc.Dir, keys[2]))
+	_, err = os.Stat(filepath.Dir(filepath.Join(uc.Dir, keys[2])))
+	assert.Assert(t, os.IsNotExist(err))
+	entries, err := uc.Entries()
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Path, filepath.Join(uc.Dir, keys[0]))
+}
+
+func TestMeta(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_cache")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	uc, err := cache.New(filepath.Join(tmp, "cache"))
+	assert.NilError(t, err)
+	key := cache.ImageKey("sha256:ccc", "linux_amd64", "/downloads/alpine.docker.tar")
+	src := filepath.Join(tmp, "alpine.docker.tar")
+	assert.NilError(t, ioutil.WriteFile(src, []byte("0123456789"), 0644))
+	assert.NilError(t, uc.Put(key, src))
+	assert.Equal(t, uc.GetMeta(key), "")
+
+	assert.NilError(t, uc.PutMeta(key, "sha256:abc"))
+	assert.Equal(t, uc.GetMeta(key), "sha256:abc")
+	// what's recorded isn't a cached file
+	entries, err := uc.Entries()
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+
+	assert.NilError(t, uc.Remove(key))
+	assert.Equal(t, uc.GetMeta(key), "")
+
+	// pruning removes what's recorded with the file
+	assert.NilError(t, uc.Put(key, src))
+	assert.NilError(t, uc.PutMeta(key, "sha256:abc"))
+	_, err = uc.Prune(0)
+	assert.NilError(t, err)
+	assert.Equal(t, uc.GetMeta(key), "")
+	_, err = os.Stat(filepath.Dir(filepath.Join(uc.Dir, key)))
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/appvia/artefactor/pkg/crypt"
 	"github.com/appvia/artefactor/pkg/util"
 	"github.com/spf13/cobra"
 )
@@ -18,18 +19,78 @@ const (
 	// FlagArchiveDir is the directory to save archives into
 	FlagArchiveDir = "archive-dir"
 	// FlagGitRepos specifies a newline seperated list of local or remote git repos
+	// optionally with a branch, tag or commit to archive e.g. path@v1.0.0
 	FlagGitRepos = "git-repos"
 	// FlagWebFiles specifies a whitespace delimited set of csv's with:
-	// url,file,md5,[true|false (executable)]
+	// url[|url],file,sha256|sums=checksums,[true|false (executable)]
+	// [,mode=|owner=|target=|sig=]
 	FlagWebFiles = "web-files"
+	// FlagWebMirrors specifies a whitespace delimited set of url prefixes to
+	// download web files from first e.g. prefix=mirror
+	FlagWebMirrors = "web-mirrors"
+	// FlagWebPlatforms specifies the platforms to save templated web files for
+	// e.g. linux_amd64 linux_arm64
+	FlagWebPlatforms = "web-platforms"
+	// FlagWebConfig is a JSON file with the auth and TLS settings for the hosts
+	// web files are downloaded from
+	FlagWebConfig = "web-config"
+	// FlagWebSumsKeyring is an OpenPGP keyring to verify the signatures of web
+	// file checksums files
+	FlagWebSumsKeyring = "web-sums-keyring"
+	// FlagLocalFiles specifies a whitespace delimited set of csv's with:
+	// path[,file][,true|false (executable)][,mode=|owner=|target=]
+	FlagLocalFiles = "local-files"
+	// FlagLocalDirs specifies a whitespace delimited set of csv's with:
+	// path[,file][,mode=|owner=|target=] to save as tars
+	FlagLocalDirs = "local-dirs"
 	// FlagLogs enabled debug logs
 	FlagLogs = "logs"
 	// FlagTargetPlatform allows the correct version of artefactor to be saved
 	// with files.
 	FlagTargetPlatform = "target-platform"
+	// FlagCacheDir is the user cache of downloads and images shared by archive
+	// dirs
+	FlagCacheDir = "cache-dir"
+	// FlagNoCache disables the user cache
+	FlagNoCache = "no-cache"
+	// FlagArtefactorSource is a local dir or url with artefactor binaries for
+	// other platforms and their checksum file (instead of the github releases)
+	FlagArtefactorSource = "artefactor-source"
 	// FlagImageVars is used to specify a whitelist of variable names to enable
 	// "export"
 	FlagImageVars = "image-vars"
+	// FlagGitFormat specifies how git repos are archived (tar or bundle)
+	FlagGitFormat = "git-format"
+	// FlagGitIncremental will only bundle git commits since the last save
+	FlagGitIncremental = "git-incremental"
+	// FlagGitSanitize removes hooks, reflogs, stashes and credentials from git
+	// meta-data
+	FlagGitSanitize = "git-sanitize"
+	// FlagGitSanitizeRemotes specifies if remotes are redacted or removed
+	FlagGitSanitizeRemotes = "git-sanitize-remotes"
+	// FlagGitRemoteRewrites specifies whitespace seperated old=new url prefixes
+	FlagGitRemoteRewrites = "git-remote-rewrites"
+	// FlagGitKeepRefs limits the git refs saved to a whitespace seperated list
+	FlagGitKeepRefs = "git-keep-refs"
+	// FlagSaveSince creates a delta bundle with only the artefacts changed since
+	// a previous checksum file (or archive dir)
+	FlagSaveSince = "since"
+	// FlagBundleDir is a dir to save the artefacts shipped to, leaving the
+	// archive dir with all the artefacts to save again from
+	FlagBundleDir = "bundle-dir"
+	// FlagDockerLayerDelta leaves out the image layers shipped with the bundle
+	// a delta bundle is saved against
+	FlagDockerLayerDelta = "docker-layer-delta"
+	// FlagEncrypt encrypts the artefacts saved to the bundle dir
+	FlagEncrypt = "encrypt"
+	// FlagEncryptRecipients is a whitespace seperated list of public keys (or
+	// files of public keys) to encrypt to
+	FlagEncryptRecipients = "encrypt-recipients"
+	// FlagPassphraseFile is a file with a passphrase to encrypt or decrypt with
+	FlagPassphraseFile = "passphrase-file"
+	// FlagIdentity is a whitespace seperated list of files with secret keys to
+	// decrypt with
+	FlagIdentity = "identity"
 	// FlagDockerUserName overrides docker registry configuration
 	FlagDockerUserName = "docker-username"
 	// FlagDockerPassword overrides docker registry configuration
@@ -75,12 +136,12 @@ func init() {
 		RootCmd,
 		FlagGitRepos,
 		"",
-		"A whitespace seperated list of local or remote git repos")
+		"A whitespace seperated list of local or remote git repos [path@ref]")
 	addFlagWithEnvDefault(
 		RootCmd,
 		FlagWebFiles,
 		"",
-		"A whitespace seperated list of CSV's: url,filename,sha256,true")
+		"A whitespace seperated list of CSV's: url[|mirror-url],filename,sha256|sums=checksums[,true][,mode=|owner=|target=|sig=]")
 }
 
 // addFlagWithEnvDefault adds a defaultValue
@@ -91,6 +152,14 @@ func addFlagWithEnvDefault(c *cobra.Command, flag string, defVal string, help st
 		fmt.Sprintf("%s (${%s})", help, GetEnvName(flag)))
 }
 
+// addBoolFlagWithEnvDefault adds a boolean flag defaulting from the environment
+func addBoolFlagWithEnvDefault(c *cobra.Command, flag string, help string) {
+	c.PersistentFlags().Bool(
+		flag,
+		strings.ToLower(defaultValue(flag, "false")) == "true",
+		fmt.Sprintf("%s (${%s})", help, GetEnvName(flag)))
+}
+
 func common(c *cobra.Command) {
 	logs, _ := c.Flags().GetBool(FlagLogs)
 	if !logs {
@@ -121,6 +190,44 @@ func getCredsFromFlags(c *cobra.Command) *util.Creds {
 	return nil
 }
 
+// getIdentities will read the secret keys and passphrase to decrypt artefacts
+// with (if specified)
+func getIdentities(c *cobra.Command) ([]crypt.Identity, error) {
+	var ids []crypt.Identity
+	for _, file := range strings.Fields(c.Flag(FlagIdentity).Value.String()) {
+		fileIds, err := crypt.ReadIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading identity file %s:%s", file, err)
+		}
+		ids = append(ids, fileIds...)
+	}
+	passphrase, err := getPassphrase(c)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != nil {
+		ids = append(ids, passphrase)
+	}
+	return ids, nil
+}
+
+// getPassphrase will read the passphrase from the file specified (if any)
+func getPassphrase(c *cobra.Command) (*crypt.Passphrase, error) {
+	file := c.Flag(FlagPassphraseFile).Value.String()
+	if len(file) == 0 {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading passphrase file %s:%s", file, err)
+	}
+	passphrase, err := crypt.NewPassphrase(strings.TrimRight(string(b), "\r\n"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid passphrase in %s:%s", file, err)
+	}
+	return passphrase, nil
+}
+
 func GetEnvName(flagName string) string {
 	return (EnvPrefix +
 		strings.Replace(strings.ToUpper(flagName), "-", "_", -1))
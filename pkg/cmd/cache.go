@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/cache"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// PruneCacheCommand is the sub command syntax
+	PruneCacheCommand string = "prune-cache"
+	// FlagCacheMaxSize is the size to prune the cache to e.g. 20GB
+	FlagCacheMaxSize string = "max-size"
+	// FlagPruneDryRun will list the files that would be removed
+	FlagPruneDryRun string = "dry-run"
+	// DefaultCacheMaxSize is the size the cache is pruned to by default
+	DefaultCacheMaxSize string = "20GB"
+)
+
+// pruneCacheCmd represents the command to limit the size of the user cache
+var pruneCacheCmd = &cobra.Command{
+	Use:   PruneCacheCommand,
+	Short: "removes the least recently used files from the download cache",
+	Long:  "will remove the least recently used downloads and images from the user cache until it is no larger than --max-size",
+	RunE: func(c *cobra.Command, args []string) error {
+		return pruneCache(c)
+	},
+}
+
+func init() {
+	addFlagWithEnvDefault(
+		pruneCacheCmd,
+		FlagCacheDir,
+		cache.DefaultDir(),
+		"the user cache of downloads and images shared by archive dirs")
+
+	addFlagWithEnvDefault(
+		pruneCacheCmd,
+		FlagCacheMaxSize,
+		DefaultCacheMaxSize,
+		"the size to prune the cache to e.g. 500MB or 20GB")
+
+	addBoolFlagWithEnvDefault(
+		pruneCacheCmd,
+		FlagPruneDryRun,
+		"list the files that would be removed without removing them")
+
+	RootCmd.AddCommand(pruneCacheCmd)
+}
+
+func pruneCache(c *cobra.Command) error {
+	common(c)
+	maxSize, err := parseSize(c.Flag(FlagCacheMaxSize).Value.String())
+	if err != nil {
+		return fmt.Errorf("invalid --%s:%s", FlagCacheMaxSize, err)
+	}
+	dir := c.Flag(FlagCacheDir).Value.String()
+	if len(dir) == 0 {
+		return fmt.Errorf("expecting a --%s", FlagCacheDir)
+	}
+	uc := &cache.Cache{Dir: dir}
+	entries, err := uc.Entries()
+	if err != nil {
+		return fmt.Errorf("problem reading cache %s:%s", dir, err)
+	}
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	fmt.Printf("cache %s has %d files (%s)\n", dir, len(entries), humanSize(size))
+
+	if dryRun, _ := c.Flags().GetBool(FlagPruneDryRun); dryRun {
+		for _, e := range entries {
+			if size <= maxSize {
+				break
+			}
+			fmt.Printf("would remove %s (%s)\n", e.Path, humanSize(e.Size))
+			size -= e.Size
+		}
+		return nil
+	}
+	removed, err := uc.Prune(maxSize)
+	for _, e := range removed {
+		fmt.Printf("removed %s (%s)\n", e.Path, humanSize(e.Size))
+		size -= e.Size
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("cache %s is now %s\n", dir, humanSize(size))
+	return nil
+}
+
+// getUserCache gets the user cache of downloads and images (nil if disabled)
+func getUserCache(c *cobra.Command) (*cache.Cache, error) {
+	if noCache, _ := c.Flags().GetBool(FlagNoCache); noCache {
+		return nil, nil
+	}
+	return cache.New(c.Flag(FlagCacheDir).Value.String())
+}
+
+// parseSize will read a size in bytes with optional units (KB, MB, GB or TB)
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	multiplier := int64(1)
+	for i, unit := range "KMGT" {
+		if strings.HasSuffix(s, string(unit)) {
+			s = strings.TrimSuffix(s, string(unit))
+			multiplier = int64(1) << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expecting a size e.g. 500MB or 20GB, got %q", size)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/docker"
+	"github.com/appvia/artefactor/pkg/git"
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// DiffCommand is the sub command syntax
+	DiffCommand string = "diff"
+	// FlagDiffOutput is the format to display differences in (text or json)
+	FlagDiffOutput string = "output"
+)
+
+// diffCmd represents the command to compare saved artefacts
+var diffCmd = &cobra.Command{
+	Use:   DiffCommand + " OLD NEW",
+	Short: "compares two sets of saved artefacts",
+	Long:  "will list the artefacts added, removed and changed between two archive dirs or checksum files",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(c *cobra.Command, args []string) error {
+		return diff(c, args[0], args[1])
+	},
+}
+
+// artefactsDiff is the difference between two sets of artefacts
+type artefactsDiff struct {
+	Old       string         `json:"old"`
+	New       string         `json:"new"`
+	Added     []inspectEntry `json:"added"`
+	Removed   []inspectEntry `json:"removed"`
+	Changed   []changedEntry `json:"changed"`
+	Unchanged int            `json:"unchanged"`
+}
+
+// changedEntry is an artefact present in both sets with different content
+type changedEntry struct {
+	// Name is the image repository, git repo name or file name
+	Name string       `json:"name"`
+	Type string       `json:"type"`
+	Old  inspectEntry `json:"old"`
+	New  inspectEntry `json:"new"`
+}
+
+func init() {
+	addFlagWithEnvDefault(
+		diffCmd,
+		FlagDiffOutput,
+		OutputText,
+		"the format to display differences in (text or json)")
+
+	RootCmd.AddCommand(diffCmd)
+}
+
+func diff(c *cobra.Command, oldPath string, newPath string) error {
+	common(c)
+	output := c.Flag(FlagDiffOutput).Value.String()
+	if output != OutputText && output != OutputJSON {
+		return fmt.Errorf(
+			"unknown output format %q, expecting %s or %s", output, OutputText, OutputJSON)
+	}
+	oldEntries, err := describeArtefacts(oldPath)
+	if err != nil {
+		return err
+	}
+	newEntries, err := describeArtefacts(newPath)
+	if err != nil {
+		return err
+	}
+	d := diffEntries(oldEntries, newEntries)
+	d.Old = oldPath
+	d.New = newPath
+	return d.print(output)
+}
+
+// describeArtefacts will describe the artefacts listed in an archive dir or
+// checksum file (keyed by how they are matched between sets)
+func describeArtefacts(path string) (map[string]inspectEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("missing archive dir or checksum file %s", path)
+	}
+	checkSumFile := path
+	if fi.IsDir() {
+		checkSumFile = filepath.Join(path, hashcache.DefaultCheckSumFileName)
+	}
+	chk, err := hashcache.NewFromCheckSumsFile(checkSumFile, true)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.Load(chk.Dir)
+	if err != nil {
+		log.Printf("no manifest, describing artefacts from file names:%s", err)
+		m = manifest.New(chk.Dir)
+	}
+	var described []inspectEntry
+	keys := make(map[string]int)
+	for _, item := range chk.CheckSumsByFilePath {
+		artefact := m.Get(item.FileName)
+		entry := describeFile(chk.Dir, item.FileName, artefact)
+		if entry.Type == typeMeta || entry.Type == manifest.TypeGitBase {
+			continue
+		}
+		entry.Sha256 = item.CheckSum
+		if artefact != nil && artefact.Encrypted {
+			// encrypted files differ every time so compare the decrypted files
+			entry.Sha256 = artefact.PlainSha256
+		}
+		described = append(described, entry)
+		keys[diffKey(entry)]++
+	}
+	entries := make(map[string]inspectEntry)
+	for _, entry := range described {
+		key := diffKey(entry)
+		if keys[key] > 1 {
+			// Images saved with several tags are matched by tag
+			key = entry.Type + ":" + entryName(entry)
+		}
+		entries[key] = entry
+	}
+	return entries, nil
+}
+
+// diffKey is how an artefact is matched with the same artefact in another set
+func diffKey(entry inspectEntry) string {
+	switch entry.Type {
+	case manifest.TypeDockerImage:
+		return entry.Type + ":" + imageRepo(entry.Image)
+	case manifest.TypeGit:
+		return entry.Type + ":" + git.GetRepoName(entry.File)
+	}
+	return entry.Type + ":" + entry.File
+}
+
+// diffEntries will work out what was added, removed and changed
+func diffEntries(oldEntries map[string]inspectEntry, newEntries map[string]inspectEntry) *artefactsDiff {
+	d := &artefactsDiff{
+		Added:   []inspectEntry{},
+		Removed: []inspectEntry{},
+		Changed: []changedEntry{},
+	}
+	for _, key := range sortedKeys(newEntries) {
+		newEntry := newEntries[key]
+		oldEntry, ok := oldEntries[key]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, newEntry)
+		case !sameContent(oldEntry, newEntry):
+			d.Changed = append(d.Changed, changedEntry{
+				Name: strings.SplitN(key, ":", 2)[1],
+				Type: newEntry.Type,
+				Old:  oldEntry,
+				New:  newEntry,
+			})
+		default:
+			d.Unchanged++
+		}
+	}
+	for _, key := range sortedKeys(oldEntries) {
+		if _, ok := newEntries[key]; !ok {
+			d.Removed = append(d.Removed, oldEntries[key])
+		}
+	}
+	return d
+}
+
+// sameContent will compare the image IDs of docker images and the commits of
+// git repos (their archives differ each time they are saved) or the sha256 of
+// other files
+func sameContent(oldEntry inspectEntry, newEntry inspectEntry) bool {
+	switch {
+	case newEntry.Type == manifest.TypeDockerImage && len(oldEntry.Digest) > 0 && len(newEntry.Digest) > 0:
+		return oldEntry.Digest == newEntry.Digest
+	case newEntry.Type == manifest.TypeGit && len(oldEntry.Commit) > 0 && len(newEntry.Commit) > 0:
+		return oldEntry.Commit == newEntry.Commit
+	}
+	return oldEntry.Sha256 == newEntry.Sha256
+}
+
+// imageRepo will remove any tag or digest from an image reference (registries
+// can have ports)
+func imageRepo(image string) string {
+	image = docker.StripRepoDigest(image)
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func sortedKeys(entries map[string]inspectEntry) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// print will display the differences as text or json
+func (d *artefactsDiff) print(output string) error {
+	if output == OutputJSON {
+		b, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+	fmt.Printf("Comparing %s with %s\n", d.Old, d.New)
+	fmt.Printf("Added:\n")
+	for _, entry := range d.Added {
+		fmt.Printf("  %-12s %s (%s)\n", entry.Type, entryName(entry), entryVersion(entry))
+	}
+	fmt.Printf("Removed:\n")
+	for _, entry := range d.Removed {
+		fmt.Printf("  %-12s %s (%s)\n", entry.Type, entryName(entry), entryVersion(entry))
+	}
+	fmt.Printf("Changed:\n")
+	for _, changed := range d.Changed {
+		fmt.Printf(
+			"  %-12s %s %s -> %s\n",
+			changed.Type,
+			changed.Name,
+			entryVersion(changed.Old),
+			entryVersion(changed.New))
+	}
+	fmt.Printf(
+		"%d added, %d removed, %d changed, %d unchanged\n",
+		len(d.Added),
+		len(d.Removed),
+		len(d.Changed),
+		d.Unchanged)
+	return nil
+}
+
+// entryName is the image reference or file name of an artefact
+func entryName(entry inspectEntry) string {
+	if len(entry.Image) > 0 {
+		return entry.Image
+	}
+	return entry.File
+}
+
+// entryVersion will display what identifies the content of an artefact, the
+// tag and digest for images, the commit for git repos or the sha256
+func entryVersion(entry inspectEntry) string {
+	switch {
+	case entry.Type == manifest.TypeDockerImage:
+		version := strings.TrimPrefix(entry.Image, imageRepo(entry.Image))
+		if len(entry.Digest) > 0 {
+			version += " " + shortID(entry.Digest)
+		}
+		return strings.TrimSpace(strings.TrimPrefix(version, ":"))
+	case entry.Type == manifest.TypeGit && len(entry.Commit) > 0:
+		return shortID(entry.Commit)
+	}
+	return "sha256:" + shortID(entry.Sha256)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/manifest"
+	"gotest.tools/assert"
+)
+
+func TestDiffEntries(t *testing.T) {
+	oldEntries := []inspectEntry{
+		{
+			File:   "app.git.tar",
+			Type:   manifest.TypeGit,
+			Sha256: "aaa",
+			Commit: "c1",
+		},
+		{
+			File:   "lib.git.tar",
+			Type:   manifest.TypeGit,
+			Sha256: "bbb",
+			Commit: "c2",
+		},
+		{
+			File:   "alpine.docker.tar",
+			Type:   manifest.TypeDockerImage,
+			Image:  "alpine:3.11",
+			Sha256: "ccc",
+			Digest: "sha256:d1",
+		},
+		{
+			File:   "helm.tgz",
+			Type:   manifest.TypeWebFile,
+			Sha256: "ddd",
+		},
+	}
+	newEntries := []inspectEntry{
+		// the tar is different each time but the commit is the same
+		{
+			File:   "app.git.tar",
+			Type:   manifest.TypeGit,
+			Sha256: "eee",
+			Commit: "c1",
+		},
+		{
+			File:   "lib.git.tar",
+			Type:   manifest.TypeGit,
+			Sha256: "bbb",
+			Commit: "c3",
+		},
+		{
+			File:   "alpine.docker.tar",
+			Type:   manifest.TypeDockerImage,
+			Image:  "alpine:3.11",
+			Sha256: "fff",
+			Digest: "sha256:d1",
+		},
+		{
+			File:   "helm.tgz",
+			Type:   manifest.TypeWebFile,
+			Sha256: "ggg",
+		},
+	}
+	d := diffEntries(byDiffKey(oldEntries), byDiffKey(newEntries))
+	assert.Equal(t, len(d.Added), 0)
+	assert.Equal(t, len(d.Removed), 0)
+	assert.Equal(t, d.Unchanged, 2)
+	assert.Equal(t, len(d.Changed), 2)
+	assert.Equal(t, d.Changed[0].Name, "lib")
+	assert.Equal(t, d.Changed[1].Name, "helm.tgz")
+}
+
+func byDiffKey(entries []inspectEntry) map[string]inspectEntry {
+	keyed := make(map[string]inspectEntry)
+	for _, entry := range entries {
+		keyed[diffKey(entry)] = entry
+	}
+	return keyed
+}
@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/appvia/artefactor/pkg/crypt"
+	"github.com/appvia/artefactor/pkg/docker"
+	"github.com/appvia/artefactor/pkg/git"
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// InspectCommand is the sub command syntax
+	InspectCommand string = "inspect"
+	// FlagInspectOutput is the format to list artefacts in (text or json)
+	FlagInspectOutput string = "output"
+
+	// typeMeta is for the files artefactor saves to describe the artefacts
+	typeMeta string = "meta"
+
+	checksumOK       string = "ok"
+	checksumMismatch string = "mismatch"
+	checksumMissing  string = "missing"
+	checksumUnlisted string = "unlisted"
+	// checksumUnchanged is for artefacts left out of a delta bundle
+	checksumUnchanged string = "not shipped (unchanged)"
+)
+
+// inspectCmd represents the command to describe saved artefacts
+var inspectCmd = &cobra.Command{
+	Use:   InspectCommand,
+	Short: "lists and describes saved artefacts",
+	Long:  "will list the artefacts in an archive dir with their type, size, checksum status and commit or digest",
+	RunE: func(c *cobra.Command, args []string) error {
+		return inspect(c)
+	},
+}
+
+// inspectEntry describes a saved artefact
+type inspectEntry struct {
+	File string `json:"file"`
+	Type string `json:"type"`
+	// Image is the decoded image reference for docker images
+	Image    string `json:"image,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+	Sha256   string `json:"sha256,omitempty"`
+	Commit   string `json:"commit,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	// Encrypted is set for artefacts saved encrypted (the checksum is of the
+	// encrypted file)
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+func init() {
+	addFlagWithEnvDefault(
+		inspectCmd,
+		FlagArchiveDir,
+		DefaultArchiveDir,
+		"a directory where artefacts exist")
+	addFlagWithEnvDefault(
+		inspectCmd,
+		FlagInspectOutput,
+		OutputText,
+		"the format to list artefacts in (text or json)")
+
+	RootCmd.AddCommand(inspectCmd)
+}
+
+func inspect(c *cobra.Command) error {
+	common(c)
+	dir := c.Flag(FlagArchiveDir).Value.String()
+	output := c.Flag(FlagInspectOutput).Value.String()
+	if output != OutputText && output != OutputJSON {
+		return fmt.Errorf(
+			"unknown output format %q, expecting %s or %s", output, OutputText, OutputJSON)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("missing archive directory %s", dir)
+	}
+	entries, err := inspectDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := printEntries(entries, output); err != nil {
+		return err
+	}
+	if failed := inspectFailures(entries); failed > 0 {
+		return fmt.Errorf("%d artefacts in %s are missing or do not match checksums", failed, dir)
+	}
+	return nil
+}
+
+// inspectFailures will count the artefacts missing or not matching checksums
+// (artefacts left out of a delta bundle as unchanged are expected to be missing)
+func inspectFailures(entries []inspectEntry) int {
+	failed := 0
+	for _, entry := range entries {
+		if entry.Checksum == checksumMismatch || entry.Checksum == checksumMissing {
+			failed++
+		}
+	}
+	return failed
+}
+
+// inspectDir will describe all the artefacts in the checksum file and any
+// other files in dir
+func inspectDir(dir string) ([]inspectEntry, error) {
+	chk, err := hashcache.NewFromDir(dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("problem with checksum file in folder %s:%s", dir, err)
+	}
+	m, err := manifest.Load(dir)
+	if err != nil {
+		log.Printf("no manifest, describing artefacts from file names:%s", err)
+		m = manifest.New(dir)
+	}
+	names := make(map[string]bool)
+	for _, item := range chk.CheckSumsByFilePath {
+		names[item.FileName] = true
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && fi.Name() != hashcache.DefaultCheckSumFileName {
+			names[fi.Name()] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	entries := make([]inspectEntry, 0, len(sorted))
+	for _, name := range sorted {
+		entries = append(entries, inspectFile(dir, name, m.Get(name), chk))
+	}
+	return entries, nil
+}
+
+// inspectFile will describe a single artefact and verify its checksum
+func inspectFile(dir string, name string, artefact *manifest.Artefact, chk *hashcache.CheckSumCache) inspectEntry {
+	file := filepath.Join(dir, name)
+	entry := describeFile(dir, name, artefact)
+	entry.Checksum = checksumUnlisted
+	if item, ok := chk.CheckSumsByFilePath[file]; ok {
+		entry.Sha256 = item.CheckSum
+		if entry.Encrypted && !crypt.IsEncrypted(file) {
+			// restored decrypted
+			entry.Encrypted = false
+			entry.Sha256 = artefact.PlainSha256
+		}
+		switch calcHash, err := hashcache.CalcChecksum(file); {
+		case os.IsNotExist(err) && artefact != nil && artefact.Unchanged:
+			entry.Checksum = checksumUnchanged
+		case os.IsNotExist(err):
+			entry.Checksum = checksumMissing
+		case err != nil || calcHash != entry.Sha256:
+			entry.Checksum = checksumMismatch
+		default:
+			entry.Checksum = checksumOK
+		}
+	}
+	return entry
+}
+
+// describeFile will describe an artefact, using the manifest where recorded and
+// the file itself otherwise (if present)
+func describeFile(dir string, name string, artefact *manifest.Artefact) inspectEntry {
+	file := filepath.Join(dir, name)
+	entry := inspectEntry{
+		File: name,
+		Type: artefactType(name),
+	}
+	if artefact != nil {
+		if len(artefact.Type) > 0 {
+			entry.Type = artefact.Type
+		}
+		entry.Source = artefact.Source
+		entry.Commit = artefact.Commit
+		entry.Digest = artefact.Digest
+		entry.Encrypted = artefact.Encrypted
+	}
+	if entry.Type == manifest.TypeDockerImage {
+		entry.Image, _ = docker.FilePathToImageName(name)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return entry
+	}
+	entry.Size = fi.Size()
+	switch {
+	case entry.Encrypted:
+		// can't be read without decrypting
+	case entry.Type == manifest.TypeDockerImage && len(entry.Digest) == 0:
+		if entry.Digest, err = docker.GetArchiveImageID(file); err != nil {
+			log.Printf("can't read image ID from %s:%s", file, err)
+		}
+	case entry.Type == manifest.TypeGit && len(entry.Commit) == 0:
+		if entry.Commit, err = git.GetArchiveCommit(file); err != nil {
+			log.Printf("can't read commit from %s:%s", file, err)
+		}
+	}
+	return entry
+}
+
+// artefactType will work out the type of an artefact from its file name (for
+// archives saved without a manifest)
+func artefactType(name string) string {
+	switch {
+	case name == manifest.FileName ||
+		name == manifest.LegacySaveDirFile ||
+		strings.HasSuffix(name, manifest.LegacyBinMarkExt):
+		return typeMeta
+	case strings.HasSuffix(name, docker.Ext):
+		return manifest.TypeDockerImage
+	case strings.HasSuffix(name, git.GitBaseExt):
+		return manifest.TypeGitBase
+	case git.GetRepoName(name) != name:
+		return manifest.TypeGit
+	case strings.HasPrefix(name, ArtefactorBinaryName):
+		return manifest.TypeArtefactor
+	}
+	return manifest.TypeWebFile
+}
+
+// printEntries will display the artefacts as a table or json
+func printEntries(entries []inspectEntry, output string) error {
+	if output == OutputJSON {
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TYPE\tARTEFACT\tSIZE\tCHECKSUM\tCOMMIT/DIGEST\n")
+	for _, entry := range entries {
+		name := entry.File
+		if len(entry.Image) > 0 {
+			name = entry.Image
+		}
+		version := entry.Commit
+		if len(entry.Digest) > 0 {
+			version = entry.Digest
+		}
+		if entry.Encrypted {
+			name += " (encrypted)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			entry.Type, name, humanSize(entry.Size), entry.Checksum, shortID(version))
+	}
+	return w.Flush()
+}
+
+// humanSize will display a size in bytes with units
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// shortID will abbreviate a commit or digest for display
+func shortID(id string) string {
+	prefix := ""
+	if strings.HasPrefix(id, "sha256:") {
+		prefix = "sha256:"
+		id = strings.TrimPrefix(id, prefix)
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return prefix + id
+}
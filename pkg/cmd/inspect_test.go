@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"gotest.tools/assert"
+)
+
+func TestInspectDeltaBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artefactor_inspect")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := hashcache.NewFromDir(dir, false)
+	assert.NilError(t, err)
+	m := manifest.New(dir)
+
+	changed := filepath.Join(dir, "changed.txt")
+	assert.NilError(t, ioutil.WriteFile(changed, []byte("changed"), 0644))
+	_, err = c.Update(changed)
+	assert.NilError(t, err)
+	m.Add(changed, manifest.TypeWebFile, "https://example.com/changed.txt", 0644)
+	// left out of the bundle
+	assert.NilError(t, c.Add(filepath.Join(dir, "unchanged.txt"), "abc"))
+	m.Add("unchanged.txt", manifest.TypeWebFile, "https://example.com/unchanged.txt", 0644).Unchanged = true
+	assert.NilError(t, c.Add(filepath.Join(dir, "missing.txt"), "def"))
+	m.Add("missing.txt", manifest.TypeWebFile, "https://example.com/missing.txt", 0644)
+	assert.NilError(t, m.Save(c))
+
+	entries, err := inspectDir(dir)
+	assert.NilError(t, err)
+	checksums := make(map[string]string)
+	for _, entry := range entries {
+		checksums[entry.File] = entry.Checksum
+	}
+	assert.Equal(t, checksums["changed.txt"], checksumOK)
+	assert.Equal(t, checksums["unchanged.txt"], checksumUnchanged)
+	assert.Equal(t, checksums["missing.txt"], checksumMissing)
+	assert.Equal(t, inspectFailures(entries), 1)
+}
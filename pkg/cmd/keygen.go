@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/appvia/artefactor/pkg/crypt"
+	"github.com/spf13/cobra"
+)
+
+// KeygenCommand is the sub command syntax
+const KeygenCommand string = "keygen"
+
+// keygenCmd represents the command to create keys to encrypt artefacts to
+var keygenCmd = &cobra.Command{
+	Use:   KeygenCommand,
+	Short: "creates a key pair to encrypt artefacts",
+	Long:  "will save a new secret key (identity) to a file and display the public key to encrypt artefacts to",
+	RunE: func(c *cobra.Command, args []string) error {
+		return keygen(c)
+	},
+}
+
+func init() {
+	addFlagWithEnvDefault(
+		keygenCmd,
+		FlagIdentity,
+		"",
+		"a file to save the secret key to (must not exist)")
+
+	RootCmd.AddCommand(keygenCmd)
+}
+
+func keygen(c *cobra.Command) error {
+	common(c)
+	file := c.Flag(FlagIdentity).Value.String()
+	if len(file) == 0 {
+		return fmt.Errorf("must specify --%s file to save the secret key to", FlagIdentity)
+	}
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("identity file %s already exists, refusing to overwrite", file)
+	}
+	id, err := crypt.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("# public key: %s\n%s\n", id.Recipient(), id)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		return fmt.Errorf("problem saving identity file %s:%s", file, err)
+	}
+	fmt.Printf("Public key: %s\n", id.Recipient())
+	return nil
+}
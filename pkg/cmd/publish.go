@@ -2,10 +2,15 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 
+	"github.com/appvia/artefactor/pkg/crypt"
 	"github.com/appvia/artefactor/pkg/docker"
 	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
 	"github.com/spf13/cobra"
 )
 
@@ -38,6 +43,18 @@ func init() {
 		"",
 		"where to publish images e.g. private-registry.local")
 
+	addFlagWithEnvDefault(
+		publishCmd,
+		FlagIdentity,
+		"",
+		"a whitespace seperated list of files with secret keys to decrypt artefacts with")
+
+	addFlagWithEnvDefault(
+		publishCmd,
+		FlagPassphraseFile,
+		"",
+		"a file with a passphrase to decrypt artefacts with")
+
 	addFlagWithEnvDefault(
 		publishCmd,
 		FlagDockerUserName,
@@ -62,11 +79,14 @@ func publish(c *cobra.Command) error {
 	}
 	// get the registry (if specified)
 	registry := c.Flag(FlagDockerRegistry).Value.String()
-	files := hashcache.GetFiles(src)
-	images, err := docker.GetImages(files, registry)
+	m, err := manifest.Load(src)
 	if err != nil {
-		return fmt.Errorf(
-			"problem getting a list of images from file names in %s:%s", src, err)
+		log.Printf("no manifest, publishing images as saved:%s", err)
+		m = manifest.New(src)
+	}
+	images, err := getPublishImages(src, registry, m)
+	if err != nil {
+		return err
 	}
 	if len(images) > 0 {
 		// Complain if we've been asked to publish any containers
@@ -76,9 +96,26 @@ func publish(c *cobra.Command) error {
 	} else {
 		fmt.Printf("No images to publish\n")
 	}
+	identities, err := getIdentities(c)
+	if err != nil {
+		return err
+	}
 	for _, image := range images {
+		a := m.Get(filepath.Base(image.FileName))
+		if a != nil && a.BaseLayers > 0 {
+			// the layers left out are loaded from the image published before
+			baseImage := docker.GetPublishedName(a.BaseImage, registry)
+			fmt.Printf("Pulling %s for the layers left out of %s\n", baseImage, image.FileName)
+			if err := docker.Pull(baseImage, getCredsFromFlags(c)); err != nil {
+				return fmt.Errorf(
+					"problem pulling %s with the layers left out of %s (it must be published first):%s",
+					baseImage,
+					image.FileName,
+					err)
+			}
+		}
 		fmt.Printf("Loading image from %s\n", image.FileName)
-		if err := docker.Load(&image); err != nil {
+		if err := loadImage(&image, a, identities); err != nil {
 			return fmt.Errorf("load image problem for %s:%s", image.FileName, err)
 		}
 		if err := docker.ReTag(&image); err != nil {
@@ -98,3 +135,62 @@ func publish(c *cobra.Command) error {
 	}
 	return nil
 }
+
+// getPublishImages gets the images saved in the archive dir, leaving out any
+// unchanged images not shipped in a delta bundle (they must have been published
+// from the previous bundle)
+func getPublishImages(src string, registry string, m *manifest.Manifest) ([]docker.Image, error) {
+	images, err := docker.GetImages(hashcache.GetFiles(src), registry)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"problem getting a list of images from file names in %s:%s", src, err)
+	}
+	var shipped []docker.Image
+	for _, image := range images {
+		if a := m.Get(filepath.Base(image.FileName)); a != nil && a.Unchanged {
+			fmt.Printf(
+				"Skipping %s, unchanged since the previous bundle (it must already be published)\n",
+				image.FileName)
+			continue
+		}
+		shipped = append(shipped, image)
+	}
+	return shipped, nil
+}
+
+// loadImage will load a saved image (decrypting it first when encrypted)
+func loadImage(image *docker.Image, a *manifest.Artefact, identities []crypt.Identity) error {
+	if a == nil || !a.Encrypted {
+		return docker.Load(image)
+	}
+	plainFile, err := decryptImage(image.FileName, identities)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(plainFile))
+	plainImage := *image
+	plainImage.FileName = plainFile
+	err = docker.Load(&plainImage)
+	image.ImageID = plainImage.ImageID
+	return err
+}
+
+// decryptImage will decrypt a saved image to a temporary dir to be loaded
+func decryptImage(file string, identities []crypt.Identity) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "artefactor_decrypted")
+	if err != nil {
+		return "", fmt.Errorf("problem creating temp dir to decrypt images:%s", err)
+	}
+	plainFile := filepath.Join(tmpDir, filepath.Base(file))
+	fmt.Printf("Decrypting %s\n", file)
+	if err := crypt.DecryptFile(file, plainFile, identities); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf(
+			"problem decrypting %s (specify --%s or --%s):%s",
+			file,
+			FlagIdentity,
+			FlagPassphraseFile,
+			err)
+	}
+	return plainFile, nil
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"gotest.tools/assert"
+)
+
+func TestGetPublishImagesDeltaBundle(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_publish")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	prevDir := filepath.Join(tmp, "prev")
+	saveDir := filepath.Join(tmp, "downloads")
+	bundleDir := filepath.Join(tmp, "bundle")
+	assert.NilError(t, os.MkdirAll(prevDir, 0755))
+	assert.NilError(t, os.MkdirAll(saveDir, 0755))
+
+	// alpine was shipped before and busybox has changed
+	since, err := hashcache.NewFromDir(prevDir, false)
+	assert.NilError(t, err)
+	prev := manifest.New(prevDir)
+	c, err := hashcache.NewFromDir(saveDir, false)
+	assert.NilError(t, err)
+	m := manifest.New(saveDir)
+	for name, content := range map[string]string{
+		"alpine~~3.11.docker.tar":  "alpine",
+		"busybox~~1.31.docker.tar": "busybox v2",
+	} {
+		file := filepath.Join(saveDir, name)
+		assert.NilError(t, ioutil.WriteFile(file, []byte(content), 0644))
+		_, err := c.Update(file)
+		assert.NilError(t, err)
+		m.Add(file, manifest.TypeDockerImage, name, 0644)
+	}
+	alpineSum, err := hashcache.CalcChecksum(filepath.Join(saveDir, "alpine~~3.11.docker.tar"))
+	assert.NilError(t, err)
+	assert.NilError(t, since.Add(filepath.Join(prevDir, "alpine~~3.11.docker.tar"), alpineSum))
+	prev.Add("alpine~~3.11.docker.tar", manifest.TypeDockerImage, "alpine:3.11", 0644)
+	assert.NilError(t, since.Add(filepath.Join(prevDir, "busybox~~1.31.docker.tar"), "aaa"))
+	prev.Add("busybox~~1.31.docker.tar", manifest.TypeDockerImage, "busybox:1.31", 0644)
+	assert.NilError(t, prev.Save(since))
+	assert.NilError(t, since.Clean())
+	assert.NilError(t, saveBundle(c, m, bundleDir, since, false, nil))
+
+	bm, err := manifest.Load(bundleDir)
+	assert.NilError(t, err)
+	images, err := getPublishImages(bundleDir, "localhost:5000", bm)
+	assert.NilError(t, err)
+	// the unchanged image isn't in the bundle to load
+	assert.Equal(t, len(images), 1)
+	assert.Equal(t, filepath.Base(images[0].FileName), "busybox~~1.31.docker.tar")
+	assert.Equal(t, images[0].NewImageName, "localhost:5000/busybox")
+
+	// all the images in the archive dir are published
+	images, err = getPublishImages(saveDir, "localhost:5000", m)
+	assert.NilError(t, err)
+	assert.Equal(t, len(images), 2)
+}
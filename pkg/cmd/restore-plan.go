@@ -0,0 +1,502 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/crypt"
+	"github.com/appvia/artefactor/pkg/git"
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+)
+
+const (
+	actionExtract string = "extract"
+	actionReplace string = "replace"
+	actionClone   string = "clone"
+	actionFetch   string = "fetch"
+	actionMove    string = "move"
+	actionCopy    string = "copy"
+	actionKeep    string = "keep"
+)
+
+// restorePlan is what a restore will change
+type restorePlan struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// ArtefactsDir is where all the artefacts are restored to
+	ArtefactsDir string `json:"artefactsDir"`
+	// Mode is move or copy
+	Mode string `json:"mode"`
+	// ModeReason is set when the mode is not the default
+	ModeReason string       `json:"modeReason,omitempty"`
+	Repos      []repoAction `json:"repos"`
+	Files      []fileAction `json:"files"`
+	// Missing and Invalid are the files that stop the restore
+	Missing []string `json:"missing,omitempty"`
+	Invalid []string `json:"invalid,omitempty"`
+}
+
+// repoAction is how a git repo will be restored
+type repoAction struct {
+	Archive string `json:"archive"`
+	Path    string `json:"path"`
+	Home    bool   `json:"home"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+}
+
+// fileAction is what will happen to an artefact file
+type fileAction struct {
+	File   string `json:"file"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Mode   string `json:"mode"`
+	Owner  string `json:"owner,omitempty"`
+	// Encrypted is set when the source is decrypted as it is restored
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Strip and Keep are how an archive is extracted (the source is the
+	// archive restored and the target the dir extracted to)
+	Strip int      `json:"strip,omitempty"`
+	Keep  []string `json:"keep,omitempty"`
+	// checked is set for files in the checksum file
+	checked bool
+	// checksum is the expected checksum for checked files
+	checksum string
+	// mode is set when the manifest records the mode to restore with
+	mode os.FileMode
+}
+
+// plan will check everything needed is present and valid BEFORE any files are
+// changed and work out what will be changed (the plan is also returned when
+// files are missing or invalid so they can be reported)
+func (r *restoreJob) plan() (*restorePlan, error) {
+	plan := &restorePlan{
+		Source:       r.src,
+		Destination:  r.dst,
+		ArtefactsDir: r.dstDir,
+		Mode:         actionMove,
+	}
+	if !r.move {
+		plan.Mode = actionCopy
+	}
+	log.Printf("dst:%s\nRepo:%s\nSavedDir:%s\n==>%s", r.dst, r.repoPath, r.savedDir, r.dstDir)
+	refresh := false
+	if _, err := os.Stat(r.dstDir); err == nil {
+		refresh = true
+	}
+	if r.homeRepo != "" {
+		home, err := r.planRepo(r.homeRepo, r.repoPath)
+		if err != nil {
+			return nil, err
+		}
+		home.Home = true
+		if home.Action == actionReplace {
+			home.Reason += " (artefacts are kept)"
+		}
+		plan.Repos = append(plan.Repos, home)
+	}
+	for _, otherRepo := range r.otherRepos {
+		repo, err := r.planRepo(otherRepo, r.repoPaths[otherRepo])
+		if err != nil {
+			return nil, err
+		}
+		plan.Repos = append(plan.Repos, repo)
+	}
+
+	var missingFiles []string
+	// set when files left out of a delta bundle haven't been restored
+	missingUnchanged := false
+	var invalidFiles []string
+	// the dirs archives are extracted to
+	extracts := make(map[string]bool)
+	// Verify if we have everything we need BEFORE moving files
+	// Check we have all files in source OR destination BEFORE we start to copy...
+	srcChk, err := hashcache.NewFromDir(r.src, true)
+	if err != nil {
+		return nil, fmt.Errorf("problem with checksum file in folder %s:%s", r.src, err)
+	}
+	plan.Files = append(plan.Files, fileAction{
+		File:   hashcache.DefaultCheckSumFileName,
+		Source: srcChk.CheckSumFile,
+		Target: filepath.Join(r.dstDir, hashcache.DefaultCheckSumFileName),
+		Action: actionCopy,
+		Reason: "lists the artefacts restored",
+		Mode:   fileMode(srcChk.CheckSumFile),
+	})
+
+	log.Printf("items in cache %v", len(srcChk.CheckSumsByFilePath))
+	r.printf("Checking source artefacts\n")
+	srcFiles := make([]string, 0, len(srcChk.CheckSumsByFilePath))
+	for srcFile := range srcChk.CheckSumsByFilePath {
+		srcFiles = append(srcFiles, srcFile)
+	}
+	sort.Strings(srcFiles)
+	for _, srcFile := range srcFiles {
+		item := srcChk.CheckSumsByFilePath[srcFile]
+		artefact := r.manifest.Get(item.FileName)
+		dstFile, err := r.targetPath(artefact, item.FileName)
+		if err != nil {
+			return nil, err
+		}
+		mode, setMode, err := artefact.FileMode()
+		if err != nil {
+			return nil, err
+		}
+		_, dstErr := os.Stat(dstFile)
+		// Only worry if the file referred from the checksum file doesn't exist
+		if _, err := os.Stat(item.FilePath); err == nil {
+			log.Printf("file present in cache and disk %s", item.FilePath)
+			if err := r.checkSum(item.FilePath, item.CheckSum); err != nil {
+				r.printf("Error: %s\n", err)
+				invalidFiles = append(invalidFiles, item.FilePath)
+			}
+			file := fileAction{
+				File:     item.FileName,
+				Source:   item.FilePath,
+				Target:   dstFile,
+				Action:   plan.Mode,
+				Mode:     fileMode(item.FilePath),
+				checked:  true,
+				checksum: item.CheckSum,
+			}
+			if dstErr == nil {
+				file.Reason = "replaces existing file"
+			}
+			if artefact != nil && artefact.Encrypted {
+				// checked once decrypted
+				if err := crypt.Check(item.FilePath, r.identities); err != nil {
+					return nil, fmt.Errorf(
+						"can't decrypt %s (specify --%s or --%s):%s",
+						item.FilePath,
+						FlagIdentity,
+						FlagPassphraseFile,
+						err)
+				}
+				file.Encrypted = true
+				file.checksum = artefact.PlainSha256
+			}
+			plan.Files = append(plan.Files, file.withMeta(artefact, mode, setMode))
+			if err := r.planExtract(plan, artefact, dstFile, extracts); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		log.Printf("file present in cache and missing on disk %s", item.FilePath)
+		// if refreshing then check if file exists in destination...
+		if !refresh || dstErr != nil {
+			// File not in source or destination!
+			log.Printf("file missing from source and destination %s", item.FilePath)
+			missingFiles = append(missingFiles, item.FilePath)
+			missingUnchanged = missingUnchanged || (artefact != nil && artefact.Unchanged)
+			continue
+		}
+		// File only in destination so we need to check it's the right one:
+		r.printf("Checking existing file (no update provided) %s\n", dstFile)
+		checksum := item.CheckSum
+		if artefact != nil && artefact.Encrypted {
+			// restored decrypted
+			checksum = artefact.PlainSha256
+		}
+		if err := r.checkSum(dstFile, checksum); err != nil {
+			r.printf("Error: %s\n", err)
+			invalidFiles = append(invalidFiles, dstFile)
+		}
+		file := fileAction{
+			File:     item.FileName,
+			Target:   dstFile,
+			Action:   actionKeep,
+			Reason:   "not in source, existing file matches checksum",
+			Mode:     fileMode(dstFile),
+			checked:  true,
+			checksum: checksum,
+		}
+		if artefact != nil && artefact.Unchanged {
+			file.Reason = "unchanged since the previous bundle, existing file matches checksum"
+		}
+		plan.Files = append(plan.Files, file.withMeta(artefact, mode, setMode))
+		if err := r.planExtract(plan, artefact, dstFile, extracts); err != nil {
+			return nil, err
+		}
+	}
+	plan.Missing = missingFiles
+	plan.Invalid = invalidFiles
+	if len(missingFiles) > 0 {
+		listFiles("Missing files", missingFiles)
+		if missingUnchanged {
+			return plan, fmt.Errorf(
+				"%s is a delta bundle and files unchanged since the previous bundle are not in destination %s, restore the previous bundle first",
+				r.src,
+				r.dstDir)
+		}
+		return plan, fmt.Errorf(
+			"files in checksum file %s not present in source %s or destination %s",
+			srcChk.CheckSumFile,
+			r.src,
+			r.dstDir)
+	}
+	if len(invalidFiles) > 0 {
+		listFiles("Invalid files", invalidFiles)
+		return plan, fmt.Errorf(
+			"files in checksum file %s are present but do not match checksums",
+			srcChk.CheckSumFile)
+	}
+
+	// Any other files already restored are kept as is
+	if refresh {
+		existing, _ := ioutil.ReadDir(r.dstDir)
+		for _, fi := range existing {
+			if _, ok := srcChk.CheckSumsByFilePath[filepath.Join(r.src, fi.Name())]; ok ||
+				fi.Name() == hashcache.DefaultCheckSumFileName ||
+				extracts[filepath.Join(r.dstDir, fi.Name())] {
+				continue
+			}
+			plan.Files = append(plan.Files, fileAction{
+				File:   fi.Name(),
+				Target: filepath.Join(r.dstDir, fi.Name()),
+				Action: actionKeep,
+				Reason: "not in checksum file",
+				Mode:   fmt.Sprintf("%04o", fi.Mode().Perm()),
+			})
+		}
+	}
+	return plan, nil
+}
+
+// listFiles will report the files that stop a restore (on stderr so any json
+// plan on stdout can still be parsed)
+func listFiles(title string, files []string) {
+	fmt.Fprintf(os.Stderr, "%s:\n", title)
+	for _, file := range files {
+		fmt.Fprintf(os.Stderr, "  %s\n", file)
+	}
+}
+
+// targetPath will return where an artefact is restored to, it must be within
+// the home repo (or the artefacts dir without a home repo)
+func (r *restoreJob) targetPath(artefact *manifest.Artefact, name string) (string, error) {
+	target := filepath.Join(r.dstDir, artefact.TargetPath(name))
+	return target, r.checkTarget(target, name)
+}
+
+// planExtract will add extracting an archive to the dir recorded in the
+// manifest (after the archive is restored to archiveTarget)
+func (r *restoreJob) planExtract(
+	plan *restorePlan,
+	artefact *manifest.Artefact,
+	archiveTarget string,
+	extracts map[string]bool) error {
+
+	if artefact == nil || len(artefact.Extract) == 0 {
+		return nil
+	}
+	dir := filepath.Join(r.dstDir, filepath.Clean(artefact.Extract))
+	if err := r.checkTarget(dir, artefact.Name); err != nil {
+		return err
+	}
+	// the dir is replaced so mustn't hold the artefacts or the archive
+	for _, path := range []string{r.dstDir, archiveTarget} {
+		if rel, err := filepath.Rel(dir, path); err != nil || !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("can't extract %s to %s, it would replace %s", artefact.Name, dir, path)
+		}
+	}
+	if extracts[dir] {
+		return fmt.Errorf("can't extract %s to %s, another archive is extracted there", artefact.Name, dir)
+	}
+	extracts[dir] = true
+	reason := "replaces anything extracted before"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		reason = "new dir"
+	}
+	plan.Files = append(plan.Files, fileAction{
+		File:   artefact.Name,
+		Source: archiveTarget,
+		Target: dir,
+		Action: actionExtract,
+		Reason: reason,
+		Strip:  artefact.StripComponents,
+		Keep:   artefact.ExtractKeep,
+	})
+	return nil
+}
+
+// checkTarget will verify a target is within the home repo (or the artefacts
+// dir without a home repo)
+func (r *restoreJob) checkTarget(target string, name string) error {
+	root := r.dstDir
+	if r.homeRepo != "" {
+		root = r.repoPath
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || outsideRoot(rel) {
+		return fmt.Errorf(
+			"restore target %s for %s must be within %s", target, name, root)
+	}
+	return nil
+}
+
+// outsideRoot will report if a path relative to the root it's restored to is
+// outside it (or is the root or in its .git dir)
+func outsideRoot(rel string) bool {
+	return rel == "." || rel == ".." || rel == ".git" ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) ||
+		strings.HasPrefix(rel, ".git"+string(filepath.Separator))
+}
+
+// withMeta will add the mode and owner recorded in the manifest
+func (f fileAction) withMeta(artefact *manifest.Artefact, mode os.FileMode, setMode bool) fileAction {
+	if setMode {
+		f.mode = mode
+		f.Mode = fmt.Sprintf("%04o", mode)
+	}
+	if artefact != nil {
+		f.Owner = artefact.Owner
+	}
+	return f
+}
+
+// planRepo will work out how a git repo is restored, existing repos must be
+// clean
+func (r *restoreJob) planRepo(gitRepoFile string, repoPath string) (repoAction, error) {
+	repo := repoAction{
+		Archive: gitRepoFile,
+		Path:    repoPath,
+	}
+	_, err := os.Stat(repoPath)
+	exists := err == nil
+	if exists {
+		// Add check for clean destination git repo...
+		if err := checkRepoClean(repoPath); err != nil {
+			return repo, err
+		}
+	}
+	artefact := r.manifest.Get(filepath.Base(gitRepoFile))
+	if artefact != nil && artefact.Unchanged {
+		// Left out of a delta bundle so it must already be restored
+		if !exists {
+			return repo, fmt.Errorf(
+				"git repo %s is unchanged since the previous bundle but not restored at %s, restore the previous bundle first",
+				filepath.Base(gitRepoFile),
+				repoPath)
+		}
+		if len(artefact.Commit) > 0 && !git.HasCommit(repoPath, artefact.Commit) {
+			return repo, fmt.Errorf(
+				"git repo %s doesn't have commit %s from the previous bundle, restore the previous bundle first",
+				repoPath,
+				artefact.Commit)
+		}
+		repo.Action = actionKeep
+		repo.Reason = "unchanged since the previous bundle, existing repo kept"
+		return repo, nil
+	}
+	refresh := r.refresh
+	switch {
+	case git.IsBundle(gitRepoFile) && exists:
+		repo.Action = actionFetch
+		repo.Reason = "repo exists, branches and tags are fast-forwarded from the bundle"
+	case git.IsBundle(gitRepoFile):
+		repo.Action = actionClone
+		repo.Reason = "new repo cloned from the bundle"
+	case exists && refresh == git.RefreshFetch:
+		repo.Action = actionFetch
+		repo.Reason = "repo exists, branches and tags are fast-forwarded from the archive (local branches, remotes and config are kept)"
+	case exists:
+		repo.Action = actionReplace
+		repo.Reason = "repo exists, working tree and .git are replaced"
+	default:
+		repo.Action = actionExtract
+		repo.Reason = "new repo extracted"
+	}
+	return repo, nil
+}
+
+// checkSum will verify a file against the checksum expected
+func (r *restoreJob) checkSum(file string, checksum string) error {
+	calcHash, err := hashcache.CalcChecksum(file)
+	if err != nil {
+		return err
+	}
+	if checksum != calcHash {
+		return fmt.Errorf(
+			"checksum failed for %s, expecting %s but got %s",
+			file,
+			checksum,
+			calcHash)
+	}
+	r.printf("  Checksum:OK %s\n", filepath.Base(file))
+	return nil
+}
+
+// fileMode will display the permissions a file will be restored with
+func fileMode(file string) string {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%04o", fi.Mode().Perm())
+}
+
+// print will display the plan as text or json
+func (p *restorePlan) print(output string) error {
+	if output == OutputJSON {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+	fmt.Printf("Restore plan (dry-run, nothing has been changed)\n")
+	fmt.Printf("  Source:      %s\n", p.Source)
+	fmt.Printf("  Destination: %s\n", p.Destination)
+	fmt.Printf("  Artefacts:   %s (%s)\n", p.ArtefactsDir, p.Mode)
+	if len(p.ModeReason) > 0 {
+		fmt.Printf("  %s\n", p.ModeReason)
+	}
+	fmt.Printf("Git repos:\n")
+	if len(p.Repos) == 0 {
+		fmt.Printf("  (none)\n")
+	}
+	for _, repo := range p.Repos {
+		home := ""
+		if repo.Home {
+			home = " (home)"
+		}
+		fmt.Printf("  %-8s %s -> %s%s\n", repo.Action, repo.Archive, repo.Path, home)
+		fmt.Printf("           %s\n", repo.Reason)
+	}
+	fmt.Printf("Files:\n")
+	for _, file := range p.Files {
+		reason := ""
+		if len(file.Reason) > 0 {
+			reason = ", " + file.Reason
+		}
+		owner := ""
+		if len(file.Owner) > 0 {
+			owner = ", owner " + file.Owner
+		}
+		if file.Encrypted {
+			reason += ", decrypted"
+		}
+		if file.Action == actionExtract {
+			if file.Strip > 0 {
+				reason += fmt.Sprintf(", stripping %d", file.Strip)
+			}
+			if len(file.Keep) > 0 {
+				reason += ", keeping " + strings.Join(file.Keep, " ")
+			}
+			fmt.Printf("  %-8s %s -> %s (%s)\n", file.Action, file.File, file.Target, strings.TrimPrefix(reason, ", "))
+			continue
+		}
+		fmt.Printf("  %-8s %s -> %s (mode %s%s%s)\n", file.Action, file.File, file.Target, file.Mode, owner, reason)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"gotest.tools/assert"
+)
+
+// captureStdout will return what fn writes to stdout
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	r, w, err := os.Pipe()
+	assert.NilError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	fnErr := fn()
+	os.Stdout = stdout
+	assert.NilError(t, w.Close())
+	b, err := ioutil.ReadAll(r)
+	assert.NilError(t, err)
+	return string(b), fnErr
+}
+
+func TestPlanJSONMissingFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_plan")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	m := newTestSource(t, src, map[string]string{"present.txt": "present", "missing.txt": "missing"})
+	assert.NilError(t, os.Remove(filepath.Join(src, "missing.txt")))
+	invalid := filepath.Join(src, "invalid.txt")
+	assert.NilError(t, ioutil.WriteFile(invalid, []byte("changed"), 0644))
+	c, err := hashcache.NewFromDir(src, false)
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(invalid, "aaa"))
+
+	job := newRestoreJob(src, "", filepath.Join(tmp, "dst"), m.SaveDir, nil, false)
+	job.manifest = m
+	job.quiet = true
+	out, err := captureStdout(t, func() error {
+		plan, err := job.plan()
+		assert.Assert(t, plan != nil)
+		assert.NilError(t, plan.print(OutputJSON))
+		return err
+	})
+	assert.ErrorContains(t, err, "not present in source")
+
+	var plan restorePlan
+	assert.NilError(t, json.Unmarshal([]byte(out), &plan), out)
+	assert.DeepEqual(t, plan.Missing, []string{filepath.Join(src, "missing.txt")})
+	assert.DeepEqual(t, plan.Invalid, []string{invalid})
+}
+
+func TestPlanPrint(t *testing.T) {
+	plan := &restorePlan{
+		Source:       "/media/usb",
+		Destination:  "/work",
+		ArtefactsDir: "/work/app/downloads",
+		Mode:         actionCopy,
+		ModeReason:   "Source /media/usb is on removable or read-only media",
+		Repos: []repoAction{
+			{Archive: "/media/usb/app.git.home.tar", Path: "/work/app", Home: true, Action: actionExtract, Reason: "new repo extracted"},
+		},
+		Files: []fileAction{
+			{File: "kd", Source: "/media/usb/kd", Target: "/work/app/downloads/kd", Action: actionCopy, Mode: "0755", Owner: "app"},
+			{File: "secret.key", Source: "/media/usb/secret.key", Target: "/work/app/downloads/secret.key", Action: actionCopy, Mode: "0600", Encrypted: true},
+			{File: "tools.tar.gz", Source: "/work/app/downloads/tools.tar.gz", Target: "/work/app/tools", Action: actionExtract, Reason: "new dir", Strip: 1, Keep: []string{"*.conf"}},
+			{File: "old.txt", Target: "/work/app/downloads/old.txt", Action: actionKeep, Reason: "not in checksum file", Mode: "0644"},
+		},
+	}
+	tests := []struct {
+		output   string
+		expected []string
+	}{
+		{
+			output: OutputText,
+			expected: []string{
+				"Restore plan (dry-run, nothing has been changed)",
+				"  Artefacts:   /work/app/downloads (copy)",
+				"  Source /media/usb is on removable or read-only media",
+				"  extract  /media/usb/app.git.home.tar -> /work/app (home)",
+				"  copy     kd -> /work/app/downloads/kd (mode 0755, owner app)",
+				"  copy     secret.key -> /work/app/downloads/secret.key (mode 0600, decrypted)",
+				"  extract  tools.tar.gz -> /work/app/tools (new dir, stripping 1, keeping *.conf)",
+				"  keep     old.txt -> /work/app/downloads/old.txt (mode 0644, not in checksum file)",
+			},
+		},
+		{
+			output: OutputJSON,
+			expected: []string{
+				`"artefactsDir": "/work/app/downloads"`,
+				`"home": true`,
+				`"owner": "app"`,
+				`"encrypted": true`,
+				`"strip": 1`,
+			},
+		},
+	}
+	for _, test := range tests {
+		out, err := captureStdout(t, func() error {
+			return plan.print(test.output)
+		})
+		assert.NilError(t, err)
+		for _, expected := range test.expected {
+			assert.Assert(t, strings.Contains(out, expected), "expecting %q in %s output:\n%s", expected, test.output, out)
+		}
+		if test.output == OutputJSON {
+			var printed restorePlan
+			assert.NilError(t, json.Unmarshal([]byte(out), &printed))
+			assert.DeepEqual(t, printed.Repos, plan.Repos)
+			assert.Equal(t, len(printed.Files), len(plan.Files))
+			assert.Equal(t, printed.ModeReason, plan.ModeReason)
+		}
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/appvia/artefactor/pkg/crypt"
 	"github.com/appvia/artefactor/pkg/git"
 	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/journal"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"github.com/appvia/artefactor/pkg/tar"
 	"github.com/appvia/artefactor/pkg/util"
 	"github.com/spf13/cobra"
 )
@@ -18,6 +23,30 @@ const (
 	RestoreCommand       string = "restore"
 	FlagRestoreSourceDir string = "source-dir"
 	FlagRestoreDestDir   string = "dest-dir"
+	// FlagRestoreGitReposDir is where to restore git repos other than the home
+	// repo (relative to the home repo)
+	FlagRestoreGitReposDir string = "git-repos-dir"
+	// FlagRestoreGitRepoMap maps saved git repo names to paths e.g. name=path
+	FlagRestoreGitRepoMap string = "git-repo-map"
+	// FlagRestoreMove will move artefacts from the source dir
+	FlagRestoreMove string = "move"
+	// FlagRestoreCopy will copy artefacts leaving the source dir intact
+	FlagRestoreCopy string = "copy"
+	// FlagRestoreResume will complete an interrupted restore
+	FlagRestoreResume string = "resume"
+	// FlagRestoreUndo will roll back an interrupted restore
+	FlagRestoreUndo string = "undo"
+	// FlagRestoreGitRefresh is how existing git repos are refreshed (replace
+	// or fetch)
+	FlagRestoreGitRefresh string = "git-refresh"
+	// FlagRestoreDryRun will only display what a restore would change
+	FlagRestoreDryRun string = "dry-run"
+	// FlagRestoreOutput is the format for the restore plan (text or json)
+	FlagRestoreOutput string = "output"
+	// OutputText displays a plan for people to read
+	OutputText string = "text"
+	// OutputJSON displays a plan for tools to read
+	OutputJSON string = "json"
 )
 
 // cleanupCmd represents the version command
@@ -43,6 +72,56 @@ func init() {
 		fmt.Sprintf(
 			"a directory to start the restore process from (${%s})",
 			GetEnvName(FlagRestoreDestDir)))
+	addFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreGitReposDir,
+		"",
+		"a directory to restore git repos other than the home repo to, relative to the home repo (default alongside the home repo)")
+	addFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreGitRepoMap,
+		"",
+		"a whitespace seperated list of saved git repo names and paths to restore them to (relative to dest-dir) e.g. name=path")
+	addFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreGitRefresh,
+		git.RefreshReplace,
+		"how existing git repos are refreshed, replace (with the archived repo) or fetch (fast-forward only, keeping local branches and config)")
+	addBoolFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreMove,
+		"move artefacts from the source dir (the default unless the source is removable or read-only)")
+	addBoolFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreCopy,
+		"copy artefacts and leave the source dir intact (the default for removable or read-only sources)")
+	addBoolFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreResume,
+		"complete an interrupted restore (from the journal in the dest-dir)")
+	addBoolFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreUndo,
+		"roll back an interrupted restore (from the journal in the dest-dir)")
+	addBoolFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreDryRun,
+		"display what would be restored without changing anything")
+	addFlagWithEnvDefault(
+		restoreCmd,
+		FlagRestoreOutput,
+		OutputText,
+		"the format to display a dry-run plan in (text or json)")
+	addFlagWithEnvDefault(
+		restoreCmd,
+		FlagIdentity,
+		"",
+		"a whitespace seperated list of files with secret keys to decrypt artefacts with")
+	addFlagWithEnvDefault(
+		restoreCmd,
+		FlagPassphraseFile,
+		"",
+		"a file with a passphrase to decrypt artefacts with")
 
 	RootCmd.AddCommand(restoreCmd)
 }
@@ -58,198 +137,615 @@ func restore(c *cobra.Command) error {
 		return fmt.Errorf("Could not determine absolute path to restore destination")
 	}
 
+	// An interrupted restore has to be resumed or undone first
+	dst = filepath.Clean(dst)
+	resumed, err := resumeOrUndo(c, dst)
+	if err != nil || resumed {
+		return err
+	}
+	dryRun, _ := c.Flags().GetBool(FlagRestoreDryRun)
+	output := c.Flag(FlagRestoreOutput).Value.String()
+	if output != OutputText && output != OutputJSON {
+		return fmt.Errorf(
+			"unknown output format %q, expecting %s or %s", output, OutputText, OutputJSON)
+	}
+	refresh := c.Flag(FlagRestoreGitRefresh).Value.String()
+	if refresh != git.RefreshReplace && refresh != git.RefreshFetch {
+		return fmt.Errorf(
+			"unknown git refresh mode %q, expecting %s or %s",
+			refresh,
+			git.RefreshReplace,
+			git.RefreshFetch)
+	}
 	if _, err := os.Stat(src); err != nil {
 		return fmt.Errorf("missing src directory (not found) %s", src)
 	}
+	move, moveReason, err := getMoveMode(c, src)
+	if err != nil {
+		return err
+	}
+	m, err := manifest.Load(src)
+	if err != nil {
+		return fmt.Errorf(
+			"problem retrieving meta data for archive directory from %s:%s",
+			src,
+			err)
+	}
 	// First re-create the 'home' git repo....
 	homeRepo, err := git.GetHomeRepo(src)
 	if err != nil {
 		return err
 	}
-
-	// Get the home repo if it exists
-	if homeRepo == "" {
-		return fmt.Errorf("Nothing to restore, no git home repo archive found in %s", src)
-	} else {
-
+	otherRepos, err := git.GetOtherRepos(src)
+	if err != nil {
+		return err
+	}
+	// Repos left out of a delta bundle must already be restored
+	homeRepo, otherRepos = addUnchangedRepos(m, src, homeRepo, otherRepos)
+	// Without a home repo, the artefacts are restored to the dest-dir
+	homePath := dst
+	if homeRepo != "" {
 		log.Printf("home repo is here %s", homeRepo)
-		restorePath, err := getRelativeSavedPath(src)
-		if err != nil {
-			return fmt.Errorf(
-				"problem retrieving meta data for archive directory from %s:%s",
-				src,
-				err)
-		}
-		if err := RestoreHome(homeRepo, dst, restorePath); err != nil {
-			return err
+		homePath = filepath.Join(dst, git.GetRepoName(homeRepo))
+	}
+	repoPaths, err := getRepoPaths(c, dst, homePath, otherRepos)
+	if err != nil {
+		return err
+	}
+	job := newRestoreJob(src, homeRepo, dst, m.SaveDir, repoPaths, move)
+	job.manifest = m
+	if job.identities, err = getIdentities(c); err != nil {
+		return err
+	}
+	// Only report progress when the plan is for people to read
+	job.quiet = dryRun && output == OutputJSON
+	job.refresh = refresh
+	plan, err := job.plan()
+	if plan != nil {
+		plan.ModeReason = moveReason
+	}
+	if err != nil {
+		if plan != nil && dryRun && output == OutputJSON {
+			// the files missing or invalid are in the plan
+			if printErr := plan.print(output); printErr != nil {
+				return printErr
+			}
 		}
-		return nil
+		return err
 	}
+	if dryRun {
+		return plan.print(output)
+	}
+	if len(moveReason) > 0 {
+		fmt.Printf("%s\n", moveReason)
+	}
+	return job.execute(plan)
 }
 
-// RestoreHome will restore the current repo and move all other archive files as
-// specified in the checksums file
-func RestoreHome(gitRepoFile string, dst string, savedDir string) error {
-
-	// Get the source directory from repo:
-	src := filepath.Dir(gitRepoFile)
-	// Get the git repo name from the file name...
-	repoName := strings.TrimSuffix(filepath.Base(gitRepoFile), git.GitFileHomeExt)
-
-	// Get the list of files from the checksum file (hashcache) in the source
-	// directory.
-	repoPath := filepath.Join(filepath.Clean(dst), repoName)
-	dstDir := filepath.Join(repoPath, filepath.Clean(savedDir))
-	refresh := false
-	log.Printf("dst:%s\nRepo:%s\nSavedDir:%s\n==>%s", dst, repoName, savedDir, dstDir)
-	if _, err := os.Stat(dstDir); err == nil {
-		refresh = true
-		// Add check for clean destination git repo...
-		clean, err := git.IsClean(repoPath)
-		if err != nil {
-			return fmt.Errorf("can't read git repo at %s:%s", repoPath, err)
+// addUnchangedRepos will add the git repos left out of a delta bundle (from the
+// manifest)
+func addUnchangedRepos(
+	m *manifest.Manifest,
+	src string,
+	homeRepo string,
+	otherRepos []string) (string, []string) {
+
+	for _, a := range m.Unchanged() {
+		if a.Type != manifest.TypeGit {
+			continue
 		}
-		if !clean {
-			return fmt.Errorf(
-				"destination repo is NOT clean, please clean then restore (%s)",
-				repoPath)
+		gitRepoFile := filepath.Join(src, a.Name)
+		if strings.HasSuffix(a.Name, git.GitFileHomeExt) || strings.HasSuffix(a.Name, git.GitBundleHomeExt) {
+			homeRepo = gitRepoFile
+		} else {
+			otherRepos = append(otherRepos, gitRepoFile)
 		}
 	}
+	return homeRepo, otherRepos
+}
 
-	var missingFiles []string
-	var invalidFiles []string
-	// Verify if we have everything we need BEFORE moving files
-	// Check we have all files in source OR destination BEFORE we start to copy...
-	srcChk, err := hashcache.NewFromDir(src, true)
+// getMoveMode will work out if artefacts should be moved or copied from src
+// (and why when not specified)
+func getMoveMode(c *cobra.Command, src string) (bool, string, error) {
+	move, _ := c.Flags().GetBool(FlagRestoreMove)
+	copyFiles, _ := c.Flags().GetBool(FlagRestoreCopy)
+	if move && copyFiles {
+		return false, "", fmt.Errorf(
+			"only one of --%s or --%s can be specified", FlagRestoreMove, FlagRestoreCopy)
+	}
+	if move || copyFiles {
+		return move, "", nil
+	}
+	removable, err := util.IsRemovable(src)
 	if err != nil {
-		return fmt.Errorf("problem with checksum file in folder %s:%s", src, err)
-	}
-
-	log.Printf("items in cache %v", len(srcChk.CheckSumsByFilePath))
-	for _, item := range srcChk.CheckSumsByFilePath {
-		// Only worry if the file referred from the checksum file doesn't exist
-		if _, err := os.Stat(item.FilePath); err == nil {
-			log.Printf("file present in cache and disk %s", item.FilePath)
-			err := calcAndCheckSum(item.FilePath, srcChk)
-			if err != nil {
-				fmt.Printf("Error: %s", err)
-				invalidFiles = append(invalidFiles, item.FilePath)
-			}
-		} else {
-			log.Printf("file present in cache and missing on disk %s", item.FilePath)
-			// if refreshing then check if file exists in destination...
-			if !refresh {
-				// Not refreshing files so all files have to be present!
-				log.Printf("not refreshing files so file is missing %s", item.FilePath)
-				missingFiles = append(missingFiles, item.FilePath)
-			} else {
-				// Refreshing only some files so check if file in destination already...
-				dstFile := filepath.Join(dstDir, item.FileName)
-				if _, err := os.Stat(dstFile); err != nil {
-					// File not in source or destination!
-					missingFiles = append(missingFiles, item.FilePath)
-					log.Printf("refreshing, and file missing from destination %s", dstFile)
-				} else {
-					// File only in destination so we need to check it's the right one:
-					fmt.Printf(
-						"Checking existing file (no update provided) %s\n",
-						dstFile)
-					// TODO: No error handler here. we should really be doing this as a method seperately.
-					err := calcAndCheckSum(dstFile, srcChk)
-					if err != nil {
-						// Not exiting the application since this is informational for now, until we decide what to do with above TODO
-						fmt.Printf("Error: %s", err)
-						invalidFiles = append(invalidFiles, dstFile)
-					}
-				}
+		log.Printf("can't detect if %s is removable:%s", src, err)
+	}
+	readOnly, err := util.IsReadOnly(src)
+	if err != nil {
+		log.Printf("can't detect if %s is read-only:%s", src, err)
+	}
+	if removable || readOnly {
+		return false, fmt.Sprintf(
+			"Source %s is on removable or read-only media, copying artefacts (use --%s to move them)",
+			src,
+			FlagRestoreMove), nil
+	}
+	return true, "", nil
+}
+
+// resumeOrUndo will complete or roll back an interrupted restore recorded in
+// the journal and report if there is nothing more to do
+func resumeOrUndo(c *cobra.Command, dst string) (bool, error) {
+	resume, _ := c.Flags().GetBool(FlagRestoreResume)
+	undo, _ := c.Flags().GetBool(FlagRestoreUndo)
+	if resume && undo {
+		return false, fmt.Errorf(
+			"only one of --%s or --%s can be specified", FlagRestoreResume, FlagRestoreUndo)
+	}
+	j, err := journal.Load(dst)
+	if err != nil {
+		return false, err
+	}
+	if j == nil {
+		if resume || undo {
+			return false, fmt.Errorf("no interrupted restore found in %s", dst)
+		}
+		return false, nil
+	}
+	switch {
+	case undo:
+		fmt.Printf("Rolling back interrupted restore (%s)\n", j.File)
+		if err := j.Rollback(); err != nil {
+			return false, err
+		}
+		fmt.Printf("Restore undone\n")
+		return true, nil
+	case resume && j.State == journal.StateStaging:
+		// Nothing has been replaced yet but the staged files may be incomplete
+		fmt.Printf("Interrupted restore was staging files, restarting\n")
+		return false, j.Rollback()
+	case resume:
+		fmt.Printf("Resuming interrupted restore (%s)\n", j.File)
+		if j.State != journal.StateFinishing {
+			if err := j.Commit(); err != nil {
+				return false, err
 			}
 		}
+		if err := j.Finish(); err != nil {
+			return false, err
+		}
+		fmt.Printf("All artefacts restored\n")
+		return true, nil
 	}
-	if len(missingFiles) > 0 {
-		fmt.Printf("Missing files:\n")
-		for _, file := range missingFiles {
-			fmt.Printf("  %s\n", file)
+	return false, fmt.Errorf(
+		"an earlier restore didn't complete (see %s), use --%s or --%s",
+		j.File,
+		FlagRestoreResume,
+		FlagRestoreUndo)
+}
+
+// getRepoPaths will work out where to restore each of the other git repos
+func getRepoPaths(
+	c *cobra.Command,
+	dst string,
+	homePath string,
+	otherRepos []string) (map[string]string, error) {
+
+	// By default, other repos are restored alongside the home repo
+	reposDir := c.Flag(FlagRestoreGitReposDir).Value.String()
+	if len(reposDir) == 0 {
+		reposDir = dst
+	} else if !filepath.IsAbs(reposDir) {
+		reposDir = filepath.Join(homePath, reposDir)
+	}
+	repoMap := make(map[string]string)
+	for _, mapping := range strings.Fields(c.Flag(FlagRestoreGitRepoMap).Value.String()) {
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf(
+				"invalid git repo mapping %q, expecting name=path (--%s)",
+				mapping,
+				FlagRestoreGitRepoMap)
 		}
-		return fmt.Errorf(
-			"files in checksum file %s not present in source %s or destination %s",
-			srcChk.CheckSumFile,
-			src,
-			dstDir)
+		repoMap[kv[0]] = kv[1]
 	}
-	if len(invalidFiles) > 0 {
-		fmt.Printf("Invalid files:\n")
-		for _, file := range invalidFiles {
-			fmt.Printf("  %s\n", file)
+
+	repoPaths := make(map[string]string)
+	for _, gitRepoFile := range otherRepos {
+		repoName := git.GetRepoName(gitRepoFile)
+		repoPath := filepath.Join(reposDir, repoName)
+		if mapped, ok := repoMap[repoName]; ok {
+			repoPath = mapped
+			if !filepath.IsAbs(repoPath) {
+				repoPath = filepath.Join(dst, repoPath)
+			}
+			delete(repoMap, repoName)
 		}
-		return fmt.Errorf(
-			"files in checksum file %s are present but do not match checksums",
-			srcChk.CheckSumFile)
+		if repoPath == homePath {
+			return nil, fmt.Errorf(
+				"can't restore git repo %s to the home repo path %s",
+				gitRepoFile,
+				homePath)
+		}
+		repoPaths[gitRepoFile] = filepath.Clean(repoPath)
+	}
+	for repoName := range repoMap {
+		return nil, fmt.Errorf(
+			"no saved git repo %s found for mapping (--%s)",
+			repoName,
+			FlagRestoreGitRepoMap)
 	}
+	return repoPaths, nil
+}
+
+// newRestoreJob will work out the paths for the home repo (if saved), any other
+// repos to the paths given and where to move (or copy) all other archive files
+// from src as specified in the checksums file
+func newRestoreJob(
+	src string,
+	gitRepoFile string,
+	dst string,
+	savedDir string,
+	repoPaths map[string]string,
+	move bool) *restoreJob {
 
-	// Pre-flight checks OK...
-	fmt.Printf(
-		"Restoring git files from %s to %s\n",
-		gitRepoFile,
-		repoPath)
-	if err := git.Restore(gitRepoFile, dst, repoName, savedDir); err != nil {
+	repoPath := filepath.Clean(dst)
+	if gitRepoFile != "" {
+		// Get the git repo name from the file name...
+		repoPath = filepath.Join(repoPath, git.GetRepoName(gitRepoFile))
+	}
+	otherRepos := make([]string, 0, len(repoPaths))
+	for otherRepo := range repoPaths {
+		otherRepos = append(otherRepos, otherRepo)
+	}
+	sort.Strings(otherRepos)
+	return &restoreJob{
+		src:        src,
+		dst:        filepath.Clean(dst),
+		homeRepo:   gitRepoFile,
+		repoPath:   repoPath,
+		dstDir:     filepath.Join(repoPath, filepath.Clean(savedDir)),
+		savedDir:   savedDir,
+		otherRepos: otherRepos,
+		repoPaths:  repoPaths,
+		move:       move,
+		decrypted:  make(map[string]string),
+	}
+}
+
+// restoreJob is what to restore and where
+type restoreJob struct {
+	src        string
+	dst        string
+	homeRepo   string
+	repoPath   string
+	dstDir     string
+	savedDir   string
+	otherRepos []string
+	repoPaths  map[string]string
+	move       bool
+	quiet      bool
+	refresh    string
+	manifest   *manifest.Manifest
+	identities []crypt.Identity
+	// decryptDir holds decrypted copies of encrypted artefacts (recorded in
+	// the journal so they are removed once finished or rolled back)
+	decryptDir string
+	decrypted  map[string]string
+}
+
+// printf will display progress unless quiet
+func (r *restoreJob) printf(format string, a ...interface{}) {
+	if !r.quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// execute will restore everything in the plan, staging and verifying it all
+// before changing the destination
+func (r *restoreJob) execute(plan *restorePlan) error {
+	j, err := journal.New(r.dst)
+	if err != nil {
 		return err
 	}
-	// This may not exist even after an update due to the way files are moved
-	if _, err := os.Stat(dstDir); os.IsNotExist(err) {
-		log.Printf("the dir doesn't exist %s so creating it...", dstDir)
-		if err := os.MkdirAll(dstDir, 0775); err != nil {
-			return fmt.Errorf(
-				"problem creating destination directory structure %s:%s",
-				dstDir,
-				err)
+	if err := r.stage(j, plan); err != nil {
+		fmt.Printf("Restore failed, rolling back\n")
+		return rollback(j, err)
+	}
+	fmt.Printf("Moving restored files into place\n")
+	if err := j.Commit(); err != nil {
+		fmt.Printf("Restore failed, rolling back\n")
+		return rollback(j, err)
+	}
+	if err := j.Finish(); err != nil {
+		return fmt.Errorf("restore complete but can't clean up (resume to retry):%s", err)
+	}
+
+	fmt.Printf("All artefacts restored and checked\n")
+	return nil
+}
+
+// stage will restore all repos and artefacts to staging dirs (recorded in the
+// journal) and verify them
+func (r *restoreJob) stage(j *journal.Journal, plan *restorePlan) error {
+	var homeStaged, stagedDstDir string
+	var err error
+	homeKept := false
+	for _, repo := range plan.Repos {
+		homeKept = homeKept || (repo.Home && repo.Action == actionKeep)
+	}
+	// The artefacts are restored within the home repo (or on their own)
+	if r.homeRepo != "" && !homeKept {
+		if homeStaged, err = j.AddSwap(r.repoPath); err != nil {
+			return err
 		}
-	} else {
+		stagedDstDir = filepath.Join(homeStaged, filepath.Clean(r.savedDir))
+	} else if stagedDstDir, err = j.AddSwap(r.dstDir); err != nil {
+		return err
+	}
+	for _, repo := range plan.Repos {
+		staged := homeStaged
+		if !repo.Home {
+			if rel, err := filepath.Rel(r.repoPath, repo.Path); homeStaged != "" &&
+				err == nil &&
+				!strings.HasPrefix(rel, "..") {
+				// Repos within the home repo are moved into place with it
+				staged = filepath.Join(homeStaged, rel)
+			} else if staged, err = j.AddSwap(repo.Path); err != nil {
+				return err
+			}
+		}
+		if repo.Action == actionKeep {
+			fmt.Printf("Keeping unchanged git repo %s\n", repo.Path)
+			if repo.Home || homeStaged == "" {
+				continue
+			}
+			// Within the home repo so it has to be moved into place with it
+			if err := util.LinkDir(repo.Path, staged); err != nil {
+				return fmt.Errorf("problem staging git repo %s:%s", repo.Path, err)
+			}
+			continue
+		}
+		fmt.Printf(
+			"Restoring git files from %s to %s\n",
+			repo.Archive,
+			repo.Path)
+		artefactsDir := ""
+		if repo.Home {
+			artefactsDir = r.savedDir
+		}
+		archive, err := r.plainFile(j, repo.Archive)
 		if err != nil {
-			// Ensure we have a checksum file in the destination first...
-			return fmt.Errorf("cannot read checksum file from %s:%s", dstDir, err)
+			return err
+		}
+		if err := git.Stage(archive, repo.Path, staged, artefactsDir, r.refresh); err != nil {
+			return err
+		}
+		if err := git.Verify(staged); err != nil {
+			return err
 		}
 	}
-	dstChkFile := filepath.Join(dstDir, hashcache.DefaultCheckSumFileName)
 
-	// Next copy the checksums file...
-	if err := util.Cp(
-		srcChk.CheckSumFile,
-		dstChkFile); err != nil {
+	// Keep any artefacts already restored (links so they are not modified)
+	if err := os.MkdirAll(stagedDstDir, 0775); err != nil {
 		return fmt.Errorf(
-			"cannot copy checksum file (%s) from:%s to %s:%s",
-			srcChk.CheckSumFile,
-			src,
-			dstDir,
+			"problem creating destination directory structure %s:%s",
+			stagedDstDir,
 			err)
 	}
-	dstChk, err := hashcache.NewFromDir(dstDir, true)
-	if err != nil {
-		return fmt.Errorf("problem with checksum file in folder %s:%s", dstDir, err)
+	if _, err := os.Stat(r.dstDir); err == nil {
+		log.Printf("linking existing artefacts from %s to %s", r.dstDir, stagedDstDir)
+		if err := util.LinkDir(r.dstDir, stagedDstDir); err != nil {
+			return fmt.Errorf(
+				"problem staging existing artefacts from %s:%s",
+				r.dstDir,
+				err)
+		}
 	}
-	// Now move all the files, checking checksums as we go...
-	for srcFile, chkItem := range srcChk.CheckSumsByFilePath {
-		dstFile := filepath.Join(dstDir, chkItem.FileName)
-
-		// Support incremental copies (error if destination not already present)
-		if _, err := os.Stat(srcFile); err == nil {
-			fmt.Printf("Moving file %q to %q\n", srcFile, dstDir)
-			if err := util.Mv(srcFile, dstFile); err != nil {
+	// Now move all the files (moved files are only removed once finished)
+	stagedFiles := make(map[string]string)
+	for _, file := range plan.Files {
+		if file.Action == actionExtract {
+			// once the archive is verified
+			continue
+		}
+		stagedFile, err := r.stagedTarget(j, stagedDstDir, homeStaged, file.Target)
+		if err != nil {
+			return err
+		}
+		stagedFiles[file.Target] = stagedFile
+		if err := os.MkdirAll(filepath.Dir(stagedFile), 0775); err != nil {
+			return fmt.Errorf("problem creating directory for %s:%s", stagedFile, err)
+		}
+		source := file.Source
+		if file.Encrypted {
+			if source, err = r.plainFile(j, file.Source); err != nil {
 				return err
 			}
-			//TODO: What is this doing??
-			err := calcAndCheckSum(dstFile, dstChk)
-			if err != nil {
+		}
+		switch file.Action {
+		case actionMove:
+			fmt.Printf("Moving file %q to %q\n", file.Source, r.dstDir)
+			if err := util.Link(source, stagedFile); err != nil {
+				return fmt.Errorf("problem moving %q to %q:%s", file.Source, stagedFile, err)
+			}
+			if err := j.AddRemoveSource(file.Source); err != nil {
 				return err
 			}
+		case actionCopy:
+			fmt.Printf("Copying file %q to %q\n", file.Source, r.dstDir)
+			if err := replaceFile(source, stagedFile); err != nil {
+				return fmt.Errorf("problem copying %q to %q:%s", file.Source, stagedFile, err)
+			}
+		case actionKeep:
+			// Targets outside the artefacts dir may not have been staged
+			if _, err := os.Lstat(stagedFile); os.IsNotExist(err) {
+				if err := util.Link(file.Target, stagedFile); err != nil {
+					return fmt.Errorf("problem staging %q:%s", file.Target, err)
+				}
+			}
+		}
+		if err := applyMeta(stagedFile, file); err != nil {
+			return err
+		}
+	}
+	// Verify every artefact arrived intact before anything is replaced
+	fmt.Printf("Verifying restored artefacts\n")
+	for _, file := range plan.Files {
+		if !file.checked {
+			continue
+		}
+		if err := calcAndCheckSum(stagedFiles[file.Target], file.checksum); err != nil {
+			return err
+		}
+	}
+	// Extract archives (replacing anything extracted before)
+	for _, file := range plan.Files {
+		if file.Action != actionExtract {
+			continue
+		}
+		stagedDir, err := r.stagedTarget(j, stagedDstDir, homeStaged, file.Target)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(stagedDir); err != nil {
+			return err
+		}
+		fmt.Printf("Extracting %q to %q\n", file.File, file.Target)
+		opts := tar.Options{StripComponents: file.Strip, Keep: file.Keep}
+		if err := tar.ExtractArchive(stagedFiles[file.Source], stagedDir, opts); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	fmt.Printf("All artefacts restored and checked\n")
+// stagedTarget will return where a target is staged, targets outside the
+// artefacts dir are staged on their own when the home repo isn't restored
+func (r *restoreJob) stagedTarget(
+	j *journal.Journal,
+	stagedDstDir string,
+	homeStaged string,
+	target string) (string, error) {
+
+	if rel, _ := filepath.Rel(r.dstDir, target); homeStaged == "" && strings.HasPrefix(rel, "..") {
+		// Outside the artefacts dir (with the home repo kept) so it is moved
+		// into place on its own
+		return j.AddSwap(target)
+	}
+	return r.stagedPath(stagedDstDir, target)
+}
+
+// plainFile will return a decrypted copy of an encrypted artefact (or the
+// artefact itself)
+func (r *restoreJob) plainFile(j *journal.Journal, file string) (string, error) {
+	artefact := r.manifest.Get(filepath.Base(file))
+	if artefact == nil || !artefact.Encrypted {
+		return file, nil
+	}
+	if plain, ok := r.decrypted[file]; ok {
+		return plain, nil
+	}
+	if r.decryptDir == "" {
+		// within the destination so decrypted files can be moved into place
+		dir, err := j.AddTempDir("decrypt")
+		if err != nil {
+			return "", fmt.Errorf("problem creating dir to decrypt artefacts:%s", err)
+		}
+		r.decryptDir = dir
+	}
+	plain := filepath.Join(r.decryptDir, filepath.Base(file))
+	fmt.Printf("Decrypting %s\n", file)
+	if err := crypt.DecryptFile(file, plain, r.identities); err != nil {
+		return "", fmt.Errorf("problem decrypting %s:%s", file, err)
+	}
+	r.decrypted[file] = plain
+	return plain, nil
+}
+
+// stagedPath will return where a target in the artefacts dir is staged
+func (r *restoreJob) stagedPath(stagedDstDir string, target string) (string, error) {
+	rel, err := filepath.Rel(r.dstDir, target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stagedDstDir, rel), nil
+}
+
+// applyMeta will set the mode and owner recorded in the manifest for a staged
+// file (linked files are copied first so the original isn't changed)
+func applyMeta(stagedFile string, file fileAction) error {
+	if file.mode == 0 && len(file.Owner) == 0 {
+		return nil
+	}
+	fi, err := os.Stat(stagedFile)
+	if err != nil {
+		return err
+	}
+	if file.mode != 0 && fi.Mode().Perm() == file.mode && len(file.Owner) == 0 {
+		return nil
+	}
+	if file.Action != actionCopy {
+		log.Printf("copying linked file %s to change its mode or owner", stagedFile)
+		tmpFile := stagedFile + ".artefactor-tmp"
+		if err := util.Cp(stagedFile, tmpFile); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpFile, stagedFile); err != nil {
+			return err
+		}
+	}
+	if file.mode != 0 {
+		if err := os.Chmod(stagedFile, file.mode); err != nil {
+			return fmt.Errorf("problem setting mode %s for %s:%s", file.Mode, file.Target, err)
+		}
+	}
+	if len(file.Owner) > 0 {
+		if err := util.Chown(stagedFile, file.Owner); err != nil {
+			return fmt.Errorf("problem setting owner %s for %s:%s", file.Owner, file.Target, err)
+		}
+	}
+	return nil
+}
+
+// replaceFile will remove any existing dst file (it may be linked to an
+// existing artefact) before copying src
+func replaceFile(src string, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return util.Cp(src, dst)
+}
+
+// rollback will undo a failed restore
+func rollback(j *journal.Journal, err error) error {
+	if rbErr := j.Rollback(); rbErr != nil {
+		return fmt.Errorf(
+			"%s (rollback failed, see %s:%s)",
+			err,
+			j.File,
+			rbErr)
+	}
+	return err
+}
+
+// checkRepoClean will error if an existing repo has changes that a restore
+// would overwrite
+func checkRepoClean(repoPath string) error {
+	clean, err := git.IsClean(repoPath)
+	if err != nil {
+		return fmt.Errorf("can't read git repo at %s:%s", repoPath, err)
+	}
+	if !clean {
+		return fmt.Errorf(
+			"destination repo is NOT clean, please clean then restore (%s)",
+			repoPath)
+	}
 	return nil
 }
 
 // calcAndCheckSum will display the results of verifying a checksum
-func calcAndCheckSum(file string, csc *hashcache.CheckSumCache) error {
+func calcAndCheckSum(file string, expectedHash string) error {
 	file = filepath.Clean(file)
 	fmt.Printf("  Checksum:")
 	calcHash, err := hashcache.CalcChecksum(file)
@@ -257,20 +753,13 @@ func calcAndCheckSum(file string, csc *hashcache.CheckSumCache) error {
 		return err
 	}
 	log.Print(calcHash)
-	if csc.IsCachedMatched(file, calcHash) {
-		fmt.Printf("OK\n")
-	} else {
-		expectedHash, ok := csc.CheckSumsByFilePath[file]
-		if !ok {
-			return fmt.Errorf(
-				"missing checksum for %s from %s", file, csc.CheckSumFile)
-		} else {
-			return fmt.Errorf(
-				"failed for %s, expecting %v but got %s\n",
-				file,
-				expectedHash,
-				calcHash)
-		}
+	if calcHash != expectedHash {
+		return fmt.Errorf(
+			"failed for %s, expecting %v but got %s\n",
+			file,
+			expectedHash,
+			calcHash)
 	}
+	fmt.Printf("OK\n")
 	return nil
 }
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"github.com/spf13/cobra"
+	"gotest.tools/assert"
+)
+
+// newTestCmd will create a command with string flags set to the values given
+func newTestCmd(flags map[string]string) *cobra.Command {
+	c := &cobra.Command{}
+	for name, value := range flags {
+		c.Flags().String(name, value, "")
+	}
+	return c
+}
+
+func TestGetRepoPaths(t *testing.T) {
+	otherRepos := []string{"/media/usb/lib.git.tar", "/media/usb/tools.git.bundle"}
+	tests := []struct {
+		name     string
+		reposDir string
+		repoMap  string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name: "alongside the home repo",
+			expected: map[string]string{
+				"/media/usb/lib.git.tar":      "/work/lib",
+				"/media/usb/tools.git.bundle": "/work/tools",
+			},
+		},
+		{
+			name:     "relative to the home repo",
+			reposDir: "vendor",
+			expected: map[string]string{
+				"/media/usb/lib.git.tar":      "/work/home/vendor/lib",
+				"/media/usb/tools.git.bundle": "/work/home/vendor/tools",
+			},
+		},
+		{
+			name:     "absolute repos dir",
+			reposDir: "/opt/repos",
+			expected: map[string]string{
+				"/media/usb/lib.git.tar":      "/opt/repos/lib",
+				"/media/usb/tools.git.bundle": "/opt/repos/tools",
+			},
+		},
+		{
+			name:     "mapped relative to the dest dir or absolute",
+			reposDir: "vendor",
+			repoMap:  "lib=libs/lib-v2 tools=/opt/tools",
+			expected: map[string]string{
+				"/media/usb/lib.git.tar":      "/work/libs/lib-v2",
+				"/media/usb/tools.git.bundle": "/opt/tools",
+			},
+		},
+		{
+			name:    "mapped to the home repo",
+			repoMap: "lib=home",
+			err:     "can't restore git repo /media/usb/lib.git.tar to the home repo path",
+		},
+		{
+			name:    "invalid mapping",
+			repoMap: "lib",
+			err:     `invalid git repo mapping "lib"`,
+		},
+		{
+			name:    "unknown repo mapped",
+			repoMap: "other=/opt/other",
+			err:     "no saved git repo other found for mapping",
+		},
+	}
+	for _, test := range tests {
+		c := newTestCmd(map[string]string{
+			FlagRestoreGitReposDir: test.reposDir,
+			FlagRestoreGitRepoMap:  test.repoMap,
+		})
+		repoPaths, err := getRepoPaths(c, "/work", "/work/home", otherRepos)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err, test.name)
+			continue
+		}
+		assert.NilError(t, err, test.name)
+		assert.DeepEqual(t, repoPaths, test.expected)
+	}
+}
+
+func TestGetMoveMode(t *testing.T) {
+	src, err := ioutil.TempDir("", "artefactor_restore")
+	assert.NilError(t, err)
+	defer os.RemoveAll(src)
+	tests := []struct {
+		move     bool
+		copy     bool
+		expected bool
+		err      string
+	}{
+		{move: true, expected: true},
+		{copy: true, expected: false},
+		{move: true, copy: true, err: "only one of --move or --copy"},
+		// the temp dir isn't removable or read-only
+		{expected: true},
+	}
+	for _, test := range tests {
+		c := &cobra.Command{}
+		c.Flags().Bool(FlagRestoreMove, test.move, "")
+		c.Flags().Bool(FlagRestoreCopy, test.copy, "")
+		move, reason, err := getMoveMode(c, src)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, move, test.expected, "move:%v copy:%v", test.move, test.copy)
+		assert.Equal(t, reason, "")
+	}
+}
+
+// newTestSource will save files with a checksum file in src and return their
+// manifest (restored to the downloads dir)
+func newTestSource(t *testing.T, src string, files map[string]string) *manifest.Manifest {
+	assert.NilError(t, os.MkdirAll(src, 0755))
+	c, err := hashcache.NewFromDir(src, false)
+	assert.NilError(t, err)
+	m := manifest.New("downloads")
+	for name, content := range files {
+		file := filepath.Join(src, name)
+		assert.NilError(t, ioutil.WriteFile(file, []byte(content), 0644))
+		_, err := c.Update(file)
+		assert.NilError(t, err)
+		m.Add(file, manifest.TypeLocalFile, name, 0644)
+	}
+	return m
+}
+
+func TestRestoreCopyVerified(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_restore")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	m := newTestSource(t, src, map[string]string{"a.txt": "a", "b.txt": "b"})
+
+	tests := []struct {
+		name    string
+		corrupt bool
+	}{
+		{name: "copied"},
+		{name: "corrupt", corrupt: true},
+	}
+	for _, test := range tests {
+		dst := filepath.Join(tmp, test.name)
+		job := newRestoreJob(src, "", dst, m.SaveDir, nil, false)
+		job.manifest = m
+		plan, err := job.plan()
+		assert.NilError(t, err)
+		assert.Equal(t, plan.Mode, actionCopy)
+		if test.corrupt {
+			// the copy won't match what was planned
+			for i := range plan.Files {
+				if plan.Files[i].File == "b.txt" {
+					plan.Files[i].checksum = "aaa"
+				}
+			}
+		}
+		err = job.execute(plan)
+		if test.corrupt {
+			assert.ErrorContains(t, err, "expecting aaa")
+			// rolled back without restoring anything
+			_, err := os.Stat(filepath.Join(dst, "downloads"))
+			assert.Assert(t, os.IsNotExist(err), test.name)
+		} else {
+			assert.NilError(t, err)
+			b, err := ioutil.ReadFile(filepath.Join(dst, "downloads", "b.txt"))
+			assert.NilError(t, err)
+			assert.Equal(t, string(b), "b")
+		}
+		// the source is left intact
+		for _, name := range []string{"a.txt", "b.txt"} {
+			_, err := os.Stat(filepath.Join(src, name))
+			assert.NilError(t, err, test.name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/cache"
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/util"
+	"github.com/appvia/artefactor/pkg/version"
+	"github.com/appvia/artefactor/pkg/web"
+	"github.com/spf13/cobra"
+)
+
+// launcherScript is saved as the artefactor binary name and runs the binary
+// saved for the platform it is run on
+const launcherScript = `#!/bin/sh
+# Runs the artefactor binary saved for this platform (artefactor_os_arch)
+os=$(uname -s | tr '[:upper:]' '[:lower:]')
+case "$(uname -m)" in
+x86_64 | amd64) arch=amd64 ;;
+aarch64 | arm64) arch=arm64 ;;
+i386 | i686) arch=386 ;;
+armv*) arch=arm ;;
+*) arch=$(uname -m) ;;
+esac
+dir=$(dirname "$0")
+bin="${dir}/artefactor_${os}_${arch}"
+if [ ! -x "${bin}" ]; then
+	echo "no artefactor binary for ${os}_${arch} in ${dir}, saved binaries are:" >&2
+	ls "${dir}"/artefactor_* >&2
+	exit 1
+fi
+exec "${bin}" "$@"
+`
+
+// getTargetPlatforms gets the platforms to save artefactor binaries for
+func getTargetPlatforms(c *cobra.Command) ([]string, error) {
+	platforms := strings.Fields(c.Flag(FlagTargetPlatform).Value.String())
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("expecting at least one --%s", FlagTargetPlatform)
+	}
+	return platforms, checkPlatforms(platforms)
+}
+
+// checkPlatforms will check platforms are in the format os_arch
+func checkPlatforms(platforms []string) error {
+	for _, platform := range platforms {
+		if parts := strings.Split(platform, "_"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return fmt.Errorf("expecting a platform in the format os_arch, got %q", platform)
+		}
+	}
+	return nil
+}
+
+// platformBinName is the name of the artefactor binary for a platform (as
+// published)
+func platformBinName(platform string) string {
+	if strings.HasPrefix(platform, "windows_") {
+		return ArtefactorBinaryName + "_" + platform + ".exe"
+	}
+	return ArtefactorBinaryName + "_" + platform
+}
+
+// saveLauncher saves a script to run the binary for the current platform and
+// returns the file saved
+func saveLauncher(c *hashcache.CheckSumCache, saveDir string) (string, error) {
+	launcher := filepath.Join(saveDir, ArtefactorBinaryName)
+	// remove any binary saved by earlier versions so it isn't written through
+	if err := os.Remove(launcher); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := ioutil.WriteFile(launcher, []byte(launcherScript), 0755); err != nil {
+		return "", fmt.Errorf("problem saving launcher %s:%s", launcher, err)
+	}
+	if _, err := c.Update(launcher); err != nil {
+		return "", fmt.Errorf("unable to update hash for %s:%s", launcher, err)
+	}
+	return launcher, nil
+}
+
+// saveMe saves a copy of the target binary in the save dir as binName and
+// returns the file saved. Binaries for other platforms are saved from the source
+// (a local dir or url) or the github release (via the user cache) and verified
+// with the source checksum file.
+func saveMe(
+	c *hashcache.CheckSumCache,
+	saveDir string,
+	platform string,
+	binName string,
+	source string,
+	webConfig *web.Config,
+	userCache *cache.Cache) (string, error) {
+
+	platformBin := platformBinName(platform)
+	binaryDst := filepath.Join(saveDir, binName)
+	// detect if the binary we are saving with matches target platform...
+	if fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH) == platform {
+		me, _ := os.Executable()
+		if err := copyBin(c, me, binaryDst); err != nil {
+			return "", fmt.Errorf(
+				"problem trying to save %s as %s:%s",
+				me,
+				binaryDst,
+				err)
+		}
+		return binaryDst, nil
+	}
+	if len(source) == 0 {
+		v := version.Get().Version
+		if len(v) == 0 {
+			return "", fmt.Errorf(
+				"can't download %s for an unversioned build of artefactor, set --%s to a dir or url with the binaries and their %s",
+				platformBin,
+				FlagArtefactorSource,
+				hashcache.DefaultCheckSumFileName)
+		}
+		source = fmt.Sprintf(ArtefactorPublishRoot, v)
+	}
+	source = strings.TrimSuffix(source, "/")
+	checkSums := source + "/" + hashcache.DefaultCheckSumFileName
+	sums, err := web.LoadSums(checkSums, "", "", webConfig)
+	if err != nil {
+		return "", fmt.Errorf("problem reading artefactor checksums:%s", err)
+	}
+	sha, err := sums.Get(platformBin)
+	if err != nil {
+		return "", fmt.Errorf("problem finding the checksum in %s:%s", checkSums, err)
+	}
+	src := source + "/" + platformBin
+	if web.IsURL(src) {
+		if err := web.Save(c, []string{src}, binName, saveDir, sha, true, webConfig, userCache); err != nil {
+			return "", fmt.Errorf("problem trying to download artefactor from %s:%s", src, err)
+		}
+		return binaryDst, nil
+	}
+	if c.IsCachedMatched(binaryDst, sha) {
+		c.Keep(binaryDst)
+		return binaryDst, nil
+	}
+	// Verify the binary before it's saved:
+	calcBinChkSum, err := hashcache.CalcChecksum(src)
+	if err != nil {
+		return "", fmt.Errorf("problem getting checksum for %s:%s", src, err)
+	}
+	if calcBinChkSum != sha {
+		return "", fmt.Errorf(
+			"%s had unexpected checksum %s, expecting %s (from %s)",
+			src,
+			calcBinChkSum,
+			sha,
+			checkSums)
+	}
+	if err := copyBin(c, src, binaryDst); err != nil {
+		return "", fmt.Errorf(
+			"problem trying to save %s as %s:%s",
+			src,
+			binaryDst,
+			err)
+	}
+	return binaryDst, nil
+}
+
+// copyBin will save a local binary and its meta-data to the archive dir
+func copyBin(c *hashcache.CheckSumCache, srcBin string, savedBin string) error {
+	// replace the binary so a cached file linked to it isn't changed
+	if err := os.Remove(savedBin); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := util.Cp(srcBin, savedBin); err != nil {
+		return err
+	}
+	if err := os.Chmod(savedBin, 0755); err != nil {
+		return err
+	}
+	_, err := c.Update(savedBin)
+	return err
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"gotest.tools/assert"
+)
+
+func TestPlatformBinName(t *testing.T) {
+	tests := map[string]string{
+		"linux_amd64":   "artefactor_linux_amd64",
+		"darwin_arm64":  "artefactor_darwin_arm64",
+		"windows_amd64": "artefactor_windows_amd64.exe",
+	}
+	for platform, name := range tests {
+		assert.Equal(t, platformBinName(platform), name)
+	}
+}
+
+func TestCheckPlatforms(t *testing.T) {
+	tests := []struct {
+		platforms []string
+		err       string
+	}{
+		{[]string{"linux_amd64"}, ""},
+		{[]string{"linux_amd64", "darwin_arm64", "windows_386"}, ""},
+		{[]string{"linux_amd64", "linux"}, `got "linux"`},
+		{[]string{"linux_"}, `got "linux_"`},
+		{[]string{"_amd64"}, `got "_amd64"`},
+		{[]string{"linux_amd64_v2"}, `got "linux_amd64_v2"`},
+	}
+	for _, test := range tests {
+		err := checkPlatforms(test.platforms)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err)
+			continue
+		}
+		assert.NilError(t, err)
+	}
+}
+
+func TestSaveLauncher(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the launcher is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "artefactor_launcher")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := hashcache.NewFromDir(dir, false)
+	assert.NilError(t, err)
+	// a binary saved by earlier versions is replaced
+	launcher := filepath.Join(dir, ArtefactorBinaryName)
+	assert.NilError(t, ioutil.WriteFile(launcher, []byte("binary"), 0755))
+
+	saved, err := saveLauncher(c, dir)
+	assert.NilError(t, err)
+	assert.Equal(t, saved, launcher)
+	assert.Assert(t, c.IsCachedMatchingFile(launcher))
+
+	// without a binary for this platform the saved binaries are listed
+	other := filepath.Join(dir, platformBinName("plan9_mips"))
+	assert.NilError(t, ioutil.WriteFile(other, []byte("#!/bin/sh\n"), 0755))
+	out, err := exec.Command(launcher, "version").CombinedOutput()
+	assert.ErrorContains(t, err, "exit status 1")
+	assert.Assert(t, strings.Contains(string(out), other), string(out))
+
+	// the binary for this platform is run with the arguments
+	bin := filepath.Join(dir, platformBinName(fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH)))
+	assert.NilError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\necho \"saved binary $*\"\n"), 0755))
+	out, err = exec.Command(launcher, "restore", "--logs").CombinedOutput()
+	assert.NilError(t, err, string(out))
+	assert.Equal(t, string(out), "saved binary restore --logs\n")
+}
+
+func TestSaveMeFromSource(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_save_me")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	// a platform other than this one so it's saved from the source
+	platform := "plan9_mips"
+	source := filepath.Join(tmp, "source")
+	assert.NilError(t, os.MkdirAll(source, 0755))
+	srcBin := filepath.Join(source, platformBinName(platform))
+	assert.NilError(t, ioutil.WriteFile(srcBin, []byte("plan9 binary"), 0755))
+	sha, err := hashcache.CalcChecksum(srcBin)
+	assert.NilError(t, err)
+	checkSums := filepath.Join(source, hashcache.DefaultCheckSumFileName)
+
+	tests := []struct {
+		name   string
+		source string
+		sums   string
+		err    string
+	}{
+		{"matching", source, sha + "  " + platformBinName(platform) + "\n", ""},
+		{"mismatched", source, strings.Repeat("0", 64) + "  " + platformBinName(platform) + "\n", "unexpected checksum"},
+		{"missing", source, sha + "  " + platformBinName("linux_amd64") + "\n", "no checksum for " + platformBinName(platform)},
+		{"unversioned", "", "", "unversioned build"},
+	}
+	for _, test := range tests {
+		if len(test.sums) > 0 {
+			assert.NilError(t, ioutil.WriteFile(checkSums, []byte(test.sums), 0644))
+		}
+		saveDir := filepath.Join(tmp, test.name)
+		assert.NilError(t, os.MkdirAll(saveDir, 0755))
+		c, err := hashcache.NewFromDir(saveDir, false)
+		assert.NilError(t, err)
+
+		saved, err := saveMe(c, saveDir, platform, ArtefactorBinaryName, test.source, nil, nil)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err, test.name)
+			_, err := os.Stat(filepath.Join(saveDir, ArtefactorBinaryName))
+			assert.Assert(t, os.IsNotExist(err), test.name)
+			continue
+		}
+		assert.NilError(t, err, test.name)
+		assert.Equal(t, saved, filepath.Join(saveDir, ArtefactorBinaryName))
+		b, err := ioutil.ReadFile(saved)
+		assert.NilError(t, err)
+		assert.Equal(t, string(b), "plan9 binary")
+		assert.Assert(t, c.IsCachedMatchingFile(saved), test.name)
+	}
+}
@@ -0,0 +1,332 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/appvia/artefactor/pkg/web"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// webOptSig is a detached signature for the checksums file of a web file
+	webOptSig string = "sig"
+	// webSumsPrefix replaces a web file sha256 with a checksums file to look it
+	// up in e.g. sums=https://example.com/v1.0/SHA256SUMS
+	webSumsPrefix string = "sums="
+	// webOptVersion is the {{.Version}} for a templated web file
+	webOptVersion string = "version"
+	// webOptOS renames the {{.OS}} of each platform e.g. darwin:macos
+	webOptOS string = "os"
+	// webOptArch renames the {{.Arch}} of each platform e.g. amd64:x86_64
+	webOptArch string = "arch"
+
+	// webTemplateStart detects a templated web file
+	webTemplateStart string = "{{"
+)
+
+// webfile is a file to download
+type webfile struct {
+	url      string
+	urls     []string
+	fileName string
+	sha      string
+	sums     string
+	sig      string
+	bin      bool
+	meta     map[string]string
+	// platform is set for a templated web file saved for each platform
+	platform string
+}
+
+// webTemplate is the data for templated web file urls, file names, checksums
+// files and signatures
+type webTemplate struct {
+	// Version is from the version= option
+	Version string
+	// OS and Arch are the platform (renamed with the os= and arch= options)
+	OS   string
+	Arch string
+	// Platform is os_arch e.g. linux_amd64
+	Platform string
+}
+
+// webMirror is a url prefix to download web files from first e.g. an internal
+// proxy
+type webMirror struct {
+	prefix string
+	mirror string
+}
+
+// getWebFiles gets the web files to save from flags, saving templated files for
+// each platform and looking up any checksums from checksums files
+func getWebFiles(c *cobra.Command, mirrors []webMirror, webConfig *web.Config) ([]webfile, error) {
+	platforms, err := getWebPlatforms(c)
+	if err != nil {
+		return nil, err
+	}
+	webFiles, err := parseWebFiles(strings.Fields(c.Flag(FlagWebFiles).Value.String()), platforms, mirrors)
+	if err != nil {
+		return nil, err
+	}
+	if err := lookupWebSums(c, webFiles, webConfig); err != nil {
+		return nil, err
+	}
+	return webFiles, nil
+}
+
+// parseWebFiles will read the web file CSV's, saving templated files for each
+// platform
+func parseWebFiles(csvs []string, platforms []string, mirrors []webMirror) ([]webfile, error) {
+	webFiles := []webfile{}
+	// the file names saved and where they are restored to so templates saving
+	// or restoring files over each other are found
+	saved := make(map[string]string)
+	restored := make(map[string]string)
+	for _, webFile := range csvs {
+		parts := strings.Split(webFile, ",")
+		if len(parts) < 3 {
+			return nil, errors.Errorf(
+				"expecting a web file CSV with url[|mirror-url],filename,sha256|sums=checksums[,true|false][,mode=|owner=|target=|sig=|version=]")
+		}
+		w := webfile{
+			url:      parts[0],
+			fileName: parts[1],
+			sha:      parts[2],
+		}
+		if strings.HasPrefix(w.sha, webSumsPrefix) {
+			w.sums = strings.TrimPrefix(w.sha, webSumsPrefix)
+			w.sha = ""
+		}
+		var err error
+		if w.bin, w.meta, err = parseFileOptions(
+			w.fileName, parts[3:], webOptSig, webOptVersion, webOptOS, webOptArch); err != nil {
+			return nil, err
+		}
+		w.sig = w.meta[webOptSig]
+		if len(w.sig) > 0 && len(w.sums) == 0 {
+			return nil, errors.Errorf(
+				"%s= for web file %s requires the checksum from a %s file", webOptSig, w.fileName, webSumsPrefix)
+		}
+		expanded := []webfile{w}
+		if strings.Contains(webFile, webTemplateStart) {
+			if expanded, err = expandWebFile(w, platforms); err != nil {
+				return nil, err
+			}
+		}
+		for _, w := range expanded {
+			if previous, ok := saved[w.fileName]; ok {
+				return nil, fmt.Errorf(
+					"web file %s would be saved from %s and %s, use {{.OS}} and {{.Arch}} in the file name of templated web files",
+					w.fileName, previous, w.url)
+			}
+			saved[w.fileName] = w.url
+			for _, key := range []string{webMetaTarget, webMetaExtract} {
+				if len(w.meta[key]) == 0 {
+					continue
+				}
+				dst := key + "=" + path.Clean(w.meta[key])
+				if previous, ok := restored[dst]; ok {
+					return nil, fmt.Errorf(
+						"web files %s and %s would both be restored with %s, use {{.OS}} and {{.Arch}} in the %s= of templated web files",
+						previous, w.fileName, dst, key)
+				}
+				restored[dst] = w.fileName
+			}
+			urls := strings.Split(w.url, "|")
+			w.url = urls[0]
+			w.urls = withMirrors(urls, mirrors)
+			webFiles = append(webFiles, w)
+		}
+	}
+	return webFiles, nil
+}
+
+// getWebPlatforms gets the platforms to save templated web files for (the
+// target platforms by default)
+func getWebPlatforms(c *cobra.Command) ([]string, error) {
+	platforms := strings.Fields(c.Flag(FlagWebPlatforms).Value.String())
+	if len(platforms) == 0 {
+		return getTargetPlatforms(c)
+	}
+	return platforms, checkPlatforms(platforms)
+}
+
+// expandWebFile will create a web file for each platform from a templated web
+// file (the target= and extract= options are templated too). The checksum can
+// be set for each platform e.g. linux_amd64=abc;...
+func expandWebFile(w webfile, platforms []string) ([]webfile, error) {
+	osNames, err := parseRenames(w.meta[webOptOS])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s= for web file %s:%s", webOptOS, w.fileName, err)
+	}
+	archNames, err := parseRenames(w.meta[webOptArch])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s= for web file %s:%s", webOptArch, w.fileName, err)
+	}
+	shas := make(map[string]string)
+	if strings.Contains(w.sha, "=") {
+		for _, platformSha := range strings.Split(w.sha, ";") {
+			kv := strings.SplitN(platformSha, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf(
+					"expecting checksums in the format platform=sha256;... for web file %s", w.fileName)
+			}
+			shas[kv[0]] = kv[1]
+		}
+	}
+	var expanded []webfile
+	for _, platform := range platforms {
+		parts := strings.SplitN(platform, "_", 2)
+		data := webTemplate{
+			Version:  w.meta[webOptVersion],
+			OS:       parts[0],
+			Arch:     parts[1],
+			Platform: platform,
+		}
+		if name, ok := osNames[data.OS]; ok {
+			data.OS = name
+		}
+		if name, ok := archNames[data.Arch]; ok {
+			data.Arch = name
+		}
+		p := w
+		p.platform = platform
+		p.meta = make(map[string]string)
+		for key, value := range w.meta {
+			p.meta[key] = value
+		}
+		target, extract := p.meta[webMetaTarget], p.meta[webMetaExtract]
+		for _, field := range []*string{&p.url, &p.fileName, &p.sums, &p.sig, &target, &extract} {
+			if *field, err = executeWebTemplate(*field, data); err != nil {
+				return nil, fmt.Errorf("invalid template for web file %s:%s", w.fileName, err)
+			}
+		}
+		if len(target) > 0 {
+			p.meta[webMetaTarget] = target
+		}
+		if len(extract) > 0 {
+			p.meta[webMetaExtract] = extract
+		}
+		if len(shas) > 0 {
+			if p.sha = shas[platform]; len(p.sha) == 0 {
+				return nil, fmt.Errorf("no checksum for %s for web file %s", platform, w.fileName)
+			}
+		}
+		expanded = append(expanded, p)
+	}
+	return expanded, nil
+}
+
+// parseRenames will read a ; seperated list of old:new names
+func parseRenames(renames string) (map[string]string, error) {
+	names := make(map[string]string)
+	if len(renames) == 0 {
+		return names, nil
+	}
+	for _, rename := range strings.Split(renames, ";") {
+		parts := strings.SplitN(rename, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expecting old:new, got %q", rename)
+		}
+		names[parts[0]] = parts[1]
+	}
+	return names, nil
+}
+
+func executeWebTemplate(text string, data webTemplate) (string, error) {
+	t, err := template.New("webfile").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// lookupWebSums will set the checksums of web files from upstream checksums
+// files (read once each)
+func lookupWebSums(c *cobra.Command, webFiles []webfile, webConfig *web.Config) error {
+	keyring := c.Flag(FlagWebSumsKeyring).Value.String()
+	sums := make(map[string]*web.Sums)
+	for i, w := range webFiles {
+		if len(w.sums) == 0 {
+			continue
+		}
+		if len(keyring) > 0 && len(w.sig) == 0 {
+			return fmt.Errorf(
+				"web file %s has no %s= for %s, checksums must be signed with --%s",
+				w.fileName, webOptSig, w.sums, FlagWebSumsKeyring)
+		}
+		key := w.sums + "|" + w.sig
+		if _, ok := sums[key]; !ok {
+			fmt.Printf("Reading checksums from %s\n", w.sums)
+			s, err := web.LoadSums(w.sums, w.sig, keyring, webConfig)
+			if err != nil {
+				return err
+			}
+			sums[key] = s
+		}
+		// the checksums file lists the file name from the url
+		sha, err := sums[key].Get(urlFileName(w.url), w.fileName)
+		if err != nil {
+			return fmt.Errorf("problem finding the checksum for web file %s in %s:%s", w.fileName, w.sums, err)
+		}
+		webFiles[i].sha = sha
+	}
+	return nil
+}
+
+// urlFileName will return the file name at the end of a url path
+func urlFileName(rawurl string) string {
+	return path.Base(strings.SplitN(strings.SplitN(rawurl, "?", 2)[0], "#", 2)[0])
+}
+
+// getWebConfig gets the auth and TLS settings for web downloads (nil if not
+// set)
+func getWebConfig(c *cobra.Command) (*web.Config, error) {
+	file := c.Flag(FlagWebConfig).Value.String()
+	if len(file) == 0 {
+		return nil, nil
+	}
+	return web.LoadConfig(file)
+}
+
+// getWebMirrors gets the web mirrors from flags (in order)
+func getWebMirrors(c *cobra.Command) ([]webMirror, error) {
+	var mirrors []webMirror
+	for _, mirror := range strings.Fields(c.Flag(FlagWebMirrors).Value.String()) {
+		parts := strings.SplitN(mirror, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf(
+				"expecting a web mirror in the format prefix=mirror, got %q", mirror)
+		}
+		mirrors = append(mirrors, webMirror{prefix: parts[0], mirror: parts[1]})
+	}
+	return mirrors, nil
+}
+
+// withMirrors will list the urls to try for a web file, any mirrors first
+func withMirrors(urls []string, mirrors []webMirror) []string {
+	var candidates []string
+	for _, url := range urls {
+		for _, m := range mirrors {
+			if strings.HasPrefix(url, m.prefix) {
+				candidates = append(candidates, m.mirror+strings.TrimPrefix(url, m.prefix))
+			}
+		}
+	}
+	var all []string
+	for _, url := range append(candidates, urls...) {
+		if !contains(all, url) {
+			all = append(all, url)
+		}
+	}
+	return all
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseRenames(t *testing.T) {
+	tests := []struct {
+		renames string
+		names   map[string]string
+		err     string
+	}{
+		{"", map[string]string{}, ""},
+		{"darwin:macos", map[string]string{"darwin": "macos"}, ""},
+		{"amd64:x86_64;arm64:aarch64", map[string]string{"amd64": "x86_64", "arm64": "aarch64"}, ""},
+		{"amd64:x86_64;arm64", nil, `expecting old:new, got "arm64"`},
+	}
+	for _, test := range tests {
+		names, err := parseRenames(test.renames)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err, test.renames)
+			continue
+		}
+		assert.NilError(t, err, test.renames)
+		assert.DeepEqual(t, names, test.names)
+	}
+}
+
+func TestExpandWebFile(t *testing.T) {
+	platforms := []string{"linux_amd64", "darwin_arm64"}
+	tests := []struct {
+		name string
+		w    webfile
+		// want is the url, file name, sha, target and extract for each platform
+		want [][5]string
+		err  string
+	}{
+		{
+			name: "renames",
+			w: webfile{
+				url:      "https://example.com/{{.Version}}/tool_{{.OS}}_{{.Arch}}.zip",
+				fileName: "tool_{{.Platform}}.zip",
+				sha:      "abc",
+				meta:     map[string]string{webOptVersion: "1.0", webOptOS: "darwin:macos", webOptArch: "amd64:x86_64"},
+			},
+			want: [][5]string{
+				{"https://example.com/1.0/tool_linux_x86_64.zip", "tool_linux_amd64.zip", "abc", "", ""},
+				{"https://example.com/1.0/tool_macos_arm64.zip", "tool_darwin_arm64.zip", "abc", "", ""},
+			},
+		},
+		{
+			name: "platform checksums",
+			w: webfile{
+				url:      "https://example.com/tool_{{.Platform}}",
+				fileName: "tool_{{.Platform}}",
+				sha:      "linux_amd64=abc;darwin_arm64=def",
+				meta:     map[string]string{},
+			},
+			want: [][5]string{
+				{"https://example.com/tool_linux_amd64", "tool_linux_amd64", "abc", "", ""},
+				{"https://example.com/tool_darwin_arm64", "tool_darwin_arm64", "def", "", ""},
+			},
+		},
+		{
+			name: "missing platform checksum",
+			w: webfile{
+				url:      "https://example.com/tool_{{.Platform}}",
+				fileName: "tool_{{.Platform}}",
+				sha:      "linux_amd64=abc",
+				meta:     map[string]string{},
+			},
+			err: "no checksum for darwin_arm64",
+		},
+		{
+			name: "invalid platform checksums",
+			w: webfile{
+				url:      "https://example.com/tool_{{.Platform}}",
+				fileName: "tool_{{.Platform}}",
+				sha:      "linux_amd64=abc;def",
+				meta:     map[string]string{},
+			},
+			err: "expecting checksums in the format platform=sha256",
+		},
+		{
+			name: "target and extract",
+			w: webfile{
+				url:      "https://example.com/tool_{{.Platform}}.tgz",
+				fileName: "tool_{{.Platform}}.tgz",
+				sha:      "abc",
+				meta: map[string]string{
+					webMetaTarget:  "../bin/{{.OS}}/tool.tgz",
+					webMetaExtract: "../tools/{{.Platform}}",
+				},
+			},
+			want: [][5]string{
+				{"https://example.com/tool_linux_amd64.tgz", "tool_linux_amd64.tgz", "abc", "../bin/linux/tool.tgz", "../tools/linux_amd64"},
+				{"https://example.com/tool_darwin_arm64.tgz", "tool_darwin_arm64.tgz", "abc", "../bin/darwin/tool.tgz", "../tools/darwin_arm64"},
+			},
+		},
+		{
+			name: "unknown field",
+			w: webfile{
+				url:      "https://example.com/tool_{{.Release}}",
+				fileName: "tool_{{.Platform}}",
+				sha:      "abc",
+				meta:     map[string]string{},
+			},
+			err: "invalid template for web file",
+		},
+	}
+	for _, test := range tests {
+		expanded, err := expandWebFile(test.w, platforms)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err, test.name)
+			continue
+		}
+		assert.NilError(t, err, test.name)
+		assert.Equal(t, len(expanded), len(test.want), test.name)
+		for i, p := range expanded {
+			assert.Equal(t, p.platform, platforms[i], test.name)
+			got := [5]string{p.url, p.fileName, p.sha, p.meta[webMetaTarget], p.meta[webMetaExtract]}
+			assert.DeepEqual(t, got, test.want[i])
+		}
+	}
+}
+
+func TestParseWebFilesDuplicates(t *testing.T) {
+	platforms := []string{"linux_amd64", "darwin_amd64"}
+	tests := []struct {
+		name string
+		csvs []string
+		err  string
+	}{
+		{
+			name: "templated targets",
+			csvs: []string{"https://example.com/tool_{{.Platform}},tool_{{.Platform}},abc,target=../bin/tool_{{.OS}}"},
+		},
+		{
+			name: "same file name",
+			csvs: []string{"https://example.com/tool_{{.Platform}},tool,abc"},
+			err:  "web file tool would be saved from",
+		},
+		{
+			name: "same target",
+			csvs: []string{"https://example.com/tool_{{.Platform}},tool_{{.Platform}},abc,target=../bin/tool"},
+			err:  "would both be restored with target=../bin/tool",
+		},
+		{
+			name: "same extract dir",
+			csvs: []string{
+				"https://example.com/a.tgz,a.tgz,abc,extract=../tools",
+				"https://example.com/b.tgz,b.tgz,def,extract=../tools/",
+			},
+			err: "web files a.tgz and b.tgz would both be restored with extract=../tools",
+		},
+	}
+	for _, test := range tests {
+		_, err := parseWebFiles(test.csvs, platforms, nil)
+		if len(test.err) > 0 {
+			assert.ErrorContains(t, err, test.err, test.name)
+			continue
+		}
+		assert.NilError(t, err, test.name)
+	}
+}
@@ -6,14 +6,18 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
 
+	"github.com/appvia/artefactor/pkg/cache"
+	"github.com/appvia/artefactor/pkg/crypt"
 	"github.com/appvia/artefactor/pkg/docker"
 	"github.com/appvia/artefactor/pkg/git"
 	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/local"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"github.com/appvia/artefactor/pkg/tar"
 	"github.com/appvia/artefactor/pkg/util"
-	"github.com/appvia/artefactor/pkg/version"
 	"github.com/appvia/artefactor/pkg/web"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -22,9 +26,20 @@ import (
 // SaveCommand is the sub command syntax
 const (
 	SaveCommand           string = "save"
-	SaveDirMetaFile       string = "saveDir.meta"
 	ArtefactorBinaryName  string = "artefactor"
 	ArtefactorPublishRoot string = "https://github.com/appvia/artefactor/releases/download/%s/"
+
+	// options for web files to record in the manifest
+	webMetaMode   string = "mode"
+	webMetaOwner  string = "owner"
+	webMetaTarget string = "target"
+	// webMetaExtract is a dir to extract an archive to on restore
+	webMetaExtract string = "extract"
+	// webMetaStrip is the number of leading path elements to strip when
+	// extracting
+	webMetaStrip string = "strip"
+	// webMetaKeep is a ; seperated list of patterns of the members to extract
+	webMetaKeep string = "keep"
 )
 
 // saveCmd represents the version command
@@ -48,7 +63,24 @@ func init() {
 		saveCmd,
 		FlagTargetPlatform,
 		DefaultTargetPlatform,
-		"the target platform in format [platform]_[arch]")
+		"a whitespace seperated list of target platforms to save artefactor binaries for in format [platform]_[arch]")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagCacheDir,
+		cache.DefaultDir(),
+		"the user cache of downloads and images shared by archive dirs")
+
+	addBoolFlagWithEnvDefault(
+		saveCmd,
+		FlagNoCache,
+		"don't use or add to the user cache")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagArtefactorSource,
+		"",
+		"a local dir or url with the artefactor binaries for other platforms and their checksum file (defaults to the github release)")
 
 	addFlagWithEnvDefault(
 		saveCmd,
@@ -56,6 +88,110 @@ func init() {
 		"",
 		"the whitelist separated list of variables specifying original image names")
 
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagWebPlatforms,
+		"",
+		"a whitespace seperated list of platforms to save templated web files for (defaults to the target platforms)")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagWebMirrors,
+		"",
+		"a whitespace seperated list of url prefixes to download web files from first (prefix=mirror)")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagWebConfig,
+		"",
+		"a JSON file with per host auth and TLS settings for downloading web files")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagWebSumsKeyring,
+		"",
+		"an OpenPGP keyring file to verify web file checksums files with (each must then have a sig=)")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagLocalFiles,
+		"",
+		"a whitespace seperated list of CSV's: path[,filename][,true][,mode=|owner=|target=]")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagLocalDirs,
+		"",
+		"a whitespace seperated list of CSV's: path[,filename][,mode=|owner=|target=] (saved as a tar)")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagGitFormat,
+		git.FormatTar,
+		"how to archive git repos, tar (working tree and .git) or bundle (commits and refs)")
+
+	addBoolFlagWithEnvDefault(
+		saveCmd,
+		FlagGitIncremental,
+		"only bundle git commits added since the last save (requires bundle format)")
+
+	addBoolFlagWithEnvDefault(
+		saveCmd,
+		FlagGitSanitize,
+		"remove hooks, reflogs, stashes and remote credentials from saved git repos")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagGitSanitizeRemotes,
+		git.RemotesRedact,
+		"when sanitizing, redact credentials from or remove all git remotes (redact or remove)")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagGitRemoteRewrites,
+		"",
+		"when sanitizing, a whitespace seperated list of remote url prefixes to replace (old=new)")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagGitKeepRefs,
+		"",
+		"when sanitizing, a whitespace seperated list of git refs to keep e.g. main refs/tags/*")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagSaveSince,
+		"",
+		"a previous checksum file (or bundle dir) to only ship artefacts changed since (a delta bundle, requires --"+FlagBundleDir+")")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagBundleDir,
+		"",
+		"a dir to save the artefacts to ship to (the archive dir keeps all the artefacts to save again from)")
+
+	addBoolFlagWithEnvDefault(
+		saveCmd,
+		FlagEncrypt,
+		"encrypt the artefacts saved to the bundle dir (requires --"+FlagBundleDir+" and --"+FlagEncryptRecipients+" or --"+FlagPassphraseFile+")")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagEncryptRecipients,
+		"",
+		"a whitespace seperated list of public keys (or files of public keys) to encrypt to")
+
+	addFlagWithEnvDefault(
+		saveCmd,
+		FlagPassphraseFile,
+		"",
+		"a file with a passphrase to encrypt with (instead of --"+FlagEncryptRecipients+")")
+
+	addBoolFlagWithEnvDefault(
+		saveCmd,
+		FlagDockerLayerDelta,
+		"leave out image layers shipped with the previous bundle (requires --"+FlagSaveSince+")")
+
 	addFlagWithEnvDefault(
 		saveCmd,
 		FlagDockerUserName,
@@ -76,53 +212,113 @@ func save(c *cobra.Command) error {
 	// Record where the archives should be stored
 	saveDir := c.Flag(FlagArchiveDir).Value.String()
 
-	type webfile struct {
-		url      string
-		fileName string
-		sha      string
-		bin      bool
+	// Pre-flight checks:
+	platforms, err := getTargetPlatforms(c)
+	if err != nil {
+		return err
+	}
+	mirrors, err := getWebMirrors(c)
+	if err != nil {
+		return err
+	}
+	webConfig, err := getWebConfig(c)
+	if err != nil {
+		return err
+	}
+	webFiles, err := getWebFiles(c, mirrors, webConfig)
+	if err != nil {
+		return err
+	}
+	userCache, err := getUserCache(c)
+	if err != nil {
+		return err
 	}
 
-	// Pre-flight checks:
-	webFiles := []webfile{}
-	for _, webFile := range strings.Fields(c.Flag(FlagWebFiles).Value.String()) {
-		parts := strings.Split(webFile, ",")
-		if len(parts) < 3 {
-			return errors.Errorf("expecting a web file CSV with url,filename,sha256[,true|false]")
-		}
-		binFile := false
-		if len(parts) == 4 {
-			if strings.ToLower(parts[3]) == "true" {
-				binFile = true
-			}
-		}
-		w := webfile{
-			url:      parts[0],
-			fileName: parts[1],
-			sha:      parts[2],
-			bin:      binFile,
-		}
-		webFiles = append(webFiles, w)
+	localFiles, err := getLocalFiles(c)
+	if err != nil {
+		return err
 	}
 
 	// validate all git repo's exists and are clean
 	gitRepos := strings.Fields(c.Flag(FlagGitRepos).Value.String())
 	for _, repo := range gitRepos {
-		if isclean, err := git.IsClean(repo); err != nil && !isclean {
+		repoPath, ref := git.SplitRef(repo)
+		if len(ref) > 0 {
+			// a ref is archived from a separate checkout so needn't be clean
+			continue
+		}
+		if isclean, err := git.IsClean(repoPath); err != nil {
 			return fmt.Errorf(
 				"unable to check git repo %s:%s",
 				repo,
 				err)
-		} else if err != nil {
+		} else if !isclean {
 			return fmt.Errorf(
 				"git repo %s is not clean - refusing to continue",
 				repo)
 		}
 	}
 
+	gitOpts := git.ArchiveOptions{
+		Format: c.Flag(FlagGitFormat).Value.String(),
+	}
+	gitOpts.Incremental, _ = c.Flags().GetBool(FlagGitIncremental)
+	if gitOpts.Format != git.FormatTar && gitOpts.Format != git.FormatBundle {
+		return fmt.Errorf(
+			"unknown git format %q, expecting %s or %s",
+			gitOpts.Format,
+			git.FormatTar,
+			git.FormatBundle)
+	}
+	if gitOpts.Incremental && gitOpts.Format != git.FormatBundle {
+		return fmt.Errorf("--%s requires --%s=%s", FlagGitIncremental, FlagGitFormat, git.FormatBundle)
+	}
+
+	if sanitize, _ := c.Flags().GetBool(FlagGitSanitize); sanitize {
+		sanitizeOpts, err := getSanitizeOptions(c)
+		if err != nil {
+			return err
+		}
+		gitOpts.Sanitize = sanitizeOpts
+	}
+
 	// validate docker images
 	images := getImages(c)
 
+	// a delta bundle is saved against the checksums already shipped
+	var since *hashcache.CheckSumCache
+	if sincePath := c.Flag(FlagSaveSince).Value.String(); len(sincePath) > 0 {
+		var err error
+		if since, err = getSinceCheckSums(sincePath); err != nil {
+			return err
+		}
+	}
+	layerDelta, _ := c.Flags().GetBool(FlagDockerLayerDelta)
+	if layerDelta && since == nil {
+		return fmt.Errorf("--%s requires --%s", FlagDockerLayerDelta, FlagSaveSince)
+	}
+	bundleDir := c.Flag(FlagBundleDir).Value.String()
+	if since != nil && len(bundleDir) == 0 {
+		return fmt.Errorf(
+			"--%s requires --%s to save the delta bundle to", FlagSaveSince, FlagBundleDir)
+	}
+	if len(bundleDir) > 0 {
+		if err := checkBundleDir(bundleDir, saveDir); err != nil {
+			return err
+		}
+	}
+	var recipients []crypt.Recipient
+	if encrypt, _ := c.Flags().GetBool(FlagEncrypt); encrypt {
+		if len(bundleDir) == 0 {
+			return fmt.Errorf(
+				"--%s requires --%s to save the encrypted bundle to", FlagEncrypt, FlagBundleDir)
+		}
+		var err error
+		if recipients, err = getRecipients(c); err != nil {
+			return err
+		}
+	}
+
 	// Now make changes
 	if _, err := os.Stat(saveDir); os.IsNotExist(err) {
 		// Create the downloads folder
@@ -139,48 +335,82 @@ func save(c *cobra.Command) error {
 	if err != nil {
 		return fmt.Errorf("cant create cache for dir %s:%s", saveDir, err)
 	}
-	fmt.Println("Saving meta-data and me")
-	if err := saveSavedPath(hc, saveDir); err != nil {
-		return fmt.Errorf(
-			"problem saving meta data file to record archive path %s:%s",
-			saveDir,
-			err)
+	// Record the meta-data for all artefacts so they can be restored faithfully
+	m := manifest.New(saveDir)
+	fmt.Println("Saving me")
+
+	// Save the binary for the target platform (or for each target platform and
+	// a launcher to pick one)
+	artefactorSource := c.Flag(FlagArtefactorSource).Value.String()
+	for _, platform := range platforms {
+		binName := platformBinName(platform)
+		if len(platforms) == 1 {
+			binName = ArtefactorBinaryName
+		}
+		savedBin, err := saveMe(hc, saveDir, platform, binName, artefactorSource, webConfig, userCache)
+		if err != nil {
+			return err
+		}
+		m.Add(savedBin, manifest.TypeArtefactor, platform, 0755).Platform = platform
 	}
-
-	// Save the binary for the target platform
-	platform := c.Flag(FlagTargetPlatform).Value.String()
-	if err := saveMe(hc, saveDir, platform); err != nil {
-		return err
+	if len(platforms) > 1 {
+		launcher, err := saveLauncher(hc, saveDir)
+		if err != nil {
+			return err
+		}
+		m.Add(launcher, manifest.TypeArtefactor, strings.Join(platforms, " "), 0755)
 	}
 
 	// save any git repos
 	for _, repo := range gitRepos {
 		fmt.Printf("\nSaving git repos\n")
-		if err := git.Archive(hc, repo, saveDir); err != nil {
+		files, err := git.Archive(hc, repo, saveDir, gitOpts)
+		if err != nil {
 			return fmt.Errorf(
 				"problem saving git repository %s to directory %s:%s",
 				repo,
 				saveDir,
 				err)
 		}
+		for _, file := range files {
+			if strings.HasSuffix(file, git.GitBaseExt) {
+				m.Add(file, manifest.TypeGitBase, repo, 0644)
+				continue
+			}
+			a := m.Add(file, manifest.TypeGit, repo, 0644)
+			if a.Commit, err = git.GetArchiveCommit(file); err != nil {
+				return fmt.Errorf("problem reading commit from %s:%s", file, err)
+			}
+		}
 	}
 
 	// save docker images
 	for _, image := range images {
 		fmt.Printf("\nSaving docker images\n")
-		if err := docker.Save(hc, image, saveDir, getCredsFromFlags(c)); err != nil {
+		if err := docker.Save(hc, image, saveDir, getCredsFromFlags(c), userCache); err != nil {
 			return fmt.Errorf(
 				"problem saving docker image %s to directory %s:%s",
 				image,
 				saveDir,
 				err)
 		}
+		imageFile, err := docker.ImageToFilePath(image, saveDir)
+		if err != nil {
+			return err
+		}
+		a := m.Add(imageFile, manifest.TypeDockerImage, image, 0644)
+		if a.Digest, err = docker.GetArchiveImageID(imageFile); err != nil {
+			return fmt.Errorf("problem reading image ID from %s:%s", imageFile, err)
+		}
+		if a.Layers, err = docker.GetArchiveLayers(imageFile); err != nil {
+			return fmt.Errorf("problem reading image layers from %s:%s", imageFile, err)
+		}
 	}
 
 	// Now save Web files
 	for _, webFile := range webFiles {
 		fmt.Printf("\nSaving web files\n")
-		if err := web.Save(hc, webFile.url, webFile.fileName, saveDir, webFile.sha, webFile.bin); err != nil {
+		if err := web.Save(hc, webFile.urls, webFile.fileName, saveDir, webFile.sha, webFile.bin, webConfig, userCache); err != nil {
 			return fmt.Errorf(
 				"problem saving url:%s to filename %s/%s:%s",
 				webFile.url,
@@ -188,14 +418,487 @@ func save(c *cobra.Command) error {
 				webFile.fileName,
 				err)
 		}
+		if err := addFileArtefact(m, webFile.fileName, manifest.TypeWebFile, webFile.url, webFile.bin, webFile.meta); err != nil {
+			return err
+		}
+		m.Get(webFile.fileName).Platform = webFile.platform
+	}
+
+	// save local files and dirs
+	for _, localFile := range localFiles {
+		fmt.Printf("\nSaving local files\n")
+		artefactType := manifest.TypeLocalFile
+		save := local.SaveFile
+		if localFile.dir {
+			artefactType = manifest.TypeLocalDir
+			save = local.SaveDir
+		}
+		if err := save(hc, localFile.src, localFile.fileName, saveDir); err != nil {
+			return fmt.Errorf(
+				"problem saving %s to filename %s/%s:%s",
+				localFile.src,
+				saveDir,
+				localFile.fileName,
+				err)
+		}
+		if err := addFileArtefact(m, localFile.fileName, artefactType, localFile.src, localFile.bin, localFile.meta); err != nil {
+			return err
+		}
+	}
+	if err := m.Save(hc); err != nil {
+		return err
 	}
 	if err := hc.Clean(); err != nil {
 		return fmt.Errorf("problem saving new set of files:%s", err)
 	}
 	fmt.Printf("all artefacts correct and present\n")
+	if len(bundleDir) > 0 {
+		return saveBundle(hc, m, bundleDir, since, layerDelta, recipients)
+	}
+	return nil
+}
+
+// checkBundleDir will check a bundle dir is outside the archive dir and is new,
+// empty or a previous bundle (as files not in the bundle are removed)
+func checkBundleDir(bundleDir string, saveDir string) error {
+	absBundleDir, err := filepath.Abs(bundleDir)
+	if err != nil {
+		return err
+	}
+	absSaveDir, err := filepath.Abs(saveDir)
+	if err != nil {
+		return err
+	}
+	if isWithin(absSaveDir, absBundleDir) || isWithin(absBundleDir, absSaveDir) {
+		return fmt.Errorf(
+			"--%s %s must be outside the archive dir %s", FlagBundleDir, bundleDir, saveDir)
+	}
+	files, err := ioutil.ReadDir(bundleDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(bundleDir, hashcache.DefaultCheckSumFileName)); len(files) > 0 && err != nil {
+		return fmt.Errorf(
+			"--%s %s must be empty or a previous bundle (no %s)",
+			FlagBundleDir,
+			bundleDir,
+			hashcache.DefaultCheckSumFileName)
+	}
 	return nil
 }
 
+// isWithin will check if path is dir or under dir
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// saveBundle will save the artefacts to ship to the bundle dir. Artefacts are
+// linked (or copied) from the archive dir and left out when unchanged since the
+// previous bundle. Layers are left out of images and artefacts encrypted in the
+// bundle dir so the archive dir is left to save again from.
+func saveBundle(
+	hc *hashcache.CheckSumCache,
+	m *manifest.Manifest,
+	bundleDir string,
+	since *hashcache.CheckSumCache,
+	layerDelta bool,
+	recipients []crypt.Recipient) error {
+
+	fmt.Printf("\nSaving bundle to %s\n", bundleDir)
+	if err := os.MkdirAll(bundleDir, 0744); err != nil {
+		return fmt.Errorf("problem creating bundle dir %s:%s", bundleDir, err)
+	}
+	// start with an empty checksum file so any previous bundle is replaced
+	bc, err := hashcache.NewFromDir(bundleDir, false)
+	if err != nil {
+		return fmt.Errorf("cant create cache for dir %s:%s", bundleDir, err)
+	}
+	if err := os.Remove(bc.CheckSumFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	bm := m.Copy()
+	shipped := make(map[string]string)
+	if since != nil {
+		if shipped, err = markUnchanged(hc, bm, since); err != nil {
+			return err
+		}
+	}
+	for _, a := range bm.Artefacts {
+		file := filepath.Join(hc.Dir, a.Name)
+		if _, ok := hc.CheckSumsByFilePath[file]; !ok {
+			return fmt.Errorf("no checksum for %s to bundle", file)
+		}
+		bundled := filepath.Join(bundleDir, a.Name)
+		if a.Unchanged {
+			// verified at the destination on restore
+			if err := bc.Add(bundled, shipped[a.Name]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := util.Link(file, bundled); err != nil {
+			return fmt.Errorf("problem saving %s to bundle %s:%s", file, bundleDir, err)
+		}
+		if _, err := bc.Update(bundled); err != nil {
+			return fmt.Errorf("unable to update hash for %s:%s", bundled, err)
+		}
+	}
+	if layerDelta {
+		if err := stripSharedLayers(bc, bm, since); err != nil {
+			return err
+		}
+	}
+	if len(recipients) > 0 {
+		if err := encryptArtefacts(bc, bm, recipients); err != nil {
+			return err
+		}
+	}
+	if err := bm.Save(bc); err != nil {
+		return err
+	}
+	if err := bc.Clean(); err != nil {
+		return fmt.Errorf("problem saving bundle checksums:%s", err)
+	}
+	if err := removeUnbundled(bc); err != nil {
+		return err
+	}
+	unchanged := bm.Unchanged()
+	if since != nil {
+		fmt.Printf(
+			"delta bundle saved to %s with %d changed artefacts (%d unchanged artefacts not shipped)\n",
+			bundleDir,
+			len(bm.Artefacts)-len(unchanged),
+			len(unchanged))
+	} else {
+		fmt.Printf("bundle saved to %s with %d artefacts\n", bundleDir, len(bm.Artefacts))
+	}
+	return nil
+}
+
+// getSinceCheckSums will read the checksums of a previous bundle from a
+// checksum file or archive dir
+func getSinceCheckSums(sincePath string) (*hashcache.CheckSumCache, error) {
+	if fi, err := os.Stat(sincePath); err != nil {
+		return nil, fmt.Errorf("missing previous checksum file or archive dir %s", sincePath)
+	} else if fi.IsDir() {
+		sincePath = filepath.Join(sincePath, hashcache.DefaultCheckSumFileName)
+	}
+	return hashcache.NewFromCheckSumsFile(sincePath, true)
+}
+
+// markUnchanged will record the artefacts with the same checksum as in the
+// previous bundle (artefactor itself is always shipped so it can restore) and
+// returns the checksums they were shipped with
+func markUnchanged(
+	c *hashcache.CheckSumCache,
+	m *manifest.Manifest,
+	since *hashcache.CheckSumCache) (map[string]string, error) {
+
+	sum, err := hashcache.CalcChecksum(since.CheckSumFile)
+	if err != nil {
+		return nil, err
+	}
+	m.Since = sum
+	prev, err := manifest.Load(since.Dir)
+	if err != nil {
+		prev = manifest.New(since.Dir)
+	}
+	shipped := make(map[string]string)
+	for _, a := range m.Artefacts {
+		if a.Type == manifest.TypeArtefactor {
+			continue
+		}
+		item, ok := c.CheckSumsByFilePath[filepath.Join(c.Dir, a.Name)]
+		prevItem, prevOk := since.CheckSumsByFilePath[filepath.Join(since.Dir, a.Name)]
+		if !ok || !prevOk {
+			a.Unchanged = false
+			continue
+		}
+		prevSum := prevItem.CheckSum
+		prevA := prev.Get(a.Name)
+		if prevA != nil && prevA.Encrypted {
+			// encrypted files differ every time so compare the decrypted files
+			prevSum = prevA.PlainSha256
+		}
+		if prevA != nil && isGitTar(a) && len(prevA.Commit) > 0 {
+			// git tars differ each time they are saved so compare the commits
+			a.Unchanged = a.Commit == prevA.Commit
+		} else {
+			a.Unchanged = item.CheckSum == prevSum
+		}
+		if a.Unchanged {
+			shipped[a.Name] = prevSum
+		}
+	}
+	return shipped, nil
+}
+
+// isGitTar will check if an artefact is a git repo saved as a tar
+func isGitTar(a *manifest.Artefact) bool {
+	return a.Type == manifest.TypeGit && len(a.Commit) > 0 && !git.IsBundle(a.Name)
+}
+
+// stripSharedLayers will leave out the layers of changed docker images that were
+// shipped with an image in the previous bundle. Layers are only shared from the
+// bottom up so the image with the most layers in common is used
+func stripSharedLayers(c *hashcache.CheckSumCache, m *manifest.Manifest, since *hashcache.CheckSumCache) error {
+	prev, err := manifest.Load(since.Dir)
+	if err != nil {
+		return fmt.Errorf("no manifest for the previous bundle in %s:%s", since.Dir, err)
+	}
+	for _, prevImage := range prev.Artefacts {
+		if prevImage.Type != manifest.TypeDockerImage || len(prevImage.Layers) > 0 {
+			continue
+		}
+		// saved before layers were recorded so read them from the image (if present)
+		file := filepath.Join(since.Dir, prevImage.Name)
+		if prevImage.Layers, err = docker.GetArchiveLayers(file); err != nil {
+			log.Printf("can't read layers for previous image %s:%s", file, err)
+		}
+	}
+	for _, a := range m.Artefacts {
+		if a.Type != manifest.TypeDockerImage || a.Unchanged {
+			continue
+		}
+		var base *manifest.Artefact
+		shared := 0
+		for _, prevImage := range prev.Artefacts {
+			if prevImage.Type != manifest.TypeDockerImage || len(prevImage.Source) == 0 {
+				continue
+			}
+			if count := docker.SharedLayers(a.Layers, prevImage.Layers); count > shared {
+				base = prevImage
+				shared = count
+			}
+		}
+		if base == nil {
+			log.Printf("no layers shared with previous images for %s", a.Source)
+			continue
+		}
+		file := filepath.Join(c.Dir, a.Name)
+		if err := docker.StripLayers(file, shared); err != nil {
+			return err
+		}
+		if _, err := c.Update(file); err != nil {
+			return fmt.Errorf("unable to update hash for %s:%s", file, err)
+		}
+		a.BaseImage = base.Source
+		a.BaseLayers = shared
+		fmt.Printf(
+			"left out %d of %d layers from %s (shipped with %s)\n",
+			shared,
+			len(a.Layers),
+			a.Source,
+			base.Source)
+	}
+	return nil
+}
+
+// getRecipients will read the public keys and passphrase to encrypt to
+func getRecipients(c *cobra.Command) ([]crypt.Recipient, error) {
+	var recipients []crypt.Recipient
+	for _, recipient := range strings.Fields(c.Flag(FlagEncryptRecipients).Value.String()) {
+		if strings.HasPrefix(recipient, crypt.PublicKeyPrefix) {
+			r, err := crypt.ParseX25519Recipient(recipient)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+		fileRecipients, err := crypt.ReadRecipients(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading recipients file %s:%s", recipient, err)
+		}
+		recipients = append(recipients, fileRecipients...)
+	}
+	passphrase, err := getPassphrase(c)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != nil {
+		if len(recipients) > 0 {
+			return nil, fmt.Errorf(
+				"--%s can't be used with --%s (a passphrase must be the only recipient)",
+				FlagPassphraseFile, FlagEncryptRecipients)
+		}
+		recipients = append(recipients, passphrase)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf(
+			"--%s requires --%s or --%s", FlagEncrypt, FlagEncryptRecipients, FlagPassphraseFile)
+	}
+	return recipients, nil
+}
+
+// encryptArtefacts will encrypt the artefacts shipped in a bundle dir (the
+// archive dir files linked to them are kept unencrypted to save again from).
+// The artefactor binary is left so it can decrypt the rest and git base files
+// only have refs
+func encryptArtefacts(c *hashcache.CheckSumCache, m *manifest.Manifest, recipients []crypt.Recipient) error {
+	for _, a := range m.Artefacts {
+		if a.Unchanged || a.Type == manifest.TypeArtefactor || a.Type == manifest.TypeGitBase {
+			continue
+		}
+		file := filepath.Join(c.Dir, a.Name)
+		item, ok := c.CheckSumsByFilePath[file]
+		if !ok {
+			return fmt.Errorf("no checksum for %s to encrypt", file)
+		}
+		plainSum := item.CheckSum
+		fmt.Printf("Encrypting %s\n", file)
+		if err := crypt.EncryptFile(file, recipients); err != nil {
+			return fmt.Errorf("problem encrypting %s:%s", file, err)
+		}
+		if _, err := c.Update(file); err != nil {
+			return fmt.Errorf("unable to update hash for %s:%s", file, err)
+		}
+		a.Encrypted = true
+		a.PlainSha256 = plainSum
+	}
+	return nil
+}
+
+// removeUnbundled will remove the files left in a bundle dir by a previous
+// bundle
+func removeUnbundled(bc *hashcache.CheckSumCache) error {
+	files, err := ioutil.ReadDir(bc.Dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		file := filepath.Join(bc.Dir, fi.Name())
+		if fi.IsDir() || file == filepath.Clean(bc.CheckSumFile) {
+			continue
+		}
+		if _, ok := bc.CheckSumsByFilePath[file]; !ok {
+			log.Printf("removing %s from previous bundle", file)
+			if err := os.Remove(file); err != nil {
+				return fmt.Errorf("problem removing %s from bundle:%s", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// localFile is a local file or dir to save
+type localFile struct {
+	src      string
+	fileName string
+	dir      bool
+	bin      bool
+	meta     map[string]string
+}
+
+// getLocalFiles gets the local files and dirs to save from flags, checking they
+// exist
+func getLocalFiles(c *cobra.Command) ([]localFile, error) {
+	var localFiles []localFile
+	for _, flag := range []string{FlagLocalFiles, FlagLocalDirs} {
+		dir := flag == FlagLocalDirs
+		for _, csv := range strings.Fields(c.Flag(flag).Value.String()) {
+			parts := strings.Split(csv, ",")
+			l := localFile{
+				src:      filepath.Clean(parts[0]),
+				fileName: filepath.Base(parts[0]),
+				dir:      dir,
+			}
+			if dir {
+				l.fileName += local.DirExt
+			}
+			options := parts[1:]
+			if len(options) > 0 && !strings.Contains(options[0], "=") && !isBool(options[0]) {
+				l.fileName = options[0]
+				options = options[1:]
+			}
+			var err error
+			if l.bin, l.meta, err = parseFileOptions(l.fileName, options); err != nil {
+				return nil, err
+			}
+			fi, err := os.Stat(l.src)
+			if err != nil {
+				return nil, fmt.Errorf("problem with --%s %s:%s", flag, l.src, err)
+			}
+			if dir && !fi.IsDir() {
+				return nil, fmt.Errorf("--%s %s is not a directory", flag, l.src)
+			}
+			if !dir && fi.IsDir() {
+				return nil, fmt.Errorf("--%s %s is a directory, use --%s", flag, l.src, FlagLocalDirs)
+			}
+			localFiles = append(localFiles, l)
+		}
+	}
+	return localFiles, nil
+}
+
+// parseFileOptions will read the executable flag and the key=value options of
+// a web or local file (mode, owner, target and any extra keys allowed)
+func parseFileOptions(fileName string, options []string, extra ...string) (bool, map[string]string, error) {
+	keys := append([]string{
+		webMetaMode,
+		webMetaOwner,
+		webMetaTarget,
+		webMetaExtract,
+		webMetaStrip,
+		webMetaKeep,
+	}, extra...)
+	bin := false
+	meta := make(map[string]string)
+	for _, option := range options {
+		if kv := strings.SplitN(option, "=", 2); len(kv) == 2 {
+			if !contains(keys, kv[0]) {
+				return false, nil, errors.Errorf(
+					"unknown option %q for %s, expecting one of %s",
+					kv[0], fileName, strings.Join(keys, ", "))
+			}
+			meta[kv[0]] = kv[1]
+			continue
+		}
+		if strings.ToLower(option) == "true" {
+			bin = true
+		}
+	}
+	// check how to extract before saving anything
+	if err := addExtract(&manifest.Artefact{Name: fileName}, meta); err != nil {
+		return false, nil, err
+	}
+	return bin, meta, nil
+}
+
+func isBool(s string) bool {
+	return strings.ToLower(s) == "true" || strings.ToLower(s) == "false"
+}
+
+// getSanitizeOptions gets the options for sanitizing git repos from flags
+func getSanitizeOptions(c *cobra.Command) (*git.SanitizeOptions, error) {
+	opts := &git.SanitizeOptions{
+		Remotes:        c.Flag(FlagGitSanitizeRemotes).Value.String(),
+		RemoteRewrites: make(map[string]string),
+		KeepRefs:       strings.Fields(c.Flag(FlagGitKeepRefs).Value.String()),
+	}
+	if opts.Remotes != git.RemotesRedact && opts.Remotes != git.RemotesRemove {
+		return nil, fmt.Errorf(
+			"unknown option %q for --%s, expecting %s or %s",
+			opts.Remotes,
+			FlagGitSanitizeRemotes,
+			git.RemotesRedact,
+			git.RemotesRemove)
+	}
+	for _, rewrite := range strings.Fields(c.Flag(FlagGitRemoteRewrites).Value.String()) {
+		parts := strings.SplitN(rewrite, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf(
+				"expecting a remote rewrite in the format old=new, got %q", rewrite)
+		}
+		opts.RemoteRewrites[parts[0]] = parts[1]
+	}
+	return opts, nil
+}
+
 // getImages gets the images from either docker-images or image-vars
 func getImages(c *cobra.Command) []string {
 	images := strings.Fields(c.Flag(FlagDockerImages).Value.String())
@@ -220,120 +923,83 @@ func contains(ary []string, item string) bool {
 	return false
 }
 
-// saveMe saves a copy of the target binary in the save dir
-func saveMe(c *hashcache.CheckSumCache, saveDir string, platform string) error {
-	binaryDst := filepath.Join(saveDir, ArtefactorBinaryName)
-	// detect if the binary we are saving with matches target platform...
-	if fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH) == platform {
-		me, _ := os.Executable()
-		if err := copyBin(c, me, saveDir); err != nil {
-			return fmt.Errorf(
-				"problem trying to save %s as %s:%s",
-				me,
-				binaryDst,
-				err)
-		}
-	} else {
-		platformBin := ArtefactorBinaryName + "_" + platform
-		// We need to download the correct binary
-		// TODO: maybe implement a local download cache in users home (with cleanup?)
-		url := fmt.Sprintf(ArtefactorPublishRoot, version.Get().Version) +
-			"/" + platformBin
-		checkSumsUrl := fmt.Sprintf(ArtefactorPublishRoot, version.Get().Version) +
-			"/" + hashcache.DefaultCheckSumFileName
-
-		tmpDir, err := ioutil.TempDir("", "artefactor_downloads")
-		if err != nil {
-			return fmt.Errorf("problem creating temp dir for artefactor downloads: %s", err)
-		}
-
-		defer os.RemoveAll(tmpDir) // clean up
-
-		// download checksums file:
-		checkSumFile := filepath.Join(tmpDir, hashcache.DefaultCheckSumFileName)
-		if err := web.SaveNoCheck(checkSumsUrl, checkSumFile, false); err != nil {
-			return fmt.Errorf(
-				"problem trying to download artefactor checksums from %s",
-				checkSumsUrl)
-		}
-		tmpBinPath := filepath.Join(tmpDir, platformBin)
-		if err := web.SaveNoCheck(url, tmpBinPath, true); err != nil {
-			return fmt.Errorf("problem trying to download artefactor from %s", url)
-		}
-		// Verify the download:
-		binChksum, err := hashcache.GetCachedChecksum(tmpBinPath)
-		if err != nil {
-			return fmt.Errorf(
-				"problem getting checksum for from %s:%s",
-				tmpBinPath,
-				err)
-		}
-		if calcBinChkSum, err := hashcache.CalcChecksum(tmpBinPath); err != nil {
-			if calcBinChkSum != binChksum {
-				return fmt.Errorf(
-					"download %s had unexpected checksum %s, expecting %s (from %s)",
-					url,
-					calcBinChkSum,
-					binChksum,
-					checkSumsUrl)
-			}
-		}
-
-		// Finally move the file to the correct download path:
-		if err := util.Mv(tmpBinPath, binaryDst); err != nil {
-			return fmt.Errorf(
-				"unable to move from %s to %s:%s",
-				tmpBinPath,
-				binaryDst,
-				err)
-		}
-
-		if _, err := c.Update(binaryDst); err != nil {
-			return fmt.Errorf("unable to update hash for %s:%s", binaryDst, err)
+// addFileArtefact will record the meta-data for a web or local file including
+// any mode, owner or restore target specified
+func addFileArtefact(
+	m *manifest.Manifest,
+	fileName string,
+	artefactType string,
+	source string,
+	bin bool,
+	meta map[string]string) error {
+
+	mode := os.FileMode(0644)
+	if bin {
+		mode = 0755
+	}
+	a := m.Add(fileName, artefactType, source, mode)
+	if len(meta[webMetaMode]) > 0 {
+		a.Mode = meta[webMetaMode]
+		if _, _, err := a.FileMode(); err != nil {
+			return err
 		}
-		if err := util.BinMark(c, binaryDst); err != nil {
+	}
+	a.Owner = meta[webMetaOwner]
+	if target := meta[webMetaTarget]; len(target) > 0 {
+		if filepath.IsAbs(target) || outsideRoot(restorePath(m.SaveDir, target)) {
 			return fmt.Errorf(
-				"problem creating meta data file for %s:%s", binaryDst, err)
+				"target %s for %s must be relative to the archive dir and within the repo it's restored to",
+				target,
+				fileName)
 		}
+		a.Target = filepath.Clean(target)
 	}
-	return nil
-}
-
-// copyBin will save binary meta-data for a local binary to the archive dir
-func copyBin(c *hashcache.CheckSumCache, srcBin string, saveDir string) error {
-	savedBin := filepath.Join(saveDir, filepath.Base(srcBin))
-	if err := util.Cp(srcBin, savedBin); err != nil {
+	if err := addExtract(a, meta); err != nil {
 		return err
 	}
-	if _, err := c.Update(savedBin); err != nil {
-		return err
+	if len(a.Extract) > 0 && outsideRoot(restorePath(m.SaveDir, a.Extract)) {
+		return fmt.Errorf(
+			"extract dir %s for %s must be within the repo the archive dir is restored to",
+			a.Extract,
+			fileName)
 	}
-	err := util.BinMark(c, savedBin)
-	return err
+	return nil
 }
 
-// saveSavedPath will record meta-data so files are restored to the same
-// relative path
-func saveSavedPath(c *hashcache.CheckSumCache, saveDir string) error {
-	// Save the archive dir as meta-data file:
-	saveDir = filepath.Clean(saveDir)
-	saveMetaFilePath := filepath.Join(saveDir, SaveDirMetaFile)
-	err := ioutil.WriteFile(
-		saveMetaFilePath,
-		[]byte(saveDir),
-		0644)
-	if err != nil {
-		return err
-	}
-	_, err = c.Update(saveMetaFilePath)
-	return err
+// restorePath will return where a path relative to the archive dir is restored
+// to, relative to the home repo (as restore does, an absolute archive dir is
+// within the home repo)
+func restorePath(saveDir string, path string) string {
+	return filepath.Join(
+		strings.TrimPrefix(filepath.Clean(saveDir), string(filepath.Separator)), path)
 }
 
-// getSavedPath will retrieve the saved path from the meta-data file.
-func getRelativeSavedPath(srcDir string) (string, error) {
-	b, err := ioutil.ReadFile(filepath.Join(srcDir, SaveDirMetaFile))
-	if err != nil {
-		return "", err
+// addExtract will record how to extract an archive on restore
+func addExtract(a *manifest.Artefact, meta map[string]string) error {
+	extract := meta[webMetaExtract]
+	if len(extract) == 0 {
+		if len(meta[webMetaStrip]) > 0 || len(meta[webMetaKeep]) > 0 {
+			return fmt.Errorf(
+				"%s= and %s= for %s require %s=", webMetaStrip, webMetaKeep, a.Name, webMetaExtract)
+		}
+		return nil
+	}
+	if !tar.IsArchive(a.Name) {
+		return fmt.Errorf("can't extract %s, expecting a .tar, .tar.gz, .tgz, .tar.xz or .zip", a.Name)
+	}
+	if filepath.IsAbs(extract) {
+		return fmt.Errorf(
+			"extract dir %s for %s must be relative to the archive dir", extract, a.Name)
+	}
+	a.Extract = filepath.Clean(extract)
+	if strip := meta[webMetaStrip]; len(strip) > 0 {
+		var err error
+		if a.StripComponents, err = strconv.Atoi(strip); err != nil || a.StripComponents < 0 {
+			return fmt.Errorf("invalid %s=%s for %s", webMetaStrip, strip, a.Name)
+		}
+	}
+	if keep := meta[webMetaKeep]; len(keep) > 0 {
+		a.ExtractKeep = strings.Split(keep, ";")
 	}
-	return string(b), nil
+	return tar.Options{StripComponents: a.StripComponents, Keep: a.ExtractKeep}.Validate()
 }
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/crypt"
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/manifest"
+	"gotest.tools/assert"
+)
+
+func TestMarkUnchanged(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_save")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	prevDir := filepath.Join(tmp, "prev")
+	saveDir := filepath.Join(tmp, "downloads")
+	assert.NilError(t, os.MkdirAll(prevDir, 0755))
+	assert.NilError(t, os.MkdirAll(saveDir, 0755))
+
+	since, err := hashcache.NewFromDir(prevDir, false)
+	assert.NilError(t, err)
+	prev := manifest.New(prevDir)
+	assert.NilError(t, since.Add(filepath.Join(prevDir, "app.git.tar"), "aaa"))
+	prev.Add("app.git.tar", manifest.TypeGit, "app", 0644).Commit = "c1"
+	assert.NilError(t, since.Add(filepath.Join(prevDir, "lib.git.tar"), "bbb"))
+	prev.Add("lib.git.tar", manifest.TypeGit, "lib", 0644).Commit = "c2"
+	assert.NilError(t, since.Add(filepath.Join(prevDir, "helm.tgz"), "ccc"))
+	prev.Add("helm.tgz", manifest.TypeWebFile, "https://example.com/helm.tgz", 0644)
+	assert.NilError(t, prev.Save(since))
+	assert.NilError(t, since.Clean())
+
+	c, err := hashcache.NewFromDir(saveDir, false)
+	assert.NilError(t, err)
+	m := manifest.New(saveDir)
+	// the tar is saved again with the same commit
+	assert.NilError(t, c.Add(filepath.Join(saveDir, "app.git.tar"), "ddd"))
+	m.Add("app.git.tar", manifest.TypeGit, "app", 0644).Commit = "c1"
+	assert.NilError(t, c.Add(filepath.Join(saveDir, "lib.git.tar"), "eee"))
+	m.Add("lib.git.tar", manifest.TypeGit, "lib", 0644).Commit = "c3"
+	assert.NilError(t, c.Add(filepath.Join(saveDir, "helm.tgz"), "ccc"))
+	m.Add("helm.tgz", manifest.TypeWebFile, "https://example.com/helm.tgz", 0644)
+
+	shipped, err := markUnchanged(c, m, since)
+	assert.NilError(t, err)
+	assert.Assert(t, m.Get("app.git.tar").Unchanged)
+	assert.Assert(t, !m.Get("lib.git.tar").Unchanged)
+	assert.Assert(t, m.Get("helm.tgz").Unchanged)
+	// unchanged artefacts are verified against the files shipped before
+	assert.DeepEqual(t, shipped, map[string]string{"app.git.tar": "aaa", "helm.tgz": "ccc"})
+}
+
+func TestSaveBundleEncrypted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_save")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	saveDir := filepath.Join(tmp, "downloads")
+	bundleDir := filepath.Join(tmp, "bundle")
+	assert.NilError(t, os.MkdirAll(saveDir, 0755))
+	c, err := hashcache.NewFromDir(saveDir, false)
+	assert.NilError(t, err)
+	m := manifest.New(saveDir)
+	file := filepath.Join(saveDir, "helm.tgz")
+	assert.NilError(t, ioutil.WriteFile(file, []byte("plain"), 0644))
+	_, err = c.Update(file)
+	assert.NilError(t, err)
+	m.Add(file, manifest.TypeWebFile, "https://example.com/helm.tgz", 0644)
+	assert.NilError(t, m.Save(c))
+	assert.NilError(t, c.Clean())
+
+	id, err := crypt.GenerateX25519Identity()
+	assert.NilError(t, err)
+	assert.NilError(t, saveBundle(c, m, bundleDir, nil, false, []crypt.Recipient{id.Recipient()}))
+
+	// only the bundle is encrypted, the archive dir is kept to save again from
+	assert.Assert(t, crypt.IsEncrypted(filepath.Join(bundleDir, "helm.tgz")))
+	b, err := ioutil.ReadFile(file)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "plain")
+	assert.Assert(t, c.IsCachedMatchingFile(file))
+	saved, err := manifest.Load(saveDir)
+	assert.NilError(t, err)
+	assert.Assert(t, !saved.Get("helm.tgz").Encrypted)
+	bundled, err := manifest.Load(bundleDir)
+	assert.NilError(t, err)
+	assert.Assert(t, bundled.Get("helm.tgz").Encrypted)
+}
+
+func TestAddFileArtefactTarget(t *testing.T) {
+	tests := []struct {
+		saveDir string
+		meta    map[string]string
+		valid   bool
+	}{
+		{"downloads", map[string]string{webMetaTarget: "bin/kd"}, true},
+		{"downloads", map[string]string{webMetaTarget: "../secrets/licence.key"}, true},
+		{"./downloads", map[string]string{webMetaTarget: "../../etc/x"}, false},
+		{"downloads", map[string]string{webMetaTarget: "/etc/x"}, false},
+		{"downloads", map[string]string{webMetaTarget: "../.git/hooks/x"}, false},
+		{"downloads", map[string]string{webMetaTarget: ".."}, false},
+		{"/data/downloads", map[string]string{webMetaTarget: "../../x"}, true},
+		{"/data/downloads", map[string]string{webMetaTarget: "../../../x"}, false},
+		{"downloads", map[string]string{webMetaExtract: "../tools"}, true},
+		{"downloads", map[string]string{webMetaExtract: "../../tools"}, false},
+	}
+	for _, test := range tests {
+		m := manifest.New(test.saveDir)
+		err := addFileArtefact(m, "kd.tar.gz", manifest.TypeWebFile, "http://example.com/kd.tar.gz", false, test.meta)
+		if test.valid {
+			assert.NilError(t, err, "%s %v", test.saveDir, test.meta)
+		} else {
+			assert.Assert(t, err != nil, "expecting %s %v to be rejected", test.saveDir, test.meta)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package crypt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+const (
+	// magic is the first line of an age file (https://age-encryption.org/v1)
+	magic string = "age-encryption.org/v1\n"
+
+	tmpSuffix string = ".artefactor-tmp"
+)
+
+var (
+	// ErrNotEncrypted is returned when decrypting a file that isn't encrypted
+	ErrNotEncrypted = errors.New("not an encrypted file")
+	// ErrNoIdentity is returned when none of the identities can decrypt a file
+	ErrNoIdentity = errors.New("no identity matches any of the recipients")
+)
+
+// Recipient can be given the key to decrypt a file
+type Recipient = age.Recipient
+
+// Identity can recover the key to decrypt a file
+type Identity = age.Identity
+
+// Encrypt will encrypt src to dst so any of the recipients can decrypt it. Each
+// file is encrypted with a new key in authenticated chunks so any change or
+// truncation is detected
+func Encrypt(dst io.Writer, src io.Reader, recipients []Recipient) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients to encrypt to")
+	}
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Decrypt will decrypt src to dst with the first identity that matches a
+// recipient. Data is only written once each chunk is authenticated but an error
+// part way through leaves dst incomplete
+func Decrypt(dst io.Writer, src io.Reader, identities []Identity) error {
+	r, err := decrypter(src, identities)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// EncryptFile will replace a file with an encrypted copy (a new file so any
+// hard links to the file are left unencrypted)
+func EncryptFile(file string, recipients []Recipient) error {
+	return transform(file, file, func(dst io.Writer, src io.Reader) error {
+		return Encrypt(dst, src, recipients)
+	})
+}
+
+// DecryptFile will save a decrypted copy of src to dst (only once the whole
+// file has been decrypted)
+func DecryptFile(src string, dst string, identities []Identity) error {
+	return transform(src, dst, func(dst io.Writer, src io.Reader) error {
+		return Decrypt(dst, src, identities)
+	})
+}
+
+// Check will verify one of the identities can decrypt a file (without
+// decrypting it)
+func Check(file string, identities []Identity) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = decrypter(f, identities)
+	return err
+}
+
+// IsEncrypted will detect an encrypted file
+func IsEncrypted(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false
+	}
+	return string(b) == magic
+}
+
+// decrypter will read the header and return a reader of the decrypted content
+func decrypter(src io.Reader, identities []Identity) (io.Reader, error) {
+	br := bufio.NewReader(src)
+	if b, err := br.Peek(len(magic)); err != nil || string(b) != magic {
+		return nil, ErrNotEncrypted
+	}
+	r, err := age.Decrypt(br, identities...)
+	if _, ok := err.(*age.NoIdentityMatchError); ok {
+		return nil, ErrNoIdentity
+	}
+	return r, err
+}
+
+// transform will write dst from src with a temporary file so dst is only
+// replaced on success (and keeps the mode of src)
+func transform(src string, dst string, fn func(io.Writer, io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmpFile := dst + tmpSuffix
+	out, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = fn(w, in)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, dst)
+}
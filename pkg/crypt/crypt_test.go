@@ -0,0 +1,91 @@
+package crypt_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/crypt"
+	"gotest.tools/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	id, err := crypt.GenerateX25519Identity()
+	assert.NilError(t, err)
+	recipient, err := crypt.ParseX25519Recipient(id.Recipient().String())
+	assert.NilError(t, err)
+	passphrase, err := crypt.NewPassphrase("correct horse battery staple")
+	assert.NilError(t, err)
+	// keep the test quick
+	passphrase.SetWorkFactor(10)
+	other, err := crypt.GenerateX25519Identity()
+	assert.NilError(t, err)
+
+	// cover empty, exact and partial chunks
+	for _, size := range []int{0, 10, 64 * 1024, 64*1024*2 + 7} {
+		plain := bytes.Repeat([]byte("a"), size)
+		for _, r := range []crypt.Recipient{recipient, passphrase} {
+			var encrypted bytes.Buffer
+			assert.NilError(t, crypt.Encrypt(&encrypted, bytes.NewReader(plain), []crypt.Recipient{r}))
+
+			for _, ids := range [][]crypt.Identity{{other, id, passphrase}, {passphrase, id}} {
+				var decrypted bytes.Buffer
+				assert.NilError(t, crypt.Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), ids))
+				assert.Assert(t, bytes.Equal(decrypted.Bytes(), plain))
+			}
+			var decrypted bytes.Buffer
+			assert.Equal(t, crypt.Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), []crypt.Identity{other}), crypt.ErrNoIdentity)
+
+			// truncated or changed files must not decrypt
+			b := encrypted.Bytes()
+			assert.Assert(t, crypt.Decrypt(&decrypted, bytes.NewReader(b[:len(b)-1]), []crypt.Identity{id, passphrase}) != nil)
+			changed := append([]byte{}, b...)
+			changed[len(changed)-20] ^= 1
+			assert.Assert(t, crypt.Decrypt(&decrypted, bytes.NewReader(changed), []crypt.Identity{id, passphrase}) != nil)
+		}
+	}
+}
+
+func TestEncryptPassphraseOnly(t *testing.T) {
+	id, err := crypt.GenerateX25519Identity()
+	assert.NilError(t, err)
+	passphrase, err := crypt.NewPassphrase("correct horse battery staple")
+	assert.NilError(t, err)
+	var encrypted bytes.Buffer
+	err = crypt.Encrypt(&encrypted, bytes.NewReader([]byte("plain text\n")), []crypt.Recipient{id.Recipient(), passphrase})
+	assert.Assert(t, err != nil)
+}
+
+func TestReadKeys(t *testing.T) {
+	id, err := crypt.GenerateX25519Identity()
+	assert.NilError(t, err)
+	dir, err := ioutil.TempDir("", "crypt")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	idFile := filepath.Join(dir, "key.txt")
+	assert.NilError(t, ioutil.WriteFile(idFile, []byte("# public key: "+id.Recipient().String()+"\n"+id.String()+"\n"), 0600))
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	assert.NilError(t, ioutil.WriteFile(recipientsFile, []byte("# ops\n"+id.Recipient().String()+"\n"), 0644))
+
+	ids, err := crypt.ReadIdentities(idFile)
+	assert.NilError(t, err)
+	recipients, err := crypt.ReadRecipients(recipientsFile)
+	assert.NilError(t, err)
+	var encrypted, decrypted bytes.Buffer
+	assert.NilError(t, crypt.Encrypt(&encrypted, bytes.NewReader([]byte("plain text\n")), recipients))
+	assert.NilError(t, crypt.Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), ids))
+	assert.Equal(t, decrypted.String(), "plain text\n")
+
+	_, err = crypt.ReadRecipients(idFile)
+	assert.Assert(t, err != nil)
+}
+
+func TestDecryptNotEncrypted(t *testing.T) {
+	id, err := crypt.GenerateX25519Identity()
+	assert.NilError(t, err)
+	var decrypted bytes.Buffer
+	err = crypt.Decrypt(&decrypted, bytes.NewReader([]byte("plain text\n")), []crypt.Identity{id})
+	assert.Equal(t, err, crypt.ErrNotEncrypted)
+}
@@ -0,0 +1,86 @@
+package crypt
+
+import (
+	"fmt"
+	"os"
+
+	"filippo.io/age"
+)
+
+const (
+	// PublicKeyPrefix starts a public key to encrypt to
+	PublicKeyPrefix string = "age1"
+	// SecretKeyPrefix starts a secret key (identity) to decrypt with
+	SecretKeyPrefix string = "AGE-SECRET-KEY-1"
+)
+
+// X25519Recipient is a public key to encrypt to
+type X25519Recipient = age.X25519Recipient
+
+// X25519Identity is a secret key to decrypt with
+type X25519Identity = age.X25519Identity
+
+// Passphrase can encrypt and decrypt files with a shared secret (it can't be
+// used with any other recipients)
+type Passphrase struct {
+	*age.ScryptRecipient
+	*age.ScryptIdentity
+}
+
+// GenerateX25519Identity will create a new secret key
+func GenerateX25519Identity() (*X25519Identity, error) {
+	return age.GenerateX25519Identity()
+}
+
+// ParseX25519Identity will read a secret key e.g. AGE-SECRET-KEY-1...
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	return age.ParseX25519Identity(s)
+}
+
+// ParseX25519Recipient will read a public key e.g. age1...
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	return age.ParseX25519Recipient(s)
+}
+
+// NewPassphrase creates a recipient and identity from a passphrase
+func NewPassphrase(passphrase string) (*Passphrase, error) {
+	r, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	i, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &Passphrase{ScryptRecipient: r, ScryptIdentity: i}, nil
+}
+
+// ReadIdentities will read the secret keys from a file (one per line, with #
+// comments)
+func ReadIdentities(file string) ([]Identity, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identities in %s:%s", file, err)
+	}
+	return ids, nil
+}
+
+// ReadRecipients will read the public keys from a file (one per line, with #
+// comments)
+func ReadRecipients(file string) ([]Recipient, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recipients, err := age.ParseRecipients(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipients in %s:%s", file, err)
+	}
+	return recipients, nil
+}
@@ -202,6 +202,17 @@ func GetNewImageName(image string, registry string) string {
 	return image
 }
 
+// GetPublishedName will return the name and tag an image is pushed as when
+// published to a registry
+func GetPublishedName(image string, registry string) string {
+	fullImgName := StripRepoDigest(image)
+	tag := GetImageTag(fullImgName)
+	if tag == "" {
+		tag = "repoDigest-" + GetRepoDigest(image)
+	}
+	return GetNewImageName(StripImageTag(fullImgName), registry) + ":" + tag
+}
+
 func GetImageTag(image string) string {
 	simage := strings.Split(image, "/")
 	// colons can exist in registry names
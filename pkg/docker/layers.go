@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	artefactortar "github.com/appvia/artefactor/pkg/tar"
+)
+
+// archiveImage is an image listed in the manifest of a saved image archive
+type archiveImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// imageConfig is the part of an image config with the layers
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// GetArchiveLayers will return the layer IDs (diff IDs) of a saved image in
+// order
+func GetArchiveLayers(archiveFile string) ([]string, error) {
+	image, err := readArchiveImage(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	files, err := artefactortar.ReadFiles(archiveFile, func(name string) bool {
+		return name == image.Config
+	})
+	if err != nil {
+		return nil, err
+	}
+	var config imageConfig
+	if err := json.Unmarshal(files[image.Config], &config); err != nil {
+		return nil, fmt.Errorf("invalid image config %s in %s:%s", image.Config, archiveFile, err)
+	}
+	return config.RootFS.DiffIDs, nil
+}
+
+// SharedLayers will return how many layers at the start of an image are the
+// same as in another image (layers are only re-used in order)
+func SharedLayers(layers []string, otherLayers []string) int {
+	count := 0
+	for count < len(layers) && count < len(otherLayers) && layers[count] == otherLayers[count] {
+		count++
+	}
+	return count
+}
+
+// StripLayers will remove the first count layers from a saved image. The image
+// can only be loaded where those layers already exist (e.g. after pulling an
+// image with the same layers)
+func StripLayers(archiveFile string, count int) error {
+	image, err := readArchiveImage(archiveFile)
+	if err != nil {
+		return err
+	}
+	if count > len(image.Layers) {
+		return fmt.Errorf("can't remove %d layers from %s with %d layers", count, archiveFile, len(image.Layers))
+	}
+	omit := make(map[string]bool)
+	for _, layer := range image.Layers[:count] {
+		omit[layer] = true
+	}
+	// the same layer file can be used again later on
+	for _, layer := range image.Layers[count:] {
+		delete(omit, layer)
+	}
+
+	tmpFile := archiveFile + ".tmp"
+	if err := copyTar(archiveFile, tmpFile, omit); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("problem removing layers from %s:%s", archiveFile, err)
+	}
+	return os.Rename(tmpFile, archiveFile)
+}
+
+// readArchiveImage will read the manifest of a saved image
+func readArchiveImage(archiveFile string) (*archiveImage, error) {
+	files, err := artefactortar.ReadFiles(archiveFile, func(name string) bool {
+		return name == archiveManifest
+	})
+	if err != nil {
+		return nil, err
+	}
+	var images []archiveImage
+	if err := json.Unmarshal(files[archiveManifest], &images); err != nil || len(images) == 0 {
+		return nil, fmt.Errorf("no image manifest found in %s", archiveFile)
+	}
+	return &images[0], nil
+}
+
+// copyTar will copy all the files in a tar except those to omit
+func copyTar(src string, dst string, omit map[string]bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if omit[header.Name] {
+			log.Printf("leaving out layer %s from %s", header.Name, src)
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
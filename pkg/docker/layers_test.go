@@ -0,0 +1,109 @@
+package docker_test
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/cache"
+	"github.com/appvia/artefactor/pkg/docker"
+	artefactortar "github.com/appvia/artefactor/pkg/tar"
+	"gotest.tools/assert"
+)
+
+// writeImageTar saves a minimal image archive with three layers
+func writeImageTar(t *testing.T, file string) {
+	files := []struct {
+		Name, Body string
+	}{
+		{"manifest.json", `[{"Config":"abc.json","RepoTags":["alpine:3"],"Layers":["l1/layer.tar","l2/layer.tar","l3/layer.tar"]}]`},
+		{"abc.json", `{"rootfs":{"type":"layers","diff_ids":["sha256:1","sha256:2","sha256:3"]}}`},
+		{"l1/layer.tar", "layer one"},
+		{"l2/layer.tar", "layer two"},
+		{"l3/layer.tar", "layer three"},
+	}
+	f, err := os.Create(file)
+	assert.NilError(t, err)
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, file := range files {
+		assert.NilError(t, tw.WriteHeader(&tar.Header{
+			Name: file.Name,
+			Mode: 0644,
+			Size: int64(len(file.Body)),
+		}))
+		_, err := tw.Write([]byte(file.Body))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tw.Close())
+}
+
+func TestStripLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artefactor_layers")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alpine~~3.docker.tar")
+	writeImageTar(t, file)
+
+	layers, err := docker.GetArchiveLayers(file)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, layers, []string{"sha256:1", "sha256:2", "sha256:3"})
+	assert.Equal(t, docker.SharedLayers(layers, []string{"sha256:1", "sha256:2", "sha256:4"}), 2)
+	assert.Equal(t, docker.SharedLayers(layers, []string{"sha256:2"}), 0)
+
+	assert.NilError(t, docker.StripLayers(file, 2))
+	files, err := artefactortar.ReadFiles(file, func(name string) bool { return true })
+	assert.NilError(t, err)
+	_, ok := files["l1/layer.tar"]
+	assert.Assert(t, !ok)
+	_, ok = files["l2/layer.tar"]
+	assert.Assert(t, !ok)
+	assert.Equal(t, string(files["l3/layer.tar"]), "layer three")
+	// the image can still be described after layers are left out
+	layers, err = docker.GetArchiveLayers(file)
+	assert.NilError(t, err)
+	assert.Equal(t, len(layers), 3)
+}
+
+func TestVerifyArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_docker")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	archiveFile := filepath.Join(tmp, "alpine.docker.tar")
+	writeImageTar(t, archiveFile)
+
+	assert.NilError(t, docker.VerifyArchive(archiveFile, ""))
+	assert.NilError(t, docker.VerifyArchive(archiveFile, "sha256:abc"))
+	assert.Assert(t, docker.VerifyArchive(archiveFile, "sha256:def") != nil)
+
+	// a damaged archive
+	assert.NilError(t, ioutil.WriteFile(archiveFile, []byte("not a tar"), 0644))
+	assert.Assert(t, docker.VerifyArchive(archiveFile, "") != nil)
+}
+
+func TestVerifyCachedArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_docker")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	uc, err := cache.New(filepath.Join(tmp, "cache"))
+	assert.NilError(t, err)
+	archiveFile := filepath.Join(tmp, "alpine.docker.tar")
+	writeImageTar(t, archiveFile)
+	key := cache.ImageKey("sha256:ccc", "linux_amd64", archiveFile)
+	assert.NilError(t, uc.Put(key, archiveFile))
+
+	// without the image ID recorded it's a cache miss
+	assert.Assert(t, docker.VerifyCachedArchive(uc, key, archiveFile, "") != nil)
+
+	assert.NilError(t, uc.PutMeta(key, "sha256:abc"))
+	// docker doesn't have the image so the ID recorded is used
+	assert.NilError(t, docker.VerifyCachedArchive(uc, key, archiveFile, ""))
+	assert.NilError(t, docker.VerifyCachedArchive(uc, key, archiveFile, "sha256:abc"))
+	assert.Assert(t, docker.VerifyCachedArchive(uc, key, archiveFile, "sha256:def") != nil)
+
+	// the archive isn't the image recorded
+	assert.NilError(t, uc.PutMeta(key, "sha256:def"))
+	assert.Assert(t, docker.VerifyCachedArchive(uc, key, archiveFile, "") != nil)
+}
@@ -6,13 +6,20 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/appvia/artefactor/pkg/cache"
 	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/tar"
 	"github.com/appvia/artefactor/pkg/util"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 )
 
+// archiveManifest lists the images in a saved image archive
+const archiveManifest string = "manifest.json"
+
 type SaveEvent struct {
 	Status         string `json:"status"`
 	Error          string `json:"error"`
@@ -24,8 +31,8 @@ type SaveEvent struct {
 	Id string `json:"id"`
 }
 
-// Save will save a docker image
-func Save(c *hashcache.CheckSumCache, image string, dir string, creds *util.Creds) error {
+// Save will save a docker image (from the user cache if uc isn't nil)
+func Save(c *hashcache.CheckSumCache, image string, dir string, creds *util.Creds, uc *cache.Cache) error {
 
 	archiveFile, err := ImageToFilePath(image, dir)
 	if err != nil {
@@ -42,7 +49,197 @@ func Save(c *hashcache.CheckSumCache, image string, dir string, creds *util.Cred
 			return nil
 		}
 	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
 
+	key := ""
+	if uc != nil {
+		if digest, platform, err := getCacheDigest(image, creds); err != nil {
+			fmt.Printf("not using cache for %s, %s\n", image, err)
+		} else {
+			key = cache.ImageKey(digest, platform, archiveFile)
+			if ok, err := uc.Get(key, archiveFile); err != nil {
+				return err
+			} else if ok {
+				// the cached archive could be damaged or saved from another image
+				err := VerifyCachedArchive(uc, key, archiveFile, localImageID(image, digest))
+				if err == nil {
+					_, err = c.Update(archiveFile)
+					return err
+				}
+				fmt.Printf("removing %s from cache:%s\n", archiveFile, err)
+				if err := uc.Remove(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := Pull(image, creds); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return (err)
+	}
+	ior, err := cli.ImageSave(ctx, []string{image})
+	if err != nil {
+		return err
+	}
+	defer ior.Close()
+	fmt.Printf("Saving to archive:%+v\n", archiveFile)
+	// save to a tmp file so a cached file linked to the archive isn't changed
+	tmpFile := archiveFile + ".tmp"
+	outFile, err := os.Create(tmpFile)
+	// handle err
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(outFile, ior)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, archiveFile); err != nil {
+		return err
+	}
+	// Update the cache with checksum
+	if _, err = c.Update(archiveFile); err != nil {
+		return err
+	}
+	if len(key) > 0 {
+		if err := putCachedArchive(uc, key, archiveFile); err != nil {
+			fmt.Printf("unable to add %q to cache:%s\n", archiveFile, err)
+		}
+	}
+	return nil
+}
+
+// putCachedArchive will add a saved image to the cache with its image ID (to
+// verify it when docker no longer has the image)
+func putCachedArchive(uc *cache.Cache, key string, archiveFile string) error {
+	id, err := GetArchiveImageID(archiveFile)
+	if err != nil {
+		return err
+	}
+	// replace anything cached before without an image ID
+	if err := uc.Remove(key); err != nil {
+		return err
+	}
+	if err := uc.Put(key, archiveFile); err != nil {
+		return err
+	}
+	return uc.PutMeta(key, id)
+}
+
+// VerifyCachedArchive will check a saved image from the cache is the image ID
+// docker pulled for the digest (or the image ID recorded when it was cached)
+func VerifyCachedArchive(uc *cache.Cache, key string, archiveFile string, imageID string) error {
+	cachedID := uc.GetMeta(key)
+	if len(cachedID) == 0 {
+		return fmt.Errorf("no image ID recorded for %s", key)
+	}
+	if len(imageID) > 0 && imageID != cachedID {
+		return fmt.Errorf("expecting image %s but %s was cached", imageID, cachedID)
+	}
+	return VerifyArchive(archiveFile, cachedID)
+}
+
+// GetDistributionDigest will get the digest of an image from its registry (or
+// the image name if pinned to a digest)
+func GetDistributionDigest(image string, creds *util.Creds) (string, error) {
+	if digest := GetRepoDigest(image); len(digest) > 0 {
+		return "sha256:" + digest, nil
+	}
+	auth, err := getRegistryAuth(image, creds)
+	if err != nil {
+		return "", err
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", err
+	}
+	inspect, err := cli.DistributionInspect(context.Background(), image, auth)
+	if err != nil {
+		return "", err
+	}
+	return string(inspect.Descriptor.Digest), nil
+}
+
+// getCacheDigest will get the registry digest of an image and the platform it
+// is pulled for (a digest can be for a list of images for each platform)
+func getCacheDigest(image string, creds *util.Creds) (string, string, error) {
+	digest, err := GetDistributionDigest(image, creds)
+	if err != nil {
+		return "", "", fmt.Errorf("can't get the image digest:%s", err)
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", "", err
+	}
+	v, err := cli.ServerVersion(context.Background())
+	if err != nil {
+		return "", "", fmt.Errorf("can't get the docker platform:%s", err)
+	}
+	return digest, v.Os + "_" + v.Arch, nil
+}
+
+// localImageID will get the ID of an image pulled from a registry digest (empty
+// if docker doesn't have it)
+func localImageID(image string, digest string) string {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return ""
+	}
+	ii, _, err := cli.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return ""
+	}
+	for _, repoDigest := range ii.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return ii.ID
+		}
+	}
+	return ""
+}
+
+// VerifyArchive will check a saved image can be read and is the image ID
+// expected (if not empty)
+func VerifyArchive(archiveFile string, imageID string) error {
+	id, err := GetArchiveImageID(archiveFile)
+	if err != nil {
+		return err
+	}
+	if len(imageID) > 0 && id != imageID {
+		return fmt.Errorf("expecting image %s but %s has %s", imageID, archiveFile, id)
+	}
+	return nil
+}
+
+// getRegistryAuth will get the encoded auth for an image from the creds or the
+// docker config
+func getRegistryAuth(image string, creds *util.Creds) (string, error) {
+	if creds == nil {
+		return GetAuth(image), nil
+	}
+	auth, err := GetAuthString(image, creds.Username, creds.Password)
+	if err != nil {
+		return "", fmt.Errorf("error with credentials provided:%s", err)
+	}
+	return auth, nil
+}
+
+// Pull will pull a docker image
+func Pull(image string, creds *util.Creds) error {
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -51,15 +248,8 @@ func Save(c *hashcache.CheckSumCache, image string, dir string, creds *util.Cred
 
 	// Load auth details from .docker config
 	var ipo types.ImagePullOptions
-	if creds != nil {
-		if auth, err := GetAuthString(
-			image, creds.Username, creds.Password); err != nil {
-			return fmt.Errorf("error with credentials provided:%s", err)
-		} else {
-			ipo.RegistryAuth = auth
-		}
-	} else {
-		ipo.RegistryAuth = GetAuth(image)
+	if ipo.RegistryAuth, err = getRegistryAuth(image, creds); err != nil {
+		return err
 	}
 
 	events, err := cli.ImagePull(ctx, image, ipo)
@@ -84,29 +274,25 @@ func Save(c *hashcache.CheckSumCache, image string, dir string, creds *util.Cred
 		}
 		lastStatus = event.Status
 	}
-	ior, err := cli.ImageSave(ctx, []string{image})
+	return nil
+}
+
+// GetArchiveImageID will return the image ID (the digest of the image config)
+// from a saved image without loading it
+func GetArchiveImageID(archiveFile string) (string, error) {
+	files, err := tar.ReadFiles(archiveFile, func(name string) bool {
+		return name == archiveManifest
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0744); err != nil {
-			return err
-		}
-	} else if err != nil {
-		return err
-	}
-	fmt.Printf("Saving to archive:%+v\n", archiveFile)
-	outFile, err := os.Create(archiveFile)
-	// handle err
-	if err != nil {
-		return err
+	var manifest []struct {
+		Config string `json:"Config"`
 	}
-	defer outFile.Close()
-	_, err = io.Copy(outFile, ior)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(files[archiveManifest], &manifest); err != nil || len(manifest) == 0 {
+		return "", fmt.Errorf("no image manifest found in %s", archiveFile)
 	}
-	// Update the cache with checksum
-	_, err = c.Update(archiveFile)
-	return err
+	// The config is named after its digest e.g. <sha>.json or blobs/sha256/<sha>
+	id := strings.TrimSuffix(filepath.Base(manifest[0].Config), ".json")
+	return "sha256:" + id, nil
 }
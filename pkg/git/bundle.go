@@ -0,0 +1,238 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+)
+
+const (
+	// bundleHeadRef is the ref name recorded for HEAD in a bundle
+	bundleHeadRef string = "HEAD"
+)
+
+// archiveBundle will create a git bundle (packfile and refs) from a repo and
+// record the refs bundled as the base for any later incremental bundle
+func archiveBundle(
+	c *hashcache.CheckSumCache,
+	repoPath string,
+	ref string,
+	keepRefs []string,
+	bundleFileName string,
+	baseFileName string,
+	incremental bool) error {
+
+	refs := []string{bundleHeadRef}
+	if len(ref) == 0 && len(keepRefs) > 0 {
+		// Only bundle the refs requested
+		gitDir := filepath.Join(repoPath, ".git")
+		kept, err := getRefs(gitDir, keepRefs, false)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, kept...)
+		excluded, err := getRefs(gitDir, keepRefs, true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Refs not bundled from %s:\n", repoPath)
+		for _, excludedRef := range excluded {
+			fmt.Printf("  %s\n", excludedRef)
+		}
+	} else if len(ref) == 0 {
+		refs = append(refs, "--branches", "--tags")
+	} else {
+		// Only bundle what was checked out for the ref
+		if branch, err := gitOutput(repoPath, "symbolic-ref", "--quiet", "HEAD"); err == nil {
+			refs = append(refs, branch)
+		}
+		if err := runGit(repoPath, "show-ref", "--verify", "--quiet", "refs/tags/"+ref); err == nil {
+			refs = append(refs, "refs/tags/"+ref)
+		}
+	}
+	// Only add commits not already sent with the last bundle
+	var bases []string
+	if incremental {
+		var err error
+		if bases, err = readBase(baseFileName); err != nil {
+			return err
+		}
+		if len(bases) == 0 {
+			fmt.Printf("No base found (%s), creating a complete bundle\n", baseFileName)
+		}
+	}
+	revs := refs
+	if len(bases) > 0 {
+		revs = append(append(revs, "--not"), bases...)
+		count, err := gitOutput(repoPath, append([]string{"rev-list", "--count"}, revs...)...)
+		if err != nil {
+			return fmt.Errorf("problem checking for new commits in %s:%s", repoPath, err)
+		}
+		if count == "0" {
+			fmt.Printf("No new commits since the last bundle %s\n", bundleFileName)
+			if _, err := os.Stat(bundleFileName); err == nil {
+				// Nothing has changed so ship the last bundle again
+				c.Keep(bundleFileName)
+				c.Keep(baseFileName)
+				return nil
+			}
+			return fmt.Errorf(
+				"no new commits since base %s and no previous bundle %s to keep",
+				baseFileName,
+				bundleFileName)
+		}
+	}
+	absBundleFileName, err := filepath.Abs(bundleFileName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Creating git bundle %s\n", bundleFileName)
+	if err := runGit(
+		repoPath,
+		append([]string{"bundle", "create", absBundleFileName}, revs...)...); err != nil {
+		return fmt.Errorf("problem creating bundle %s:%s", bundleFileName, err)
+	}
+	if _, err := c.Update(bundleFileName); err != nil {
+		return err
+	}
+
+	// Record what was bundled as the base for the next incremental bundle
+	heads, err := gitOutput(repoPath, "bundle", "list-heads", absBundleFileName)
+	if err != nil {
+		return fmt.Errorf("problem listing refs in bundle %s:%s", bundleFileName, err)
+	}
+	if err := ioutil.WriteFile(baseFileName, []byte(heads+"\n"), 0644); err != nil {
+		return fmt.Errorf("problem saving base file %s:%s", baseFileName, err)
+	}
+	_, err = c.Update(baseFileName)
+	return err
+}
+
+// readBase will return the commits recorded in a base file (if present)
+func readBase(baseFileName string) ([]string, error) {
+	b, err := ioutil.ReadFile(baseFileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem reading base file %s:%s", baseFileName, err)
+	}
+	var bases []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !contains(bases, fields[0]) {
+			bases = append(bases, fields[0])
+		}
+	}
+	return bases, nil
+}
+
+// restoreBundle will clone a bundle or fetch it into an existing repo
+func restoreBundle(bundleFile string, repoPath string) error {
+	absBundleFile, err := filepath.Abs(bundleFile)
+	if err != nil {
+		return err
+	}
+	if repoPath, err = filepath.Abs(repoPath); err != nil {
+		return err
+	}
+	prerequisites, heads, err := readBundleHeader(bundleFile)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		if len(prerequisites) > 0 {
+			return fmt.Errorf(
+				"%s is an incremental bundle and needs an existing repo at %s",
+				bundleFile,
+				repoPath)
+		}
+		log.Printf("%s doesn't exist, cloning from bundle %s", repoPath, bundleFile)
+		if err := runGit(
+			filepath.Dir(repoPath),
+			"clone", "--quiet", absBundleFile, repoPath); err != nil {
+			return fmt.Errorf("problem cloning bundle to %s:%s", repoPath, err)
+		}
+		// The bundle path is no use as a remote
+		return runGit(repoPath, "remote", "remove", "origin")
+	}
+
+	log.Printf("%s exists, fetching from bundle %s", repoPath, bundleFile)
+	if err := runGit(repoPath, "bundle", "verify", absBundleFile); err != nil {
+		return fmt.Errorf(
+			"bundle %s can't be applied to %s:%s",
+			bundleFile,
+			repoPath,
+			err)
+	}
+	// Update branches and tags (refusing non fast-forward updates)
+	if err := fastForward(repoPath, absBundleFile); err != nil {
+		return err
+	}
+	// Stay on the checked out branch if it was bundled, otherwise checkout the
+	// bundle HEAD
+	branch, _ := gitOutput(repoPath, "symbolic-ref", "--quiet", "HEAD")
+	sha, bundledHead := heads[bundleHeadRef]
+	if _, bundledBranch := heads[branch]; bundledBranch || !bundledHead {
+		return nil
+	}
+	checkout := []string{"checkout", "--quiet", "--detach", sha}
+	for name, headSha := range heads {
+		if headSha == sha && strings.HasPrefix(name, "refs/heads/") {
+			checkout = []string{"checkout", "--quiet", strings.TrimPrefix(name, "refs/heads/")}
+			break
+		}
+	}
+	if err := runGit(repoPath, checkout...); err != nil {
+		return fmt.Errorf("problem checking out bundle HEAD in %s:%s", repoPath, err)
+	}
+	return nil
+}
+
+// readBundleHeader will return the prerequisite commits and refs in a bundle
+func readBundleHeader(bundleFile string) ([]string, map[string]string, error) {
+	f, err := os.Open(bundleFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	signature, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(signature, "# v2 git bundle") {
+		return nil, nil, fmt.Errorf("%s is not a supported git bundle", bundleFile)
+	}
+	var prerequisites []string
+	heads := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bundle header in %s:%s", bundleFile, err)
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			// the end of the header
+			return prerequisites, heads, nil
+		}
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "-") {
+			prerequisites = append(prerequisites, strings.TrimPrefix(fields[0], "-"))
+		} else if len(fields) > 1 {
+			heads[fields[1]] = fields[0]
+		}
+	}
+}
+
+func contains(ary []string, item string) bool {
+	for _, s := range ary {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+)
+
+func TestBundleIncrementalRestore(t *testing.T) {
+	srcPath := newTestRepo(t, map[string]string{"README.md": "v1"})
+	defer os.RemoveAll(srcPath)
+	tmp, err := ioutil.TempDir("", "artefactor_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	saveDir := filepath.Join(tmp, "downloads")
+	if err := os.MkdirAll(saveDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := hashcache.NewFromDir(saveDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundleFile := filepath.Join(saveDir, "repo"+GitBundleExt)
+	baseFile := filepath.Join(saveDir, "repo"+GitBaseExt)
+	repoPath := filepath.Join(tmp, "restored", "repo")
+	if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a base the bundle is complete
+	if err := archiveBundle(c, srcPath, "", nil, bundleFile, baseFile, true); err != nil {
+		t.Fatal(err)
+	}
+	prerequisites, _, err := readBundleHeader(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prerequisites) != 0 {
+		t.Errorf("Expecting a complete bundle but got prerequisites %v", prerequisites)
+	}
+	bases, err := readBase(baseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSha := mustGit(t, srcPath, "rev-parse", "HEAD")
+	if !contains(bases, firstSha) {
+		t.Errorf("Expecting %s in base %v", firstSha, bases)
+	}
+	if err := restoreBundle(bundleFile, repoPath); err != nil {
+		t.Fatal(err)
+	}
+	if sha := mustGit(t, repoPath, "rev-parse", "HEAD"); sha != firstSha {
+		t.Errorf("Expecting HEAD %s but got %s", firstSha, sha)
+	}
+
+	// the next bundle only has the commits since the base
+	commitFiles(t, srcPath, map[string]string{"README.md": "v2"})
+	secondSha := mustGit(t, srcPath, "rev-parse", "HEAD")
+	if err := archiveBundle(c, srcPath, "", nil, bundleFile, baseFile, true); err != nil {
+		t.Fatal(err)
+	}
+	prerequisites, _, err = readBundleHeader(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(prerequisites, firstSha) {
+		t.Errorf("Expecting an incremental bundle needing %s but got %v", firstSha, prerequisites)
+	}
+	if err := restoreBundle(bundleFile, filepath.Join(tmp, "restored", "new")); err == nil {
+		t.Errorf("Expecting an incremental bundle to need an existing repo")
+	}
+	if err := restoreBundle(bundleFile, repoPath); err != nil {
+		t.Fatal(err)
+	}
+	if sha := mustGit(t, repoPath, "rev-parse", "HEAD"); sha != secondSha {
+		t.Errorf("Expecting HEAD %s but got %s", secondSha, sha)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(repoPath, "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "v2" {
+		t.Errorf("Expecting the working tree to be fast-forwarded but got %q", b)
+	}
+}
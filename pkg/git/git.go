@@ -3,6 +3,7 @@ package git
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,76 +11,192 @@ import (
 
 	"github.com/appvia/artefactor/pkg/hashcache"
 	"github.com/appvia/artefactor/pkg/tar"
+	"github.com/appvia/artefactor/pkg/util"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 const (
-	GitFileExt     string = ".git.tar"
-	GitFileHomeExt string = ".git.home.tar"
+	GitFileExt       string = ".git.tar"
+	GitFileHomeExt   string = ".git.home.tar"
+	GitBundleExt     string = ".git.bundle"
+	GitBundleHomeExt string = ".git.home.bundle"
+	// GitBaseExt records the refs of the last bundle for incremental saves
+	GitBaseExt string = ".git.base"
+	// FormatTar archives the working tree and the complete .git directory
+	FormatTar string = "tar"
+	// FormatBundle archives the commits and refs only (see git bundle)
+	FormatBundle string = "bundle"
 )
 
-// Archive will create a git archive from a local path
-func Archive(c *hashcache.CheckSumCache, repoPath string, saveDir string) error {
+// ArchiveOptions specifies how a git repo is archived
+type ArchiveOptions struct {
+	// Format is one of FormatTar or FormatBundle
+	Format string
+	// Incremental will only bundle commits after the base from the last save
+	Incremental bool
+	// Sanitize will remove local only meta-data when set
+	Sanitize *SanitizeOptions
+}
+
+// Archive will create a git archive from a local path and return the files
+// saved. The path can specify a branch, tag or commit to archive with the
+// syntax path@ref
+func Archive(
+	c *hashcache.CheckSumCache,
+	repoSpec string,
+	saveDir string,
+	opts ArchiveOptions) ([]string, error) {
 	// TODO: add if local path ! exist try and clone first...
 
-	fmt.Printf("Archiving git repo %s\n", repoPath)
+	repoPath, ref := SplitRef(repoSpec)
+	fmt.Printf("Archiving git repo %s\n", repoSpec)
 
 	// Open the current git repo path
 	r, err := git.PlainOpen(repoPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Check if clean
-	w, err := r.Worktree()
+	absRepoPath, err := filepath.Abs(repoPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	status, err := w.Status()
-	if err != nil {
-		return err
+	repoName := getRepoName(r, filepath.Base(absRepoPath))
+
+	// The files to archive will come from this path
+	srcPath := repoPath
+	if len(ref) > 0 {
+		// Archive the ref from a temporary checkout, the working tree of the
+		// repo being archived is never changed
+		tmpDir, err := ioutil.TempDir("", "artefactor_git")
+		if err != nil {
+			return nil, fmt.Errorf("problem creating temp dir for git checkout: %s", err)
+		}
+		defer os.RemoveAll(tmpDir) // clean up
+
+		srcPath = filepath.Join(tmpDir, repoName)
+		if err := checkoutRef(r, absRepoPath, ref, srcPath); err != nil {
+			return nil, err
+		}
+		if r, err = git.PlainOpen(srcPath); err != nil {
+			return nil, err
+		}
+	} else {
+		// Check if clean
+		w, err := r.Worktree()
+		if err != nil {
+			return nil, err
+		}
+		status, err := w.Status()
+		if err != nil {
+			return nil, err
+		}
+		if !status.IsClean() {
+			// Not a clean repo, deal with it...
+			return nil, errors.New(fmt.Sprintf("Not backing up git directory %v- not clean:\n%s", repoPath, status))
+		}
 	}
-	if !status.IsClean() {
-		// Not a clean repo, deal with it...
-		return errors.New(fmt.Sprintf("Not backing up git directory %v- not clean:\n%s", repoPath, status))
+
+	submodules, err := getSubmodules(srcPath)
+	if err != nil {
+		return nil, err
 	}
 
-	repoName := getRepoName(r, filepath.Dir(repoPath))
-	tarFileName := ""
 	// The repo should be named appropriatly so we can use it as a home on restore
-	if isHome(repoPath) {
+	home := isHome(repoPath)
+	if opts.Format == FormatBundle {
+		// Bundles only have the commits from this repo
+		lfs, err := usesLFS(srcPath, []string{".gitattributes"})
+		if err != nil {
+			return nil, err
+		}
+		if len(submodules) > 0 || lfs {
+			return nil, fmt.Errorf(
+				"repo %s has submodules or Git LFS files, use the %s format",
+				repoSpec,
+				FormatTar)
+		}
+		bundleFileName := fmt.Sprintf("%s/%s%s", saveDir, repoName, GitBundleExt)
+		if home {
+			bundleFileName = fmt.Sprintf("%s/%s%s", saveDir, repoName, GitBundleHomeExt)
+		}
+		baseFileName := fmt.Sprintf("%s/%s%s", saveDir, repoName, GitBaseExt)
+		var keepRefs []string
+		if opts.Sanitize != nil {
+			keepRefs = opts.Sanitize.KeepRefs
+		}
+		if err := archiveBundle(
+			c, srcPath, ref, keepRefs, bundleFileName, baseFileName, opts.Incremental); err != nil {
+			return nil, err
+		}
+		return []string{bundleFileName, baseFileName}, nil
+	}
+	tarFileName := fmt.Sprintf("%s/%s%s", saveDir, repoName, GitFileExt)
+	if home {
 		tarFileName = fmt.Sprintf("%s/%s%s", saveDir, repoName, GitFileHomeExt)
-	} else {
-		tarFileName = fmt.Sprintf("%s/%s%s", saveDir, repoName, GitFileExt)
 	}
 	// Now archive this repo...
 	// Get the HEAD ref
-	ref, err := r.Head()
+	head, err := r.Head()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// ... retrieving the commit object
-	commit, err := r.CommitObject(ref.Hash())
+	commit, err := r.CommitObject(head.Hash())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// ... retrieve the tree from the commit
 	tree, err := commit.Tree()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// get all the files that need archiving from the repo meta-data
 	var archiveFiles []string
-	tree.Files().ForEach(func(f *object.File) error {
-		archiveFiles = append(archiveFiles, f.Name)
-		return nil
-	})
+	if len(submodules) > 0 {
+		// include the files from submodules (recursively)
+		if archiveFiles, err = getSubmoduleFiles(srcPath, submodules); err != nil {
+			return nil, err
+		}
+	} else {
+		tree.Files().ForEach(func(f *object.File) error {
+			archiveFiles = append(archiveFiles, f.Name)
+			return nil
+		})
+	}
+	// LFS objects are kept under .git so make sure they're all present
+	if lfs, err := usesLFS(srcPath, archiveFiles); err != nil {
+		return nil, err
+	} else if lfs && len(ref) == 0 {
+		if err := fetchLFS(srcPath, submodules); err != nil {
+			return nil, err
+		}
+	}
 	// now add the meta-data files themselves (for a functioning git repo with no
 	// extra files from .gitignore etc.)
-	gitMetaFolder := filepath.Join(repoPath, ".git")
-	filepath.Walk(
+	gitPath := srcPath
+	if opts.Sanitize != nil {
+		if len(ref) == 0 {
+			// Never change the repo being archived, sanitize a copy
+			tmpDir, err := ioutil.TempDir("", "artefactor_git")
+			if err != nil {
+				return nil, fmt.Errorf("problem creating temp dir for git meta-data: %s", err)
+			}
+			defer os.RemoveAll(tmpDir) // clean up
+			if gitPath, err = stageGitDir(absRepoPath, tmpDir); err != nil {
+				return nil, err
+			}
+		}
+		report, err := sanitizeGitDir(filepath.Join(gitPath, ".git"), opts.Sanitize)
+		if err != nil {
+			return nil, fmt.Errorf("problem sanitizing git meta-data for %s:%s", repoSpec, err)
+		}
+		printReport(repoSpec, report)
+	}
+	var gitFiles []string
+	gitMetaFolder := filepath.Join(gitPath, ".git")
+	err = filepath.Walk(
 		gitMetaFolder,
 		func(path string, fi os.FileInfo, err error) error {
 
@@ -87,18 +204,96 @@ func Archive(c *hashcache.CheckSumCache, repoPath string, saveDir string) error
 				fmt.Printf("access denied accessing a path %q: %v\n", path, err)
 				return err
 			}
-			archiveFiles = append(archiveFiles, path)
+			relPath, err := filepath.Rel(gitPath, path)
+			if err != nil {
+				return err
+			}
+			gitFiles = append(gitFiles, relPath)
 			return nil
 		})
+	if err != nil {
+		return nil, err
+	}
 
-	// Now add the complete set of files to archive:
-	if err := tar.Create(tarFileName, archiveFiles); err != nil {
-		return err
+	// Now add the complete set of files to archive (named after the repo so
+	// it can be found on restore):
+	if err := tar.CreateFromDirs(
+		tarFileName,
+		repoName,
+		tar.Files{Dir: srcPath, Paths: archiveFiles},
+		tar.Files{Dir: gitPath, Paths: gitFiles}); err != nil {
+		return nil, err
 	}
 
 	// Lastly update the checksums
-	_, err = c.Update(tarFileName)
-	return err
+	if _, err = c.Update(tarFileName); err != nil {
+		return nil, err
+	}
+	return []string{tarFileName}, nil
+}
+
+// SplitRef will return the path and any ref (branch, tag or commit) from a
+// repo specified as path@ref
+func SplitRef(repoSpec string) (repoPath string, ref string) {
+	i := strings.LastIndex(repoSpec, "@")
+	if i < 1 {
+		return repoSpec, ""
+	}
+	return repoSpec[:i], repoSpec[i+1:]
+}
+
+// checkoutRef will clone a repo to dst and checkout the ref requested
+func checkoutRef(r *git.Repository, repoPath string, ref string, dst string) error {
+	log.Printf("checking out %s from %s to %s", ref, repoPath, dst)
+	if err := runGit(
+		filepath.Dir(dst),
+		"clone", "--quiet", "--no-checkout", "--no-hardlinks", repoPath, dst); err != nil {
+		return fmt.Errorf("problem cloning %s:%s", repoPath, err)
+	}
+	// Any Git LFS files are checked out from the objects fetched for the ref
+	if refUsesLFS(dst, ref) {
+		if remote := lfsRemote(r); len(remote) > 0 {
+			if err := fetchRefLFS(repoPath, remote, ref); err != nil {
+				return err
+			}
+		}
+	}
+	if err := copyLFSObjects(repoPath, dst); err != nil {
+		return fmt.Errorf("problem copying Git LFS objects from %s:%s", repoPath, err)
+	}
+	if err := runGit(dst, "checkout", "--quiet", ref); err != nil {
+		return fmt.Errorf("unable to checkout %q from %s:%s", ref, repoPath, err)
+	}
+	if err := initSubmodules(repoPath, dst); err != nil {
+		return fmt.Errorf("problem checking out submodules for %q:%s", ref, err)
+	}
+	// The clone will refer to the local path, use the original remote
+	if cfg, _ := r.Config(); cfg != nil {
+		if origin, ok := cfg.Remotes["origin"]; ok && len(origin.URLs) > 0 {
+			return runGit(dst, "remote", "set-url", "origin", origin.URLs[0])
+		}
+	}
+	return runGit(dst, "remote", "remove", "origin")
+}
+
+// lfsRemote is the remote to fetch LFS objects from ("" if there are none and
+// the objects must already be present)
+func lfsRemote(r *git.Repository) string {
+	cfg, err := r.Config()
+	if err != nil || len(cfg.Remotes) == 0 {
+		return ""
+	}
+	if _, ok := cfg.Remotes["origin"]; ok {
+		return "origin"
+	}
+	// otherwise the first by name
+	remote := ""
+	for name := range cfg.Remotes {
+		if len(remote) == 0 || name < remote {
+			remote = name
+		}
+	}
+	return remote
 }
 
 // IsClean will report is a repo is clean given a path
@@ -120,86 +315,127 @@ func IsClean(repoPath string) (bool, error) {
 	return status.IsClean(), nil
 }
 
-// Restore will extract a git repository to the correct path under the dst
-// directory
-func Restore(gitRepoFile, dst, repoName, artefactsDir string) error {
-	// If the destination path doesn't exist...
-	repoPath := filepath.Join(dst, repoName)
-	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-		log.Printf("%s doesn't exist, extracting files", repoPath)
-		if err := tar.Extract(gitRepoFile, dst); err != nil {
-			return fmt.Errorf("problem checking out files to %s:%s", dst, err)
+// Stage will restore a git repository to stagedPath from an archive, starting
+// from the existing repo at repoPath when fetching a bundle or when refresh is
+// RefreshFetch. The artefactsDir (relative to the repo) is not copied.
+func Stage(gitRepoFile, repoPath, stagedPath, artefactsDir, refresh string) error {
+	if err := os.MkdirAll(filepath.Dir(stagedPath), 0775); err != nil {
+		return fmt.Errorf("error creating directory %s:%s", filepath.Dir(stagedPath), err)
+	}
+	// Anything here will be replaced
+	if err := os.RemoveAll(stagedPath); err != nil {
+		return fmt.Errorf("error removing %s:%s", stagedPath, err)
+	}
+	if IsBundle(gitRepoFile) {
+		if _, err := os.Stat(repoPath); err == nil {
+			log.Printf("%s exists, copying it to %s to fetch the bundle", repoPath, stagedPath)
+			if err := copyRepo(repoPath, stagedPath, artefactsDir); err != nil {
+				return fmt.Errorf("problem copying %s to %s:%s", repoPath, stagedPath, err)
+			}
 		}
-		return nil
+		if err := restoreBundle(gitRepoFile, stagedPath); err != nil {
+			return err
+		}
+		return restoreLFS(stagedPath)
 	}
-	// When refreshing, extract the repo files to a clean temp directory first
-	tmpD := filepath.Join(dst, repoName+"_artefactor_tmp")
-	err := os.MkdirAll(tmpD, 0775)
-	if err != nil {
+	// The archive files are all prefixed with the repo name so extract to a
+	// clean temp directory first
+	tmpD := stagedPath + "_artefactor_tmp"
+	if err := os.MkdirAll(tmpD, 0775); err != nil {
 		return fmt.Errorf(
 			"error creating temp dir %s for clean extraction:%s",
 			tmpD,
 			err)
 	}
-	tmpRepoPath := filepath.Join(tmpD, repoName)
-	log.Printf("%s exists, extracting to temp dir %s", repoPath, tmpD)
-	if err = tar.Extract(gitRepoFile, tmpD); err != nil {
+	log.Printf("extracting %s to temp dir %s", gitRepoFile, tmpD)
+	if err := tar.Extract(gitRepoFile, tmpD); err != nil {
 		return fmt.Errorf(
 			"problem extracting files to tempdir %s from %s:%s",
 			tmpD,
 			gitRepoFile,
 			err)
 	}
-	// Now we have a clean repo, move the downloads to the TempDir...
-	downloads := filepath.Join(repoPath, artefactsDir)
-	tmpDownloads := filepath.Join(tmpRepoPath, artefactsDir)
-	// First check if we had any downloads before
-	if _, err = os.Stat(downloads); err == nil {
-		log.Printf("%s exists, moving it to %s", downloads, tmpDownloads)
-		// Move the previous downloads
-		if err = os.Rename(downloads, tmpDownloads); err != nil {
-			return fmt.Errorf(
-				"error moving %s to clean chekout temp dir %s:%s",
-				downloads,
-				tmpDownloads,
-				err)
-		}
-	}
-	log.Printf("Now moving %s to %s", tmpRepoPath, repoPath)
-	if _, err = os.Stat(repoPath); err == nil {
-		// Amazingly, go's os.Rename will not error if a directory exists
-		// and fail to rename, so we delete here!
-		if err = os.RemoveAll(repoPath); err != nil {
-			fmt.Errorf("error removing old repo before replace %s:%s", repoPath, err)
-		}
-	}
-	// Move the old checkout with the clean extracted files
-	if err = os.Rename(tmpRepoPath, repoPath); err != nil {
-		fmt.Errorf(
-			"error moving %s back to %s after clean checkout:%s",
+	tmpRepoPath := filepath.Join(tmpD, GetRepoName(gitRepoFile))
+	if _, err := os.Stat(repoPath); err == nil && refresh == RefreshFetch {
+		if err := refreshRepo(tmpRepoPath, repoPath, stagedPath, artefactsDir); err != nil {
+			return err
+		}
+	} else if err := os.Rename(tmpRepoPath, stagedPath); err != nil {
+		return fmt.Errorf(
+			"error moving %s to %s after clean checkout:%s",
 			tmpRepoPath,
-			repoPath,
+			stagedPath,
 			err)
 	}
-	// We didn't defer as we have to do this last
-	// (don't want to loose any downloads!)
-	if err = os.RemoveAll(tmpD); err != nil {
-		return fmt.Errorf("warning, can't clean up temp files %s:%s", tmpD, err)
+	if err := os.RemoveAll(tmpD); err != nil {
+		return fmt.Errorf("can't clean up temp files %s:%s", tmpD, err)
+	}
+	return restoreLFS(stagedPath)
+}
+
+// Verify will check a restored repo can be opened and has a valid HEAD
+func Verify(repoPath string) error {
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return fmt.Errorf("can't open restored git repo %s:%s", repoPath, err)
+	}
+	if _, err := r.Head(); err != nil {
+		return fmt.Errorf("can't resolve HEAD for restored git repo %s:%s", repoPath, err)
 	}
 	return nil
 }
 
+// HasCommit will report if a commit is checked out (or an ancestor of HEAD)
+// in a repo
+func HasCommit(repoPath string, commit string) bool {
+	return runGit(repoPath, "merge-base", "--is-ancestor", commit, "HEAD") == nil
+}
+
+// copyRepo will copy a repo (except for skipDir) hard linking git objects as
+// they are never modified
+func copyRepo(repoPath string, dst string, skipDir string) error {
+	objectsDir := filepath.Join(repoPath, ".git", "objects")
+	skipPath := filepath.Join(repoPath, skipDir)
+	return filepath.Walk(repoPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(skipDir) > 0 && path == skipPath {
+			return filepath.SkipDir
+		}
+		relPath, err := filepath.Rel(repoPath, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case strings.HasPrefix(path, objectsDir+string(filepath.Separator)):
+			return util.Link(path, target)
+		default:
+			return util.Cp(path, target)
+		}
+	})
+}
+
 // GetHomeRepo will return a 'home' repo
 func GetHomeRepo(path string) (string, error) {
-	tars, err := filepath.Glob(path + string(filepath.Separator) + "*" + GitFileHomeExt)
+	homes, err := globRepos(path, GitFileHomeExt, GitBundleHomeExt)
 	if err != nil {
 		return "", err
 	}
-	switch homes := len(tars); homes {
+	switch len(homes) {
 	case 0:
 		return "", nil
 	case 1:
-		return tars[0], nil
+		return homes[0], nil
 	default:
 		return "", fmt.Errorf("Multiple home git repos found in %q", path)
 	}
@@ -207,9 +443,72 @@ func GetHomeRepo(path string) (string, error) {
 
 // GetOtherRepos will list other git repos saved
 func GetOtherRepos(path string) ([]string, error) {
-	gitRepos, err := filepath.Glob(path + string(filepath.Separator) + "*" + GitFileExt)
+	return globRepos(path, GitFileExt, GitBundleExt)
+}
+
+// GetRepoName will return the name of a repo from an archive file name
+func GetRepoName(gitRepoFile string) string {
+	name := filepath.Base(gitRepoFile)
+	for _, ext := range []string{
+		GitFileHomeExt, GitBundleHomeExt, GitFileExt, GitBundleExt} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// IsBundle will report if an archive file is a git bundle
+func IsBundle(gitRepoFile string) bool {
+	return strings.HasSuffix(gitRepoFile, GitBundleExt) ||
+		strings.HasSuffix(gitRepoFile, GitBundleHomeExt)
+}
+
+// GetArchiveCommit will return the commit checked out (HEAD) in a git archive
+// without extracting it
+func GetArchiveCommit(gitRepoFile string) (string, error) {
+	if IsBundle(gitRepoFile) {
+		_, heads, err := readBundleHeader(gitRepoFile)
+		if err != nil {
+			return "", err
+		}
+		return heads[bundleHeadRef], nil
+	}
+	gitDir := GetRepoName(gitRepoFile) + "/.git/"
+	files, err := tar.ReadFiles(gitRepoFile, func(name string) bool {
+		return name == gitDir+"HEAD" ||
+			name == gitDir+"packed-refs" ||
+			strings.HasPrefix(name, gitDir+"refs/heads/")
+	})
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	head := strings.TrimSpace(string(files[gitDir+"HEAD"]))
+	if !strings.HasPrefix(head, "ref: ") {
+		// A detached HEAD
+		return head, nil
+	}
+	ref := strings.TrimPrefix(head, "ref: ")
+	if commit, ok := files[gitDir+ref]; ok {
+		return strings.TrimSpace(string(commit)), nil
+	}
+	for _, line := range strings.Split(string(files[gitDir+"packed-refs"]), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no commit found for %s in %s", ref, gitRepoFile)
+}
+
+// globRepos will list the archives in path with any of the extensions given
+func globRepos(path string, exts ...string) ([]string, error) {
+	var gitRepos []string
+	for _, ext := range exts {
+		found, err := filepath.Glob(path + string(filepath.Separator) + "*" + ext)
+		if err != nil {
+			return nil, err
+		}
+		gitRepos = append(gitRepos, found...)
 	}
 	return gitRepos, nil
 }
@@ -230,11 +529,12 @@ func getRepoName(r *git.Repository, dir string) string {
 	if cfg == nil {
 		return dir
 	}
-	if len(cfg.Remotes) < 1 {
+	origin, ok := cfg.Remotes["origin"]
+	if !ok || len(origin.URLs) < 1 {
 		return dir
 	}
 	basename := strings.Replace(
-		filepath.Base(cfg.Remotes["origin"].URLs[0]),
+		filepath.Base(origin.URLs[0]),
 		".git",
 		"",
 		1)
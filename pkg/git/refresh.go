@@ -0,0 +1,182 @@
+package git
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+const (
+	// RefreshReplace replaces an existing repo with the archived repo
+	RefreshReplace string = "replace"
+	// RefreshFetch fetches from the archived repo into an existing repo and
+	// only fast-forwards branches
+	RefreshFetch string = "fetch"
+
+	// fetchNamespace is where refs are fetched to before being checked
+	fetchNamespace string = "refs/artefactor/"
+)
+
+// refreshRepo will fetch from an extracted archive into a copy of an existing
+// repo (keeping local branches, remotes and config)
+func refreshRepo(archivedPath string, repoPath string, stagedPath string, artefactsDir string) error {
+	log.Printf("%s exists, copying it to %s to fetch from %s", repoPath, stagedPath, archivedPath)
+	if err := copyRepo(repoPath, stagedPath, artefactsDir); err != nil {
+		return fmt.Errorf("problem copying %s to %s:%s", repoPath, stagedPath, err)
+	}
+	if err := fastForward(stagedPath, archivedPath); err != nil {
+		return fmt.Errorf("can't refresh %s:%s", repoPath, err)
+	}
+	if err := checkoutArchivedHead(archivedPath, stagedPath); err != nil {
+		return err
+	}
+	if err := fetchModules(archivedPath, stagedPath); err != nil {
+		return err
+	}
+	return copyLFSObjects(archivedPath, stagedPath)
+}
+
+// checkoutArchivedHead will checkout the branch or commit checked out in an
+// archived repo (staying on the branch if it is already checked out)
+func checkoutArchivedHead(archivedPath string, repoPath string) error {
+	sha, err := gitOutput(archivedPath, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return fmt.Errorf("problem reading HEAD of archived repo %s:%s", archivedPath, err)
+	}
+	checkout := []string{"checkout", "--quiet", "--detach", sha}
+	archivedBranch, _ := gitOutput(archivedPath, "symbolic-ref", "--quiet", "HEAD")
+	if len(archivedBranch) > 0 {
+		branch, _ := gitOutput(repoPath, "symbolic-ref", "--quiet", "HEAD")
+		if branch == archivedBranch {
+			return nil
+		}
+		checkout = []string{"checkout", "--quiet", strings.TrimPrefix(archivedBranch, "refs/heads/")}
+	} else if head, _ := gitOutput(repoPath, "rev-parse", "--verify", "HEAD"); head == sha {
+		return nil
+	}
+	if err := runGit(repoPath, checkout...); err != nil {
+		return fmt.Errorf("problem checking out archived HEAD in %s:%s", repoPath, err)
+	}
+	return nil
+}
+
+// fastForward will fetch all branches and tags from source and update the
+// matching refs in repoPath only where they fast-forward. Any diverged refs
+// are reported and nothing is changed.
+func fastForward(repoPath string, source string) error {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	if err := runGit(
+		repoPath,
+		"fetch", "--quiet", "--no-tags", source,
+		"+refs/heads/*:"+fetchNamespace+"heads/*",
+		"+refs/tags/*:"+fetchNamespace+"tags/*"); err != nil {
+		return fmt.Errorf("problem fetching from %s into %s:%s", source, repoPath, err)
+	}
+	fetched, err := gitOutput(
+		repoPath, "for-each-ref", "--format=%(refname) %(objectname)", fetchNamespace)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, line := range strings.Split(fetched, "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 {
+				runGit(repoPath, "update-ref", "-d", fields[0])
+			}
+		}
+	}()
+
+	head, _ := gitOutput(repoPath, "symbolic-ref", "--quiet", "HEAD")
+	updates := make(map[string]string)
+	var diverged []string
+	for _, line := range strings.Split(fetched, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		ref := "refs/" + strings.TrimPrefix(fields[0], fetchNamespace)
+		newSha := fields[1]
+		oldSha, err := gitOutput(repoPath, "rev-parse", "--verify", "--quiet", ref)
+		switch {
+		case err != nil:
+			updates[ref] = newSha
+		case oldSha == newSha:
+			continue
+		case strings.HasPrefix(ref, "refs/tags/"):
+			diverged = append(diverged, fmt.Sprintf("%s (tag moved)", ref))
+		case runGit(repoPath, "merge-base", "--is-ancestor", oldSha, newSha) == nil:
+			updates[ref] = newSha
+		case runGit(repoPath, "merge-base", "--is-ancestor", newSha, oldSha) == nil:
+			fmt.Printf("Keeping local %s, it is ahead of the archived repo\n", ref)
+		default:
+			diverged = append(diverged, ref)
+		}
+	}
+	if len(diverged) > 0 {
+		sort.Strings(diverged)
+		return fmt.Errorf(
+			"refusing to refresh, local history has diverged from the archived repo for:\n  %s",
+			strings.Join(diverged, "\n  "))
+	}
+
+	refs := make([]string, 0, len(updates))
+	for ref := range updates {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		if ref == head {
+			// Update the working tree as well
+			if err := runGit(repoPath, "merge", "--quiet", "--ff-only", updates[ref]); err != nil {
+				return fmt.Errorf("problem fast-forwarding %s in %s:%s", ref, repoPath, err)
+			}
+		} else if err := runGit(repoPath, "update-ref", ref, updates[ref]); err != nil {
+			return fmt.Errorf("problem updating %s in %s:%s", ref, repoPath, err)
+		}
+		log.Printf("updated %s in %s", ref, repoPath)
+	}
+	fmt.Printf("Fast-forwarded %d refs\n", len(refs))
+	return nil
+}
+
+// fetchModules will fetch the checked out commits for all submodule repos from
+// an archived repo and update the submodules
+func fetchModules(archivedPath string, repoPath string) error {
+	archivedModules := filepath.Join(archivedPath, ".git", "modules")
+	if _, err := os.Stat(archivedModules); os.IsNotExist(err) {
+		return nil
+	}
+	err := filepath.Walk(archivedModules, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == archivedModules || !fi.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(p, "HEAD")); err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(archivedModules, p)
+		module := filepath.Join(repoPath, ".git", "modules", rel)
+		if _, err := os.Stat(module); os.IsNotExist(err) {
+			// A new submodule
+			return util.CpDir(p, module)
+		}
+		absModule, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		return runGit(module, "--git-dir=.", "fetch", "--quiet", absModule, "HEAD")
+	})
+	if err != nil {
+		return fmt.Errorf("problem fetching submodules for %s:%s", repoPath, err)
+	}
+	return runGit(repoPath, "submodule", "update", "--quiet", "--init", "--recursive")
+}
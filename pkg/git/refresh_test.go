@@ -0,0 +1,58 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+func TestRefreshRepoChecksOutArchivedHead(t *testing.T) {
+	srcPath := newTestRepo(t, map[string]string{"README.md": "v1"})
+	defer os.RemoveAll(srcPath)
+	mustGit(t, srcPath, "branch", "--move", "main")
+	// the existing repo was restored before the changes below
+	existing := filepath.Join(srcPath+"_restored", "repo")
+	defer os.RemoveAll(filepath.Dir(existing))
+	if err := util.CpDir(srcPath, existing); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, srcPath, map[string]string{"README.md": "v2"})
+	mustGit(t, srcPath, "tag", "v2")
+	commitFiles(t, srcPath, map[string]string{"README.md": "v3"})
+	mainSha := mustGit(t, srcPath, "rev-parse", "main")
+	tagSha := mustGit(t, srcPath, "rev-parse", "v2^{commit}")
+
+	tests := []struct {
+		name     string
+		checkout []string
+		branch   string
+		sha      string
+		content  string
+	}{
+		{"detached", []string{"checkout", "--quiet", "--detach", "v2"}, "", tagSha, "v2"},
+		{"branch", []string{"checkout", "--quiet", "-b", "release", "main"}, "refs/heads/release", mainSha, "v3"},
+	}
+	for _, test := range tests {
+		mustGit(t, srcPath, test.checkout...)
+		staged := filepath.Join(filepath.Dir(existing), test.name)
+		if err := refreshRepo(srcPath, existing, staged, ""); err != nil {
+			t.Fatalf("refresh checking out %s failed:%s", test.name, err)
+		}
+		branch, _ := gitOutput(staged, "symbolic-ref", "--quiet", "HEAD")
+		if branch != test.branch {
+			t.Errorf("Expecting branch %q but got %q for %s", test.branch, branch, test.name)
+		}
+		if sha := mustGit(t, staged, "rev-parse", "HEAD"); sha != test.sha {
+			t.Errorf("Expecting HEAD %s but got %s for %s", test.sha, sha, test.name)
+		}
+		if sha := mustGit(t, staged, "rev-parse", "main"); sha != mainSha {
+			t.Errorf("Expecting main fast-forwarded to %s but got %s for %s", mainSha, sha, test.name)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(staged, "README.md")); err != nil || string(b) != test.content {
+			t.Errorf("Expecting README.md %q but got %q (%v) for %s", test.content, b, err, test.name)
+		}
+	}
+}
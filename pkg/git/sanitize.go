@@ -0,0 +1,321 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+const (
+	// RemotesRedact will remove any credentials from remote urls
+	RemotesRedact string = "redact"
+	// RemotesRemove will remove all remotes
+	RemotesRemove string = "remove"
+)
+
+// SanitizeOptions specifies what is removed from git meta-data before it is
+// archived. Hooks, reflogs, stashes and fetch records are always removed.
+type SanitizeOptions struct {
+	// Remotes is one of RemotesRedact or RemotesRemove
+	Remotes string
+	// RemoteRewrites replaces any remote url prefix (key) with a new prefix
+	RemoteRewrites map[string]string
+	// KeepRefs limits the refs archived to those matching any pattern
+	KeepRefs []string
+}
+
+// sanitizeGitDir will remove local only meta-data from a git directory and
+// return a report of what was removed
+func sanitizeGitDir(gitDir string, opts *SanitizeOptions) ([]string, error) {
+	report, err := sanitizeMetaData(gitDir, opts, "")
+	if err != nil {
+		return report, err
+	}
+	// Submodule repos are kept under the modules directory
+	modules := filepath.Join(gitDir, "modules")
+	err = filepath.Walk(modules, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p == modules || !fi.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(p, "HEAD")); err != nil {
+			return nil
+		}
+		name, _ := filepath.Rel(gitDir, p)
+		subReport, err := sanitizeMetaData(p, opts, name+": ")
+		report = append(report, subReport...)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	refReport, err := limitRefs(gitDir, opts.KeepRefs)
+	return append(report, refReport...), err
+}
+
+// sanitizeMetaData will remove hooks, reflogs, stashes and credentials from a
+// single git directory
+func sanitizeMetaData(gitDir string, opts *SanitizeOptions, label string) ([]string, error) {
+	var report []string
+	prune := false
+	// Remove all hooks but keep the directory
+	hooksDir := filepath.Join(gitDir, "hooks")
+	hooks, _ := ioutil.ReadDir(hooksDir)
+	samples := 0
+	for _, hook := range hooks {
+		if err := os.RemoveAll(filepath.Join(hooksDir, hook.Name())); err != nil {
+			return report, err
+		}
+		if strings.HasSuffix(hook.Name(), ".sample") {
+			samples++
+		} else {
+			report = append(report, label+"hook "+hook.Name())
+		}
+	}
+	if samples > 0 {
+		report = append(report, fmt.Sprintf("%s%d sample hooks", label, samples))
+	}
+	if err := runGit(gitDir, "--git-dir=.", "rev-parse", "--verify", "--quiet", "refs/stash"); err == nil {
+		if err := runGit(gitDir, "--git-dir=.", "update-ref", "-d", "refs/stash"); err != nil {
+			return report, err
+		}
+		report = append(report, label+"stash")
+		prune = true
+	}
+	for _, file := range []string{"logs", "FETCH_HEAD", "ORIG_HEAD"} {
+		if _, err := os.Stat(filepath.Join(gitDir, file)); err == nil {
+			if err := os.RemoveAll(filepath.Join(gitDir, file)); err != nil {
+				return report, err
+			}
+			if file == "logs" {
+				file = "reflogs"
+				// commits only in the reflogs are still in the object store
+				prune = true
+			}
+			report = append(report, label+file)
+		}
+	}
+
+	// Credential helpers (including url scoped ones), url rewrites (which can
+	// include tokens) and extra headers in config
+	for _, section := range configSections(gitDir, `^(credential|url)\.`) {
+		if err := runGit(gitDir, "--git-dir=.", "config", "--local", "--remove-section", section); err != nil {
+			return report, err
+		}
+		report = append(report, label+"config "+sectionHeader(section))
+	}
+	headers, _ := gitOutput(
+		gitDir, "--git-dir=.", "config", "--local", "--name-only", "--get-regexp", `^http\..*extraheader$`)
+	for _, key := range strings.Fields(headers) {
+		if err := runGit(gitDir, "--git-dir=.", "config", "--unset-all", key); err != nil {
+			return report, err
+		}
+		report = append(report, label+"config "+key)
+	}
+
+	remoteReport, err := sanitizeRemotes(gitDir, opts, label)
+	report = append(report, remoteReport...)
+	if err != nil || !prune {
+		return report, err
+	}
+	// Stashed changes and commits only in reflogs are still in the object
+	// store until pruned
+	log.Printf("pruning stashed and reflog objects in %s", gitDir)
+	if err := runGit(gitDir, "--git-dir=.", "reflog", "expire", "--expire=now", "--all"); err != nil {
+		return report, err
+	}
+	return report, runGit(gitDir, "--git-dir=.", "gc", "--quiet", "--prune=now")
+}
+
+// configSections will list the sections of the repo config with keys matching
+// a pattern e.g. credential.https://example.com
+func configSections(gitDir string, pattern string) []string {
+	// git config fails when no keys match
+	out, _ := gitOutput(gitDir, "--git-dir=.", "config", "--local", "--name-only", "--get-regexp", pattern)
+	var sections []string
+	for _, key := range strings.Split(out, "\n") {
+		// the section is all but the last part (subsections can have dots)
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			continue
+		}
+		if section := key[:i]; !contains(sections, section) {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// sectionHeader will display a config section as it's written in the config
+// file e.g. [credential "https://example.com"] (without any url credentials)
+func sectionHeader(section string) string {
+	parts := strings.SplitN(section, ".", 2)
+	if len(parts) == 1 {
+		return "[" + section + "]"
+	}
+	return fmt.Sprintf("[%s %q]", parts[0], SanitizeURL(parts[1], nil))
+}
+
+// sanitizeRemotes will rewrite, redact or remove the remotes configured
+func sanitizeRemotes(gitDir string, opts *SanitizeOptions, label string) ([]string, error) {
+	var report []string
+	remotes, _ := gitOutput(gitDir, "--git-dir=.", "remote")
+	for _, remote := range strings.Fields(remotes) {
+		if opts.Remotes == RemotesRemove {
+			if err := runGit(gitDir, "--git-dir=.", "remote", "remove", remote); err != nil {
+				return report, err
+			}
+			report = append(report, label+"remote "+remote)
+			continue
+		}
+		for _, key := range []string{"url", "pushurl"} {
+			configKey := "remote." + remote + "." + key
+			oldURL, err := gitOutput(gitDir, "--git-dir=.", "config", "--get", configKey)
+			if err != nil {
+				continue
+			}
+			newURL := SanitizeURL(oldURL, opts.RemoteRewrites)
+			if newURL == oldURL {
+				continue
+			}
+			if err := runGit(gitDir, "--git-dir=.", "config", configKey, newURL); err != nil {
+				return report, err
+			}
+			report = append(
+				report,
+				fmt.Sprintf("%s%s (rewritten as %s)", label, configKey, newURL))
+		}
+	}
+	return report, nil
+}
+
+// SanitizeURL will rewrite a url prefix and remove any credentials
+func SanitizeURL(remoteURL string, rewrites map[string]string) string {
+	// Use the longest matching prefix
+	prefix := ""
+	for from := range rewrites {
+		if strings.HasPrefix(remoteURL, from) && len(from) > len(prefix) {
+			prefix = from
+		}
+	}
+	if len(prefix) > 0 {
+		remoteURL = rewrites[prefix] + strings.TrimPrefix(remoteURL, prefix)
+	}
+	u, err := url.Parse(remoteURL)
+	if err != nil || u.User == nil || len(u.Scheme) == 0 {
+		// Not a url with credentials (e.g. git@host:path or a local path)
+		return remoteURL
+	}
+	if _, hasPassword := u.User.Password(); hasPassword || u.Scheme != "ssh" {
+		u.User = nil
+	}
+	return u.String()
+}
+
+// limitRefs will remove all refs not matching the patterns and any objects
+// only they referenced
+func limitRefs(gitDir string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var report []string
+	refs, err := getRefs(gitDir, patterns, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if err := runGit(gitDir, "--git-dir=.", "update-ref", "--no-deref", "-d", ref); err != nil {
+			return report, err
+		}
+		report = append(report, "ref "+ref)
+	}
+	if len(refs) > 0 {
+		log.Printf("pruning objects only referenced by removed refs in %s", gitDir)
+		if err := runGit(
+			gitDir, "--git-dir=.", "reflog", "expire", "--expire=now", "--all"); err != nil {
+			return report, err
+		}
+		if err := runGit(gitDir, "--git-dir=.", "gc", "--quiet", "--prune=now"); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// getRefs will list the refs in a repo matching (or not matching) patterns.
+// The branch checked out always matches.
+func getRefs(gitDir string, patterns []string, notMatching bool) ([]string, error) {
+	out, err := gitOutput(gitDir, "--git-dir=.", "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		return nil, fmt.Errorf("problem listing refs in %s:%s", gitDir, err)
+	}
+	head, _ := gitOutput(gitDir, "--git-dir=.", "symbolic-ref", "--quiet", "HEAD")
+	var refs []string
+	for _, ref := range strings.Fields(out) {
+		matched := ref == head
+		for _, pattern := range patterns {
+			if matchRef(pattern, ref) {
+				matched = true
+				break
+			}
+		}
+		if matched != notMatching {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// matchRef will match a full ref name to a pattern e.g. refs/tags/* or a short
+// branch or tag name e.g. main
+func matchRef(pattern string, ref string) bool {
+	names := []string{pattern}
+	if !strings.HasPrefix(pattern, "refs/") {
+		names = []string{"refs/heads/" + pattern, "refs/tags/" + pattern}
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/*") {
+			if strings.HasPrefix(ref, strings.TrimSuffix(name, "*")) {
+				return true
+			}
+		} else if matched, _ := path.Match(name, ref); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// stageGitDir will copy a .git directory so it can be changed
+func stageGitDir(repoPath string, tmpDir string) (string, error) {
+	stagedRepo := filepath.Join(tmpDir, filepath.Base(repoPath))
+	if err := util.CpDir(
+		filepath.Join(repoPath, ".git"),
+		filepath.Join(stagedRepo, ".git")); err != nil {
+		return "", fmt.Errorf("problem copying .git directory from %s:%s", repoPath, err)
+	}
+	return stagedRepo, nil
+}
+
+// printReport will display what was removed when sanitizing
+func printReport(repoSpec string, report []string) {
+	fmt.Printf("Sanitized git meta-data for %s, removed:\n", repoSpec)
+	if len(report) == 0 {
+		fmt.Printf("  (nothing)\n")
+	}
+	for _, item := range report {
+		fmt.Printf("  %s\n", item)
+	}
+}
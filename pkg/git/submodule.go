@@ -0,0 +1,218 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+const (
+	// lfsFilter is the attribute that marks a file as stored in Git LFS
+	lfsFilter string = "filter=lfs"
+)
+
+// getSubmodules will return the paths of all (recursive) submodules in a repo
+// relative to the top level repo
+func getSubmodules(repoPath string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(repoPath, ".gitmodules")); os.IsNotExist(err) {
+		return nil, nil
+	}
+	out, err := gitOutput(repoPath, "submodule", "status", "--recursive")
+	if err != nil {
+		return nil, fmt.Errorf("problem listing submodules for %s:%s", repoPath, err)
+	}
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 {
+			continue
+		}
+		switch line[0] {
+		case '-':
+			return nil, fmt.Errorf(
+				"submodule %s in %s is not initialized (git submodule update --init --recursive)",
+				fields[1],
+				repoPath)
+		case '+', 'U':
+			return nil, fmt.Errorf(
+				"submodule %s in %s is not checked out at the recorded commit",
+				fields[1],
+				repoPath)
+		}
+		paths = append(paths, fields[1])
+	}
+	return paths, nil
+}
+
+// getSubmoduleFiles will list all files to archive from the working tree
+// including the files in submodules and the submodule .git files
+func getSubmoduleFiles(repoPath string, submodules []string) ([]string, error) {
+	out, err := gitOutput(repoPath, "ls-files", "-z", "--recurse-submodules")
+	if err != nil {
+		return nil, fmt.Errorf("problem listing files in %s:%s", repoPath, err)
+	}
+	var files []string
+	for _, file := range strings.Split(out, "\x00") {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	// The .git file (or older style directory) links each submodule to its
+	// repo (kept under .git/modules)
+	for _, submodule := range submodules {
+		gitPath := filepath.Join(submodule, ".git")
+		err := filepath.Walk(
+			filepath.Join(repoPath, gitPath),
+			func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				relPath, err := filepath.Rel(repoPath, path)
+				if err != nil {
+					return err
+				}
+				files = append(files, relPath)
+				return nil
+			})
+		if err != nil {
+			return nil, fmt.Errorf("problem reading submodule %s:%s", gitPath, err)
+		}
+	}
+	return files, nil
+}
+
+// initSubmodules will checkout submodules in a clone using the submodule repos
+// from the original repo where present
+func initSubmodules(srcRepoPath string, repoPath string) error {
+	if _, err := os.Stat(filepath.Join(repoPath, ".gitmodules")); os.IsNotExist(err) {
+		return nil
+	}
+	if err := runGit(repoPath, "submodule", "init"); err != nil {
+		return err
+	}
+	names, err := gitOutput(
+		repoPath, "config", "--file", ".gitmodules", "--name-only", "--get-regexp", `^submodule\..*\.path$`)
+	if err != nil {
+		return fmt.Errorf("problem reading .gitmodules in %s:%s", repoPath, err)
+	}
+	for _, key := range strings.Fields(names) {
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+		localRepo := filepath.Join(srcRepoPath, ".git", "modules", name)
+		if _, err := os.Stat(localRepo); err == nil {
+			log.Printf("using local submodule repo %s for %s", localRepo, name)
+			if err := runGit(
+				repoPath, "config", "submodule."+name+".url", localRepo); err != nil {
+				return err
+			}
+		}
+	}
+	if err := runGit(
+		repoPath,
+		"-c", "protocol.file.allow=always",
+		"submodule", "update", "--recursive", "--init"); err != nil {
+		return err
+	}
+	// Put back the submodule urls from .gitmodules
+	return runGit(repoPath, "submodule", "sync", "--quiet", "--recursive")
+}
+
+// usesLFS will check the .gitattributes files to be archived for LFS files
+func usesLFS(repoPath string, files []string) (bool, error) {
+	for _, file := range files {
+		if filepath.Base(file) != ".gitattributes" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(repoPath, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if strings.Contains(string(b), lfsFilter) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fetchLFS will fetch all the LFS objects for the checked out commit of a repo
+// and its submodules so they are archived with the .git directories
+func fetchLFS(repoPath string, submodules []string) error {
+	if err := runGit(repoPath, "lfs", "version"); err != nil {
+		return fmt.Errorf("repo %s uses Git LFS and git-lfs is not available:%s", repoPath, err)
+	}
+	fmt.Printf("Fetching Git LFS objects for %s\n", repoPath)
+	if err := runGit(repoPath, "lfs", "fetch"); err != nil {
+		return fmt.Errorf("problem fetching Git LFS objects for %s:%s", repoPath, err)
+	}
+	if len(submodules) > 0 {
+		if err := runGit(
+			repoPath, "submodule", "foreach", "--quiet", "--recursive", "git lfs fetch"); err != nil {
+			return fmt.Errorf("problem fetching Git LFS objects for submodules in %s:%s", repoPath, err)
+		}
+	}
+	return nil
+}
+
+// refUsesLFS will check the .gitattributes files committed at a ref for LFS
+// files
+func refUsesLFS(repoPath string, ref string) bool {
+	// git grep fails when nothing matches
+	_, err := gitOutput(
+		repoPath, "grep", "--quiet", "--fixed-strings", lfsFilter, ref, "--", ":(glob)**/.gitattributes")
+	return err == nil
+}
+
+// fetchRefLFS will fetch the LFS objects for a ref (only those for the commit
+// checked out are fetched when a repo is archived without a ref)
+func fetchRefLFS(repoPath string, remote string, ref string) error {
+	if err := runGit(repoPath, "lfs", "version"); err != nil {
+		return fmt.Errorf("repo %s uses Git LFS and git-lfs is not available:%s", repoPath, err)
+	}
+	fmt.Printf("Fetching Git LFS objects for %s@%s\n", repoPath, ref)
+	if err := runGit(repoPath, "lfs", "fetch", remote, ref); err != nil {
+		return fmt.Errorf("problem fetching Git LFS objects for %s@%s:%s", repoPath, ref, err)
+	}
+	return nil
+}
+
+// copyLFSObjects will copy any LFS objects cached for one repo to another
+func copyLFSObjects(srcRepoPath string, repoPath string) error {
+	lfsDir := filepath.Join(srcRepoPath, ".git", "lfs", "objects")
+	if _, err := os.Stat(lfsDir); os.IsNotExist(err) {
+		return nil
+	}
+	return util.CpDir(lfsDir, filepath.Join(repoPath, ".git", "lfs", "objects"))
+}
+
+// restoreLFS will configure git-lfs for a restored repo so LFS files are
+// managed (and not reported as changes)
+func restoreLFS(repoPath string) error {
+	if _, err := os.Stat(filepath.Join(repoPath, ".git", "lfs")); os.IsNotExist(err) {
+		return nil
+	}
+	if err := runGit(repoPath, "lfs", "version"); err != nil {
+		fmt.Printf(
+			"Warning: %s uses Git LFS but git-lfs is not installed, LFS files are restored but will show as modified\n",
+			repoPath)
+		return nil
+	}
+	if err := runGit(repoPath, "lfs", "install", "--local"); err != nil {
+		return fmt.Errorf("problem configuring Git LFS for %s:%s", repoPath, err)
+	}
+	if err := runGit(repoPath, "lfs", "checkout"); err != nil {
+		return fmt.Errorf("problem checking out Git LFS files for %s:%s", repoPath, err)
+	}
+	return runGit(
+		repoPath, "submodule", "foreach", "--quiet", "--recursive",
+		"git lfs install --local && git lfs checkout")
+}
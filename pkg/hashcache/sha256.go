@@ -190,6 +190,21 @@ func (c *CheckSumCache) Update(file string) (checksum string, err error) {
 	return checksum, nil
 }
 
+// Add will record the checksum of a file that isn't present e.g. one left out
+// of a delta bundle
+func (c *CheckSumCache) Add(file string, checksum string) error {
+	file = filepath.Clean(file)
+	c.readCheckSumsIfPresent()
+	item := CheckSumItem{
+		CheckSum: checksum,
+		FileName: filepath.Base(file),
+		FilePath: file,
+	}
+	c.CheckSumsByFilePath[file] = item
+	c.AddedItems = append(c.AddedItems, item)
+	return c.writeCheckSums()
+}
+
 // Keep will mark a file (and checksum) so it won't be cleaned with .Clean
 func (c *CheckSumCache) Keep(file string) {
 	file = filepath.Clean(file)
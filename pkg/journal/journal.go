@@ -0,0 +1,289 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// FileName is the name of the journal kept in the restore destination
+	FileName string = ".artefactor-restore.json"
+	// StateStaging is set while artefacts are copied to the staging dirs
+	StateStaging string = "staging"
+	// StateCommitting is set while staged dirs are swapped into place
+	StateCommitting string = "committing"
+	// StateCommitted is set once all staged dirs are in place
+	StateCommitted string = "committed"
+	// StateFinishing is set while sources and backups are removed (from here
+	// the restore can't be undone)
+	StateFinishing string = "finishing"
+
+	stageSuffix  string = ".artefactor-stage"
+	backupSuffix string = ".artefactor-backup"
+	tempPrefix   string = ".artefactor-"
+)
+
+// Swap records a target path to replace with a staged copy
+type Swap struct {
+	// Target is the path being restored
+	Target string `json:"target"`
+	// StageDir is where the replacement for Target is prepared
+	StageDir string `json:"stageDir"`
+	// Backup is where Target is kept until the restore has finished
+	Backup string `json:"backup"`
+	// BackedUp is set once Target has been moved to Backup
+	BackedUp bool `json:"backedUp"`
+	// Swapped is set once the staged copy has been moved to Target
+	Swapped bool `json:"swapped"`
+}
+
+// Journal records the progress of a restore so it can be resumed or undone
+// after a failure or crash
+type Journal struct {
+	// File is where the journal is saved
+	File string `json:"-"`
+	// State is one of the State constants
+	State string `json:"state"`
+	// Swaps are the paths being replaced
+	Swaps []*Swap `json:"swaps"`
+	// RemoveSources are the files to remove once the restore has finished
+	// (when moving artefacts)
+	RemoveSources []string `json:"removeSources,omitempty"`
+	// TempDirs are dirs of temporary files (e.g. decrypted artefacts) to remove
+	// once the restore has finished or been undone
+	TempDirs []string `json:"tempDirs,omitempty"`
+}
+
+// New will create and save a journal in the dst directory, failing if a
+// journal from an earlier restore exists
+func New(dst string) (*Journal, error) {
+	j := &Journal{
+		File:  filepath.Join(dst, FileName),
+		State: StateStaging,
+	}
+	if _, err := os.Stat(j.File); err == nil {
+		return nil, fmt.Errorf(
+			"an earlier restore didn't complete (see %s), resume or undo it first",
+			j.File)
+	}
+	if err := os.MkdirAll(dst, 0775); err != nil {
+		return nil, fmt.Errorf("problem creating destination %s:%s", dst, err)
+	}
+	return j, j.Save()
+}
+
+// Load will read the journal from the dst directory (nil if not present)
+func Load(dst string) (*Journal, error) {
+	file := filepath.Join(dst, FileName)
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem reading restore journal %s:%s", file, err)
+	}
+	j := &Journal{File: file}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("invalid restore journal %s:%s", file, err)
+	}
+	return j, nil
+}
+
+// Save will write the journal (atomically)
+func (j *Journal) Save() error {
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := j.File + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, b, 0644); err != nil {
+		return fmt.Errorf("problem saving restore journal %s:%s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, j.File); err != nil {
+		return fmt.Errorf("problem saving restore journal %s:%s", j.File, err)
+	}
+	return nil
+}
+
+// AddSwap will record a target to be replaced and return the path to stage
+// the replacement at (in the same parent dir so it can be renamed)
+func (j *Journal) AddSwap(target string) (string, error) {
+	target = filepath.Clean(target)
+	dir, name := filepath.Split(target)
+	swap := &Swap{
+		Target:   target,
+		StageDir: filepath.Join(dir, "."+name+stageSuffix),
+		Backup:   filepath.Join(dir, "."+name+backupSuffix),
+	}
+	// Anything left here is from an earlier restore
+	for _, path := range []string{swap.StageDir, swap.Backup} {
+		if err := os.RemoveAll(path); err != nil {
+			return "", fmt.Errorf("problem removing %s:%s", path, err)
+		}
+	}
+	j.Swaps = append(j.Swaps, swap)
+	if err := j.Save(); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(swap.StageDir, 0775); err != nil {
+		return "", fmt.Errorf("problem creating staging dir %s:%s", swap.StageDir, err)
+	}
+	return swap.staged(), nil
+}
+
+// AddTempDir will record and create a dir for temporary files next to the
+// journal
+func (j *Journal) AddTempDir(name string) (string, error) {
+	dir := filepath.Join(filepath.Dir(j.File), tempPrefix+name)
+	// Anything left here is from an earlier restore
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("problem removing %s:%s", dir, err)
+	}
+	j.TempDirs = append(j.TempDirs, dir)
+	if err := j.Save(); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("problem creating temporary dir %s:%s", dir, err)
+	}
+	return dir, nil
+}
+
+// AddRemoveSource will record a source file to remove once finished
+func (j *Journal) AddRemoveSource(file string) error {
+	j.RemoveSources = append(j.RemoveSources, file)
+	return j.Save()
+}
+
+// Commit will move all the targets to their backups and the staged copies into
+// place
+func (j *Journal) Commit() error {
+	j.State = StateCommitting
+	if err := j.Save(); err != nil {
+		return err
+	}
+	for _, swap := range j.Swaps {
+		if !swap.BackedUp {
+			_, backupErr := os.Stat(swap.Backup)
+			// The backup may have been made before a crash
+			if _, err := os.Stat(swap.Target); err == nil && os.IsNotExist(backupErr) {
+				log.Printf("moving %s to backup %s", swap.Target, swap.Backup)
+				if err := os.Rename(swap.Target, swap.Backup); err != nil {
+					return fmt.Errorf("problem moving %s to %s:%s", swap.Target, swap.Backup, err)
+				}
+			}
+			swap.BackedUp = true
+			if err := j.Save(); err != nil {
+				return err
+			}
+		}
+		if !swap.Swapped {
+			log.Printf("moving %s to %s", swap.staged(), swap.Target)
+			// The rename may have happened before a crash
+			err := os.Rename(swap.staged(), swap.Target)
+			if err != nil && !moved(swap.staged(), swap.Target) {
+				return fmt.Errorf("problem moving %s to %s:%s", swap.staged(), swap.Target, err)
+			}
+			swap.Swapped = true
+			if err := j.Save(); err != nil {
+				return err
+			}
+		}
+	}
+	j.State = StateCommitted
+	return j.Save()
+}
+
+// Finish will remove any sources (moved artefacts), backups, staging and
+// temporary dirs and finally the journal
+func (j *Journal) Finish() error {
+	j.State = StateFinishing
+	if err := j.Save(); err != nil {
+		return err
+	}
+	for _, file := range j.RemoveSources {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Warning, can't remove moved file %s:%s\n", file, err)
+		}
+	}
+	for _, swap := range j.Swaps {
+		for _, path := range []string{swap.Backup, swap.StageDir} {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("problem removing %s:%s", path, err)
+			}
+		}
+	}
+	if err := j.removeTempDirs(); err != nil {
+		return err
+	}
+	return os.Remove(j.File)
+}
+
+// Rollback will put back the original targets and remove all staged copies
+// (and temporary dirs)
+func (j *Journal) Rollback() error {
+	if j.State == StateFinishing {
+		return fmt.Errorf(
+			"restore has completed and is removing old files, it can only be resumed (%s)",
+			j.File)
+	}
+	for i := len(j.Swaps) - 1; i >= 0; i-- {
+		swap := j.Swaps[i]
+		if swap.Swapped {
+			log.Printf("moving %s back to %s", swap.Target, swap.staged())
+			err := os.Rename(swap.Target, swap.staged())
+			if err != nil && !moved(swap.Target, swap.staged()) {
+				return fmt.Errorf("problem moving %s to %s:%s", swap.Target, swap.staged(), err)
+			}
+			swap.Swapped = false
+			if err := j.Save(); err != nil {
+				return err
+			}
+		}
+		if swap.BackedUp {
+			if _, err := os.Stat(swap.Backup); err == nil {
+				log.Printf("moving backup %s to %s", swap.Backup, swap.Target)
+				if err := os.Rename(swap.Backup, swap.Target); err != nil {
+					return fmt.Errorf("problem moving %s to %s:%s", swap.Backup, swap.Target, err)
+				}
+			}
+			swap.BackedUp = false
+			if err := j.Save(); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(swap.StageDir); err != nil {
+			return fmt.Errorf("problem removing %s:%s", swap.StageDir, err)
+		}
+	}
+	if err := j.removeTempDirs(); err != nil {
+		return err
+	}
+	return os.Remove(j.File)
+}
+
+// removeTempDirs will remove the dirs of temporary files
+func (j *Journal) removeTempDirs() error {
+	for _, dir := range j.TempDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("problem removing %s:%s", dir, err)
+		}
+	}
+	return nil
+}
+
+// moved reports if a rename from src to dst has already happened
+func moved(src string, dst string) bool {
+	_, srcErr := os.Stat(src)
+	_, dstErr := os.Stat(dst)
+	return os.IsNotExist(srcErr) && dstErr == nil
+}
+
+// staged is the path of the replacement for the target
+func (s *Swap) staged() string {
+	return filepath.Join(s.StageDir, filepath.Base(s.Target))
+}
@@ -0,0 +1,126 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stageTarget will create a target with old content and a staged replacement
+// (and a temporary dir)
+func stageTarget(t *testing.T, dst string) (*Journal, string) {
+	target := filepath.Join(dst, "repo")
+	if err := os.MkdirAll(target, 0775); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(target, "file"), "old")
+	j, err := New(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err := j.AddSwap(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(staged, 0775); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(staged, "file"), "new")
+	// e.g. a decrypted artefact the staged file is linked to
+	tmpDir, err := j.AddTempDir("decrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tmpDir, "file"), "new")
+	return j, target
+}
+
+func writeFile(t *testing.T, file string, content string) {
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectContent(t *testing.T, file string, expected string) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("Expecting %q but got %q in %s", expected, string(b), file)
+	}
+}
+
+func expectOnly(t *testing.T, dst string, expected ...string) {
+	files, _ := ioutil.ReadDir(dst)
+	if len(files) != len(expected) {
+		t.Errorf("Expecting only %v in %s but found %d files", expected, dst, len(files))
+	}
+	for _, name := range expected {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("Expecting %s in %s", name, dst)
+		}
+	}
+}
+
+func TestCommitAndFinish(t *testing.T) {
+	dst, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dst)
+	j, target := stageTarget(t, dst)
+
+	if err := j.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, filepath.Join(target, "file"), "new")
+	if err := j.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	expectOnly(t, dst, "repo")
+}
+
+func TestRollback(t *testing.T) {
+	dst, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dst)
+	j, target := stageTarget(t, dst)
+
+	if err := j.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, filepath.Join(target, "file"), "old")
+	expectOnly(t, dst, "repo")
+}
+
+func TestResumeAfterCrash(t *testing.T) {
+	dst, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dst)
+	j, target := stageTarget(t, dst)
+
+	// Crash after both renames but before the journal was updated
+	j.State = StateCommitting
+	if err := j.Save(); err != nil {
+		t.Fatal(err)
+	}
+	swap := j.Swaps[0]
+	os.Rename(target, swap.Backup)
+	os.Rename(swap.staged(), target)
+
+	loaded, err := Load(dst)
+	if err != nil || loaded == nil {
+		t.Fatalf("Expecting a journal in %s:%v", dst, err)
+	}
+	if _, err := New(dst); err == nil {
+		t.Errorf("Expecting an error for a new restore with a journal present")
+	}
+	if err := loaded.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, filepath.Join(target, "file"), "new")
+	expectOnly(t, dst, "repo")
+}
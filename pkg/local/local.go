@@ -0,0 +1,104 @@
+package local
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/tar"
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+const (
+	// DirExt is added to the name of a local dir saved as a tar
+	DirExt string = ".dir.tar"
+
+	tmpExt string = ".tmp"
+)
+
+// SaveFile will copy a local file to the archive dir (unless the copy already
+// there matches)
+func SaveFile(c *hashcache.CheckSumCache, src string, fileName string, dir string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", src)
+	}
+	sha256, err := hashcache.CalcChecksum(src)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, fileName)
+	if c.IsCachedMatched(dst, sha256) {
+		fmt.Printf("file %q in cache and matching checksum %s\n", dst, sha256)
+		c.Keep(dst)
+		return nil
+	}
+	if err := util.Cp(src, dst+tmpExt); err != nil {
+		return fmt.Errorf("problem copying %s:%s", src, err)
+	}
+	if err := util.Mv(dst+tmpExt, dst); err != nil {
+		return err
+	}
+	fmt.Printf("Copied %s to %s\n", src, dst)
+	_, err = c.Update(dst)
+	return err
+}
+
+// SaveDir will tar a local dir to the archive dir with paths relative to the
+// dir (only replacing the tar already there if it has changed)
+func SaveDir(c *hashcache.CheckSumCache, src string, fileName string, dir string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+	// walk is in lexical order so an unchanged dir creates the same tar
+	var paths []string
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		paths = append(paths, relPath)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("problem reading %s:%s", src, err)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("directory %s is empty", src)
+	}
+
+	dst := filepath.Join(dir, fileName)
+	tmpTar := dst + tmpExt
+	if err := tar.CreateFromDir(tmpTar, src, ".", paths); err != nil {
+		os.Remove(tmpTar)
+		return err
+	}
+	sha256, err := hashcache.CalcChecksum(tmpTar)
+	if err != nil {
+		return err
+	}
+	if c.IsCachedMatched(dst, sha256) {
+		log.Printf("removing %s, %s unchanged", tmpTar, dst)
+		fmt.Printf("file %q in cache and matching checksum %s\n", dst, sha256)
+		c.Keep(dst)
+		return os.Remove(tmpTar)
+	}
+	if err := util.Mv(tmpTar, dst); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %s to %s\n", src, dst)
+	_, err = c.Update(dst)
+	return err
+}
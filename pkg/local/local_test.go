@@ -0,0 +1,52 @@
+package local_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+	"github.com/appvia/artefactor/pkg/local"
+	"github.com/appvia/artefactor/pkg/tar"
+	"gotest.tools/assert"
+)
+
+func TestSaveDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_local")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "config")
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(src, "a.yaml"), []byte("a: 1\n"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(src, "sub", "b.yaml"), []byte("b: 2\n"), 0600))
+	saveDir := filepath.Join(tmp, "downloads")
+	assert.NilError(t, os.MkdirAll(saveDir, 0755))
+
+	c, err := hashcache.NewFromDir(saveDir, false)
+	assert.NilError(t, err)
+	fileName := "config" + local.DirExt
+	saved := filepath.Join(saveDir, fileName)
+	assert.NilError(t, local.SaveDir(c, src, fileName, saveDir))
+	sum, err := hashcache.CalcChecksum(saved)
+	assert.NilError(t, err)
+
+	files, err := tar.ReadFiles(saved, func(string) bool { return true })
+	assert.NilError(t, err)
+	assert.Equal(t, string(files["a.yaml"]), "a: 1\n")
+	assert.Equal(t, string(files["sub/b.yaml"]), "b: 2\n")
+
+	// reading the files mustn't change the tar saved again
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, local.SaveDir(c, src, fileName, saveDir))
+	again, err := hashcache.CalcChecksum(saved)
+	assert.NilError(t, err)
+	assert.Equal(t, again, sum)
+	_, err = os.Stat(saved + ".tmp")
+	assert.Assert(t, os.IsNotExist(err))
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(src, "a.yaml"), []byte("a: 3\n"), 0644))
+	assert.NilError(t, local.SaveDir(c, src, fileName, saveDir))
+	assert.Assert(t, !c.IsCachedMatched(saved, sum))
+}
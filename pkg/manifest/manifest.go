@@ -0,0 +1,224 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+)
+
+const (
+	// FileName is the name of the manifest saved with the artefacts
+	FileName string = "manifest.json"
+	// LegacySaveDirFile recorded the archive dir before the manifest
+	LegacySaveDirFile string = "saveDir.meta"
+	// LegacyBinMarkExt marked executable files before the manifest
+	LegacyBinMarkExt string = ".binmark.meta"
+
+	// TypeArtefactor is a copy of the artefactor binary
+	TypeArtefactor string = "artefactor"
+	// TypeGit is a git repo archive (tar or bundle)
+	TypeGit string = "git"
+	// TypeGitBase records the refs of the last git bundle
+	TypeGitBase string = "git-base"
+	// TypeDockerImage is a saved docker image
+	TypeDockerImage string = "docker-image"
+	// TypeWebFile is a downloaded file
+	TypeWebFile string = "web-file"
+	// TypeLocalFile is a copy of a local file
+	TypeLocalFile string = "local-file"
+	// TypeLocalDir is a tar of a local dir
+	TypeLocalDir string = "local-dir"
+)
+
+// Artefact is the meta-data for a saved file
+type Artefact struct {
+	// Name is the file name in the archive dir
+	Name string `json:"name"`
+	// Type is one of the Type constants
+	Type string `json:"type,omitempty"`
+	// Source is where the artefact was saved from e.g. a url or image name
+	Source string `json:"source,omitempty"`
+	// Commit is the commit checked out in a git archive
+	Commit string `json:"commit,omitempty"`
+	// Digest is the image ID of a docker image
+	Digest string `json:"digest,omitempty"`
+	// Layers are the layer IDs of a docker image in order
+	Layers []string `json:"layers,omitempty"`
+	// BaseImage is an image shipped before with the layers left out of a
+	// docker image
+	BaseImage string `json:"baseImage,omitempty"`
+	// BaseLayers is the number of layers left out (shared with BaseImage)
+	BaseLayers int `json:"baseLayers,omitempty"`
+	// Platform is the os_arch a file was saved for (from a templated web file)
+	Platform string `json:"platform,omitempty"`
+	// Mode is the octal file mode to restore with e.g. 0755
+	Mode string `json:"mode,omitempty"`
+	// Owner is an optional user[:group] to restore with
+	Owner string `json:"owner,omitempty"`
+	// Target is the path to restore to relative to the archive dir (defaults
+	// to Name)
+	Target string `json:"target,omitempty"`
+	// Extract is a dir (relative to the archive dir) to extract an archive to
+	// when restored
+	Extract string `json:"extract,omitempty"`
+	// StripComponents is the number of leading path elements removed when
+	// extracting
+	StripComponents int `json:"stripComponents,omitempty"`
+	// ExtractKeep are patterns of the archive members to extract (all when
+	// empty)
+	ExtractKeep []string `json:"extractKeep,omitempty"`
+	// Encrypted is set when the artefact is saved encrypted (the checksum file
+	// has the checksum of the encrypted file)
+	Encrypted bool `json:"encrypted,omitempty"`
+	// PlainSha256 is the checksum of an encrypted artefact once decrypted
+	PlainSha256 string `json:"plainSha256,omitempty"`
+	// Unchanged is set when an artefact is left out of a delta bundle as it
+	// was shipped with the previous bundle
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// Manifest records the meta-data for all the artefacts saved
+type Manifest struct {
+	// SaveDir is the archive dir relative to the home repo
+	SaveDir string `json:"saveDir"`
+	// Since is the checksum of the checksum file a delta bundle was saved
+	// against
+	Since string `json:"since,omitempty"`
+	// Artefacts are all the files saved
+	Artefacts []*Artefact `json:"artefacts"`
+}
+
+// New creates an empty manifest for an archive dir
+func New(saveDir string) *Manifest {
+	return &Manifest{SaveDir: filepath.Clean(saveDir)}
+}
+
+// Add will record an artefact (replacing any with the same file name)
+func (m *Manifest) Add(file string, artefactType string, source string, mode os.FileMode) *Artefact {
+	a := &Artefact{
+		Name:   filepath.Base(file),
+		Type:   artefactType,
+		Source: source,
+		Mode:   fmt.Sprintf("%04o", mode.Perm()),
+	}
+	for i, existing := range m.Artefacts {
+		if existing.Name == a.Name {
+			m.Artefacts[i] = a
+			return a
+		}
+	}
+	m.Artefacts = append(m.Artefacts, a)
+	return a
+}
+
+// Copy will return a copy of the manifest that can be changed for a bundle
+func (m *Manifest) Copy() *Manifest {
+	copied := *m
+	copied.Artefacts = make([]*Artefact, 0, len(m.Artefacts))
+	for _, a := range m.Artefacts {
+		artefact := *a
+		copied.Artefacts = append(copied.Artefacts, &artefact)
+	}
+	return &copied
+}
+
+// Get will return the meta-data for a file name (nil if not recorded)
+func (m *Manifest) Get(name string) *Artefact {
+	for _, a := range m.Artefacts {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// Save will write the manifest with the checksum file (the archive dir or a
+// bundle dir) and record its checksum
+func (m *Manifest) Save(c *hashcache.CheckSumCache) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(c.Dir, FileName)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		return fmt.Errorf("problem saving manifest %s:%s", file, err)
+	}
+	_, err = c.Update(file)
+	return err
+}
+
+// Load will read the manifest from a directory of artefacts, falling back to
+// the meta-data files saved by earlier versions
+func Load(dir string) (*Manifest, error) {
+	file := filepath.Join(dir, FileName)
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return loadLegacy(dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem reading manifest %s:%s", file, err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s:%s", file, err)
+	}
+	return m, nil
+}
+
+// loadLegacy will create a manifest from a saveDir.meta file and binmark files
+func loadLegacy(dir string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, LegacySaveDirFile))
+	if err != nil {
+		return nil, fmt.Errorf("no %s or %s found in %s", FileName, LegacySaveDirFile, dir)
+	}
+	m := New(string(b))
+	binMarks, err := filepath.Glob(filepath.Join(dir, "*"+LegacyBinMarkExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, binMark := range binMarks {
+		m.Artefacts = append(m.Artefacts, &Artefact{
+			Name: strings.TrimSuffix(filepath.Base(binMark), LegacyBinMarkExt),
+			Mode: "0755",
+		})
+	}
+	return m, nil
+}
+
+// Unchanged will list the artefacts left out of a delta bundle
+func (m *Manifest) Unchanged() []*Artefact {
+	var unchanged []*Artefact
+	for _, a := range m.Artefacts {
+		if a.Unchanged {
+			unchanged = append(unchanged, a)
+		}
+	}
+	return unchanged
+}
+
+// FileMode will return the mode to restore with (false if not recorded)
+func (a *Artefact) FileMode() (os.FileMode, bool, error) {
+	if a == nil || len(a.Mode) == 0 {
+		return 0, false, nil
+	}
+	mode, err := strconv.ParseUint(a.Mode, 8, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid mode %q for %s:%s", a.Mode, a.Name, err)
+	}
+	return os.FileMode(mode).Perm(), true, nil
+}
+
+// TargetPath will return where to restore an artefact relative to the archive
+// dir
+func (a *Artefact) TargetPath(name string) string {
+	if a == nil || len(a.Target) == 0 {
+		return name
+	}
+	return filepath.Clean(a.Target)
+}
@@ -0,0 +1,62 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appvia/artefactor/pkg/hashcache"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "manifest")
+	defer os.RemoveAll(dir)
+	c, err := hashcache.NewFromDir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(dir)
+	m.Add(filepath.Join(dir, "kubectl"), TypeWebFile, "https://example.com/kubectl", 0755)
+	a := m.Add("kubectl", TypeWebFile, "https://example.com/kubectl", 0700)
+	a.Target = "../bin/kubectl"
+	if err := m.Save(c); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Artefacts) != 1 {
+		t.Fatalf("Expecting 1 artefact but got %d", len(loaded.Artefacts))
+	}
+	mode, ok, err := loaded.Get("kubectl").FileMode()
+	if err != nil || !ok || mode != 0700 {
+		t.Errorf("Expecting mode 0700 but got %04o (%v, %v)", mode, ok, err)
+	}
+	if target := loaded.Get("kubectl").TargetPath("kubectl"); target != "../bin/kubectl" {
+		t.Errorf("Expecting target ../bin/kubectl but got %s", target)
+	}
+	if target := loaded.Get("missing").TargetPath("missing"); target != "missing" {
+		t.Errorf("Expecting the default target for a missing artefact but got %s", target)
+	}
+}
+
+func TestLoadLegacy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "manifest")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, LegacySaveDirFile), []byte("downloads"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "artefactor"+LegacyBinMarkExt), nil, 0644)
+
+	m, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SaveDir != "downloads" {
+		t.Errorf("Expecting save dir downloads but got %s", m.SaveDir)
+	}
+	if mode, ok, _ := m.Get("artefactor").FileMode(); !ok || mode != 0755 {
+		t.Errorf("Expecting mode 0755 for a binmark file but got %04o", mode)
+	}
+}
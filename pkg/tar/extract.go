@@ -0,0 +1,406 @@
+package tar
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appvia/artefactor/pkg/util"
+)
+
+// archiveExts are the archive formats that can be extracted
+var archiveExts = []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".txz", ".zip"}
+
+// Options limit what is extracted from an archive
+type Options struct {
+	// StripComponents is the number of leading path elements to remove
+	StripComponents int
+	// Keep are patterns (see path.Match) of the paths to extract (after
+	// stripping), matching a path or any of its parent dirs (all when empty)
+	Keep []string
+	// legacyLinks extracts hard links as symlinks (as saved by earlier versions
+	// of artefactor)
+	legacyLinks bool
+}
+
+// Extract a tar file to the dst directory
+func Extract(tarFn string, dst string) error {
+	log.Printf("Opening tar %s", tarFn)
+	tarFile, err := os.Open(tarFn)
+	if err != nil {
+		return err
+	}
+	defer tarFile.Close()
+	_, err = extractTar(tarFile, dst, Options{legacyLinks: true})
+	return err
+}
+
+// IsArchive will detect a file that can be extracted from its name
+func IsArchive(file string) bool {
+	return len(archiveExt(file)) > 0
+}
+
+// ExtractArchive will extract a tar (optionally gzip or xz compressed) or zip
+// file to the dst directory
+func ExtractArchive(file string, dst string, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0775); err != nil {
+		return err
+	}
+	var count int
+	var err error
+	switch archiveExt(file) {
+	case ".zip":
+		count, err = extractZip(file, dst, opts)
+	case ".tar.gz", ".tgz":
+		count, err = extractFile(file, func(f *os.File) (int, error) {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return 0, err
+			}
+			defer gz.Close()
+			return extractTar(gz, dst, opts)
+		})
+	case ".tar.xz", ".txz":
+		count, err = extractXz(file, dst, opts)
+	case ".tar":
+		count, err = extractFile(file, func(f *os.File) (int, error) {
+			return extractTar(f, dst, opts)
+		})
+	default:
+		return fmt.Errorf("can't extract %s, expecting one of %s", file, strings.Join(archiveExts, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("problem extracting %s:%s", file, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("nothing extracted from %s (keeping %s)", file, strings.Join(opts.Keep, ", "))
+	}
+	return nil
+}
+
+// Validate will check the keep patterns
+func (o Options) Validate() error {
+	if o.StripComponents < 0 {
+		return fmt.Errorf("invalid strip components %d", o.StripComponents)
+	}
+	for _, pattern := range o.Keep {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q:%s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// name will return the path to extract an archive member to ("" to skip it)
+func (o Options) name(member string) string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(member), "/") {
+		if len(part) > 0 && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) <= o.StripComponents {
+		return ""
+	}
+	parts = parts[o.StripComponents:]
+	if len(o.Keep) == 0 {
+		return strings.Join(parts, "/")
+	}
+	for i := range parts {
+		candidate := strings.Join(parts[:i+1], "/")
+		for _, pattern := range o.Keep {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return strings.Join(parts, "/")
+			}
+		}
+	}
+	return ""
+}
+
+func archiveExt(file string) string {
+	name := strings.ToLower(file)
+	ext := ""
+	for _, archiveExt := range archiveExts {
+		// the longest match e.g. .tar.gz not .gz
+		if strings.HasSuffix(name, archiveExt) && len(archiveExt) > len(ext) {
+			ext = archiveExt
+		}
+	}
+	return ext
+}
+
+func extractFile(file string, extract func(*os.File) (int, error)) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return extract(f)
+}
+
+// extractXz will decompress with the xz command (there's no xz in the standard
+// library)
+func extractXz(file string, dst string, opts Options) (int, error) {
+	cmd := exec.Command("xz", "-dc", file)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("xz is required to extract %s:%s", file, err)
+	}
+	count, err := extractTar(stdout, dst, opts)
+	if err != nil {
+		// stop xz writing to a pipe no one is reading
+		io.Copy(ioutil.Discard, stdout)
+	}
+	if waitErr := cmd.Wait(); waitErr != nil && err == nil {
+		err = fmt.Errorf("xz failed:%s %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	return count, err
+}
+
+// extractTar will extract the members of a tar to dst, refusing any paths
+// outside dst or through links
+func extractTar(r io.Reader, dst string, opts Options) (int, error) {
+	count := 0
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		switch {
+		// if no more files are found return
+		case err == io.EOF:
+			return count, nil
+		// return any other error
+		case err != nil:
+			return count, err
+		// if the header is nil, just skip it (not sure how this happens)
+		case header == nil:
+			continue
+		}
+		name := opts.name(header.Name)
+		if len(name) == 0 {
+			log.Printf("skipping %s", header.Name)
+			continue
+		}
+		// the target location where the dir/file should be created
+		target, err := safePath(dst, name)
+		if err != nil {
+			return count, err
+		}
+		log.Printf("Creating %s", target)
+
+		// check the file type
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirAll(dst, target); err != nil {
+				return count, err
+			}
+
+		case tar.TypeSymlink:
+			if err := symlink(dst, target, header.Linkname); err != nil {
+				return count, err
+			}
+
+		case tar.TypeLink:
+			if opts.legacyLinks {
+				// earlier versions saved symlinks as hard links
+				if err := symlink(dst, target, header.Linkname); err != nil {
+					return count, err
+				}
+				break
+			}
+			// a hard link to a member already extracted (relative to the
+			// archive root)
+			linkName := opts.name(header.Linkname)
+			if len(linkName) == 0 {
+				log.Printf("skipping %s, linked to %s which isn't extracted", header.Name, header.Linkname)
+				continue
+			}
+			linked, err := safePath(dst, linkName)
+			if err != nil {
+				return count, err
+			}
+			if fi, err := os.Lstat(linked); err != nil || !fi.Mode().IsRegular() {
+				return count, fmt.Errorf("can't link %s to %s, it isn't an extracted file", header.Name, header.Linkname)
+			}
+			if err := replace(dst, target, func() error { return os.Link(linked, target) }); err != nil {
+				return count, err
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(dst, target, tr, os.FileMode(header.Mode).Perm()); err != nil {
+				return count, err
+			}
+
+		default:
+			log.Printf("skipping %s of type %c", header.Name, header.Typeflag)
+			continue
+		}
+		count++
+	}
+}
+
+// extractZip will extract the members of a zip to dst, refusing any paths
+// outside dst or through links
+func extractZip(file string, dst string, opts Options) (int, error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	count := 0
+	for _, f := range zr.File {
+		name := opts.name(f.Name)
+		if len(name) == 0 {
+			log.Printf("skipping %s", f.Name)
+			continue
+		}
+		target, err := safePath(dst, name)
+		if err != nil {
+			return count, err
+		}
+		log.Printf("Creating %s", target)
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = mkdirAll(dst, target)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipLink(dst, target, f)
+		default:
+			err = extractZipFile(dst, target, f)
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func extractZipFile(dst string, target string, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	mode := f.Mode().Perm()
+	if mode == 0 {
+		// zips created without unix permissions
+		mode = 0644
+	}
+	return writeFile(dst, target, r, mode)
+}
+
+func extractZipLink(dst string, target string, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return symlink(dst, target, string(b))
+}
+
+// safePath will return the path for an archive member within dst
+func safePath(dst string, name string) (string, error) {
+	target := filepath.Join(dst, filepath.FromSlash(name))
+	if filepath.IsAbs(filepath.FromSlash(name)) || isOutside(dst, target) {
+		return "", fmt.Errorf("illegal path %q in archive (outside %s)", name, dst)
+	}
+	return target, nil
+}
+
+func isOutside(dst string, target string) bool {
+	rel, err := filepath.Rel(dst, target)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkParents will refuse to create anything through a link within dst (an
+// archive could link a dir outside dst before adding files to it)
+func checkParents(dst string, target string) error {
+	rel, err := filepath.Rel(dst, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("can't extract %s through link %s", target, dir)
+		}
+	}
+	return nil
+}
+
+func mkdirAll(dst string, dir string) error {
+	if err := checkParents(dst, dir); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("can't extract %s through link", dir)
+	}
+	return os.MkdirAll(dir, 0775)
+}
+
+// replace will create a file or link (and any parent dirs), removing anything
+// already at the target so a link isn't written through
+func replace(dst string, target string, create func() error) error {
+	if err := mkdirAll(dst, filepath.Dir(target)); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(target); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("can't extract %s, it is a directory", target)
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return create()
+}
+
+func symlink(dst string, target string, linkname string) error {
+	log.Printf("file name: %s links to %s", target, linkname)
+	// Destination may not exist until all of tar is extracted
+	return replace(dst, target, func() error { return util.SymLink(target, linkname) })
+}
+
+func writeFile(dst string, target string, r io.Reader, mode os.FileMode) error {
+	return replace(dst, target, func() error {
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		// copy over contents
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
@@ -0,0 +1,199 @@
+package tar_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	artefactortar "github.com/appvia/artefactor/pkg/tar"
+	"gotest.tools/assert"
+)
+
+type member struct {
+	name     string
+	content  string
+	linkname string
+}
+
+func writeTgz(t *testing.T, file string, members ...member) {
+	f, err := os.Create(file)
+	assert.NilError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+	for _, m := range members {
+		header := &tar.Header{Name: m.name, Mode: 0755, Size: int64(len(m.content)), Typeflag: tar.TypeReg}
+		if len(m.linkname) > 0 {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = m.linkname
+		}
+		assert.NilError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(m.content))
+		assert.NilError(t, err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_tar")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+
+	tgz := filepath.Join(tmp, "helm.tgz")
+	writeTgz(t, tgz,
+		member{name: "linux-amd64/helm", content: "helm"},
+		member{name: "linux-amd64/LICENSE", content: "licence"},
+		member{name: "linux-amd64/docs/README.md", content: "docs"})
+	dst := filepath.Join(tmp, "bin")
+	assert.NilError(t, artefactortar.ExtractArchive(tgz, dst, artefactortar.Options{
+		StripComponents: 1,
+		Keep:            []string{"helm", "docs"},
+	}))
+	b, err := ioutil.ReadFile(filepath.Join(dst, "helm"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "helm")
+	_, err = os.Stat(filepath.Join(dst, "docs", "README.md"))
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(dst, "LICENSE"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	err = artefactortar.ExtractArchive(tgz, dst, artefactortar.Options{Keep: []string{"missing"}})
+	assert.ErrorContains(t, err, "nothing extracted")
+
+	zipFile := filepath.Join(tmp, "terraform.zip")
+	f, err := os.Create(zipFile)
+	assert.NilError(t, err)
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("terraform")
+	assert.NilError(t, err)
+	w.Write([]byte("terraform"))
+	assert.NilError(t, zw.Close())
+	assert.NilError(t, f.Close())
+	assert.NilError(t, artefactortar.ExtractArchive(zipFile, dst, artefactortar.Options{}))
+	b, err = ioutil.ReadFile(filepath.Join(dst, "terraform"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "terraform")
+}
+
+func TestExtractArchiveOutsideDst(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_tar")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "dst")
+	outside := filepath.Join(tmp, "outside")
+	assert.NilError(t, os.MkdirAll(outside, 0755))
+
+	traversal := filepath.Join(tmp, "traversal.tgz")
+	writeTgz(t, traversal, member{name: "a/../../outside/evil", content: "evil"})
+	err = artefactortar.ExtractArchive(traversal, dst, artefactortar.Options{})
+	assert.ErrorContains(t, err, "illegal path")
+
+	// a link to a dir outside dst then a file written through it
+	throughLink := filepath.Join(tmp, "link.tgz")
+	writeTgz(t, throughLink,
+		member{name: "escape", linkname: outside},
+		member{name: "escape/evil", content: "evil"})
+	err = artefactortar.ExtractArchive(throughLink, dst, artefactortar.Options{})
+	assert.ErrorContains(t, err, "through link")
+
+	_, err = os.Stat(filepath.Join(outside, "evil"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestCreateExtractLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_tar")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(src, "file"), []byte("root"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(src, "bin", "file"), []byte("bin"), 0644))
+	assert.NilError(t, os.Symlink("file", filepath.Join(src, "link")))
+	assert.NilError(t, os.Symlink("file", filepath.Join(src, "bin", "link")))
+	assert.NilError(t, os.Symlink("../file", filepath.Join(src, "bin", "up")))
+
+	tarFile := filepath.Join(tmp, "links.tar")
+	// no prefix (as for local dirs) so a link could be confused with a member
+	assert.NilError(t, artefactortar.CreateFromDir(tarFile, src, ".",
+		[]string{"file", "bin", "bin/file", "link", "bin/link", "bin/up"}))
+	dst := filepath.Join(tmp, "dst")
+	assert.NilError(t, artefactortar.Extract(tarFile, dst))
+
+	for link, expected := range map[string]struct{ linkname, content string }{
+		"link":     {"file", "root"},
+		"bin/link": {"file", "bin"},
+		"bin/up":   {"../file", "root"},
+	} {
+		linkname, err := os.Readlink(filepath.Join(dst, link))
+		assert.NilError(t, err, link)
+		assert.Equal(t, linkname, expected.linkname)
+		b, err := ioutil.ReadFile(filepath.Join(dst, link))
+		assert.NilError(t, err, link)
+		assert.Equal(t, string(b), expected.content, link)
+	}
+}
+
+func TestExtractLegacyLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_tar")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+
+	// earlier versions saved symlinks as hard links relative to the link
+	tarFile := filepath.Join(tmp, "legacy.tar")
+	f, err := os.Create(tarFile)
+	assert.NilError(t, err)
+	tw := tar.NewWriter(f)
+	for _, header := range []*tar.Header{
+		{Name: "repo/bin/file", Mode: 0644, Size: 3, Typeflag: tar.TypeReg},
+		{Name: "repo/bin/link", Linkname: "file", Typeflag: tar.TypeLink},
+	} {
+		assert.NilError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("bin"))
+			assert.NilError(t, err)
+		}
+	}
+	assert.NilError(t, tw.Close())
+	assert.NilError(t, f.Close())
+
+	dst := filepath.Join(tmp, "dst")
+	assert.NilError(t, artefactortar.Extract(tarFile, dst))
+	linkname, err := os.Readlink(filepath.Join(dst, "repo", "bin", "link"))
+	assert.NilError(t, err)
+	assert.Equal(t, linkname, "file")
+	b, err := ioutil.ReadFile(filepath.Join(dst, "repo", "bin", "link"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "bin")
+}
+
+func TestExtractArchiveHardLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artefactor_tar")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmp)
+
+	// hard links in other archives are relative to the archive root
+	tarFile := filepath.Join(tmp, "tool.tar")
+	f, err := os.Create(tarFile)
+	assert.NilError(t, err)
+	tw := tar.NewWriter(f)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "tool/bin/tool", Mode: 0755, Size: 4, Typeflag: tar.TypeReg}))
+	_, err = tw.Write([]byte("tool"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "tool/sbin/tool", Linkname: "tool/bin/tool", Typeflag: tar.TypeLink}))
+	assert.NilError(t, tw.Close())
+	assert.NilError(t, f.Close())
+
+	dst := filepath.Join(tmp, "dst")
+	assert.NilError(t, artefactortar.ExtractArchive(tarFile, dst, artefactortar.Options{StripComponents: 1}))
+	fi, err := os.Lstat(filepath.Join(dst, "sbin", "tool"))
+	assert.NilError(t, err)
+	assert.Assert(t, fi.Mode().IsRegular())
+	b, err := ioutil.ReadFile(filepath.Join(dst, "sbin", "tool"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "tool")
+}
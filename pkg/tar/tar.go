@@ -5,151 +5,66 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-
-	"github.com/appvia/artefactor/pkg/util"
 )
 
-// Create a tar file from file name and array of paths and files to add
-func Create(tarFn string, paths []string) error {
+// Files are paths relative to a directory to add to an archive
+type Files struct {
+	Dir   string
+	Paths []string
+}
 
-	// ensure the src actually exists before trying to tar it
-	if len(paths) < 1 {
-		return fmt.Errorf("must supply at least one path to archive")
-	}
-	// Find the first file and use it's directory as the wd
-	src, err := filepath.Abs(paths[0])
-	if err != nil {
-		return err
+// CreateFromDir creates a tar file from paths relative to dir, adding all
+// files under the prefix directory name
+func CreateFromDir(tarFn string, dir string, prefix string, paths []string) error {
+	return CreateFromDirs(tarFn, prefix, Files{Dir: dir, Paths: paths})
+}
+
+// CreateFromDirs creates a tar file from files in one or more directories,
+// adding all files under the prefix directory name
+func CreateFromDirs(tarFn string, prefix string, files ...Files) error {
+	count := 0
+	for _, f := range files {
+		count += len(f.Paths)
 	}
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return fmt.Errorf("unable to tar files %v", err.Error())
+	if count < 1 {
+		return fmt.Errorf("must supply at least one path to archive")
 	}
-	// create tar file
 	tarfile, err := os.Create(tarFn)
 	if err != nil {
 		return fmt.Errorf("unable to create tar file %v due to %v", tarFn, err)
 	}
-
 	defer tarfile.Close()
-	var fw io.WriteCloser = tarfile
-	tw := tar.NewWriter(fw)
+	tw := tar.NewWriter(tarfile)
 	defer tw.Close()
 
-	// keep track of tar's relative working dir
-	var wd string
-	if srcInfo.Mode().IsDir() {
-		// Add the prefix for the whole repo...
-		log.Printf("prefix = %s", srcInfo.Name())
-		wd = srcInfo.Name()
-	} else {
-		wd = filepath.Base(filepath.Dir(src))
-	}
-	log.Printf("adding prefix from directoy name: %s", wd)
-
-	// add all the files to the archive
-	for _, path := range paths {
-		if err := addFile(tw, wd, path); err != nil {
-			return fmt.Errorf(
-				"problem tryig to add %s to archive %s",
-				path,
-				tarFn)
-		}
-	}
-	return nil
-}
-
-// Extract a tar file to the dst directory
-func Extract(tarFn string, dst string) error {
-
-	log.Printf("Opening tar %s", tarFn)
-	tarFile, err := os.Open(tarFn)
-	if err != nil {
-		return err
-	}
-	tr := tar.NewReader(tarFile)
-	for {
-		header, err := tr.Next()
-
-		switch {
-		// if no more files are found return
-		case err == io.EOF:
-			return nil
-		// return any other error
-		case err != nil:
-			return err
-		// if the header is nil, just skip it (not sure how this happens)
-		case header == nil:
-			continue
-		}
-
-		// the target location where the dir/file should be created
-		target := filepath.Join(dst, header.Name)
-		log.Printf("Creating %s", target)
-
-		// check the file type
-		switch header.Typeflag {
-
-		// if its a dir and it doesn't exist create it
-		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0775); err != nil {
-					return err
-				}
-			}
-
-		case tar.TypeLink:
-			dir := filepath.Dir(target)
-			dest := header.Linkname
-			log.Printf("link dir %s file name: %s links to %s", dir, target, dest)
-			// Check the path exists first
-			if _, err := os.Stat(dir); err != nil {
-				if err := os.MkdirAll(dir, 0775); err != nil {
-					return err
-				}
-			}
-			// Destination may not exist until all of tar is extracted
-			// os.Symlink cannot create symlink when destination doesn't exists!!!???
-			if err := util.SymLink(target, dest); err != nil {
-				return err
-			}
-
-		// if it's a file create it
-		case tar.TypeReg:
-			dir := filepath.Dir(target)
-			// Check the path exists first
-			if _, err := os.Stat(dir); err != nil {
-				if err := os.MkdirAll(dir, 0775); err != nil {
-					return err
-				}
-			}
-			tarFile, err := os.OpenFile(
-				target,
-				os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-			defer tarFile.Close()
-
-			// copy over contents
-			if _, err := io.Copy(tarFile, tr); err != nil {
-				return err
+	for _, f := range files {
+		for _, path := range f.Paths {
+			if err := addFile(tw, f.Dir, prefix, path); err != nil {
+				return fmt.Errorf(
+					"problem trying to add %s to archive %s:%s",
+					path,
+					tarFn,
+					err)
 			}
 		}
 	}
+	return nil
 }
 
-// addFile to an archive using a tar.Writer
+// addFile to an archive using a tar.Writer, path is relative to dir (if set)
 func addFile(
 	tw *tar.Writer,
+	dir string,
 	prefix string,
 	path string) error {
 
+	srcPath := filepath.Join(dir, path)
 	// Ensure path exists
-	fi, err := os.Lstat(path)
+	fi, err := os.Lstat(srcPath)
 	if err != nil {
 		return err
 	}
@@ -157,11 +72,13 @@ func addFile(
 	if err != nil {
 		return err
 	}
-	if len(header.Linkname) > 0 {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		// the link is saved as is (relative to the link's directory)
+		header.Typeflag = tar.TypeSymlink
+		if header.Linkname, err = os.Readlink(srcPath); err != nil {
+			return err
+		}
 		log.Printf("adding link:%s to %s", header.Linkname, header.Name)
-		header.Typeflag = tar.TypeLink
-		// Link name isn't right - let's make sure it contains the path
-		header.Linkname, _ = os.Readlink(path)
 	}
 	// update the name to correctly reflect the desired destination when untaring
 	if len(prefix) > 0 {
@@ -178,11 +95,11 @@ func addFile(
 	}
 
 	// open files for taring
-	srcFile, err := os.Open(path)
-	defer srcFile.Close()
+	srcFile, err := os.Open(srcPath)
 	if err != nil {
 		return err
 	}
+	defer srcFile.Close()
 
 	// copy file data into tar writer
 	if _, err := io.Copy(tw, srcFile); err != nil {
@@ -193,3 +110,32 @@ func addFile(
 
 	return nil
 }
+
+// ReadFiles will return the content of the files in a tar for which match
+// returns true (keyed by the name in the tar)
+func ReadFiles(tarFn string, match func(name string) bool) (map[string][]byte, error) {
+	tarFile, err := os.Open(tarFn)
+	if err != nil {
+		return nil, err
+	}
+	defer tarFile.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(tarFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("problem reading tar %s:%s", tarFn, err)
+		}
+		if header.Typeflag != tar.TypeReg || !match(header.Name) {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading %s from tar %s:%s", header.Name, tarFn, err)
+		}
+		files[header.Name] = b
+	}
+}
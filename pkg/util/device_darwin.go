@@ -0,0 +1,52 @@
+//go:build darwin
+// +build darwin
+
+package util
+
+import (
+	"strings"
+	"syscall"
+)
+
+const (
+	// mntRdOnly is the statfs flag for a read-only mount
+	mntRdOnly = 0x1
+	// mntRemovable is the statfs flag for a mount on removable media
+	mntRemovable = 0x200
+	// mntLocal is the statfs flag for a local file system
+	mntLocal = 0x1000
+)
+
+// IsRemovable will report if a path is on a removable device e.g. a USB stick
+func IsRemovable(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	if st.Flags&mntRemovable != 0 {
+		return true, nil
+	}
+	// External drives are mounted under /Volumes
+	mount := string(int8ToBytes(st.Mntonname[:]))
+	return st.Flags&mntLocal != 0 && strings.HasPrefix(mount, "/Volumes/"), nil
+}
+
+// IsReadOnly will report if a path is on a read-only file system
+func IsReadOnly(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	return st.Flags&mntRdOnly != 0, nil
+}
+
+func int8ToBytes(chars []int8) []byte {
+	b := make([]byte, 0, len(chars))
+	for _, c := range chars {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return b
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// stRdOnly is the statfs flag for a read-only mount
+const stRdOnly = 0x1
+
+// IsRemovable will report if a path is on a removable device e.g. a USB stick
+func IsRemovable(path string) (bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, err
+	}
+	dev := uint64(st.Dev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+	sysDir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		// Not a block device (e.g. tmpfs or a network file system)
+		return false, nil
+	}
+	// Some USB drives don't report as removable
+	if strings.Contains(sysDir, "/usb") {
+		return true, nil
+	}
+	// Partitions don't have a removable flag, their parent disk does
+	for _, dir := range []string{sysDir, filepath.Dir(sysDir)} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "removable"))
+		if err == nil {
+			return strings.TrimSpace(string(b)) == "1", nil
+		}
+	}
+	return false, nil
+}
+
+// IsReadOnly will report if a path is on a read-only file system
+func IsReadOnly(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	return st.Flags&stRdOnly != 0, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package util
+
+// IsRemovable isn't supported on this platform so always reports false
+func IsRemovable(path string) (bool, error) {
+	return false, nil
+}
+
+// IsReadOnly isn't supported on this platform so always reports false
+func IsReadOnly(path string) (bool, error) {
+	return false, nil
+}
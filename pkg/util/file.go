@@ -6,8 +6,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
-
-	"github.com/appvia/artefactor/pkg/hashcache"
+	"path/filepath"
 )
 
 // Cp copies a file
@@ -19,7 +18,7 @@ func Cp(src string, dst string) error {
 	defer from.Close()
 	fi, _ := from.Stat()
 
-	to, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, fi.Mode().Perm())
+	to, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
 	if err != nil {
 		return err
 	}
@@ -32,6 +31,55 @@ func Cp(src string, dst string) error {
 	return nil
 }
 
+// CpDir copies a directory tree of files
+func CpDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0775)
+		}
+		return Cp(path, target)
+	})
+}
+
+// Link will hard link a file (or copy it when it can't be linked e.g. on a
+// different device), replacing dst so nothing linked to it is changed
+func Link(src string, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err != nil {
+		log.Printf("can't link %s to %s, copying:%s", src, dst, err)
+		return Cp(src, dst)
+	}
+	return nil
+}
+
+// LinkDir will hard link (or copy) a directory tree of files
+func LinkDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0775)
+		}
+		return Link(path, target)
+	})
+}
+
 // Mv wraps the os.rename and will copy on error
 func Mv(src string, dst string) error {
 	if err := os.Rename(src, dst); err != nil {
@@ -55,14 +103,6 @@ func Mv(src string, dst string) error {
 	return nil
 }
 
-// BinMark marks a file as binary and update meta data checksum
-func BinMark(c *hashcache.CheckSumCache, download string) error {
-	binMark := download + ".binmark.meta"
-	os.Create(binMark)
-	_, err := c.Update(binMark)
-	return err
-}
-
 // SymLink can create links even when golang cannot
 func SymLink(linkFile, destination string) error {
 	cmd := exec.Command("ln", "-s", destination, linkFile)
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Chown will set the owner of a file from a user name or id with an optional
+// group e.g. user:group
+func Chown(file string, owner string) error {
+	parts := strings.SplitN(owner, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		if u, err = user.LookupId(parts[0]); err != nil {
+			return fmt.Errorf("unknown user %s:%s", parts[0], err)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("can't set owner %s on this platform", owner)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("can't set owner %s on this platform", owner)
+	}
+	if len(parts) == 2 && len(parts[1]) > 0 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			if g, err = user.LookupGroupId(parts[1]); err != nil {
+				return fmt.Errorf("unknown group %s:%s", parts[1], err)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("can't set owner %s on this platform", owner)
+		}
+	}
+	return os.Lchown(file, uid, gid)
+}
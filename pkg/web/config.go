@@ -0,0 +1,352 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cavaliercoder/grab"
+)
+
+const (
+	// secretFilePrefix reads a header value from a file
+	secretFilePrefix string = "file:"
+	// secretEnvPrefix reads a header value from an environment variable
+	secretEnvPrefix string = "env:"
+	// maxRedirects is how many redirects are followed (as the go default)
+	maxRedirects int = 10
+)
+
+// Config is how to authenticate with and connect to the hosts web files are
+// downloaded from. Secrets are only ever read from files or the environment
+type Config struct {
+	// Hosts are the settings for each host (the first match is used)
+	Hosts []*HostConfig `json:"hosts"`
+	// Netrc is a netrc file with credentials for hosts without any configured
+	// (defaults to $NETRC or ~/.netrc when it exists)
+	Netrc string `json:"netrc,omitempty"`
+
+	netrc []netrcMachine
+}
+
+// HostConfig is the auth and TLS settings for a host
+type HostConfig struct {
+	// Host is a host name (with an optional port), *.domain or * for any host
+	Host string `json:"host"`
+	// BearerTokenFile is a file with a bearer token
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+	// BearerTokenEnv is an environment variable with a bearer token
+	BearerTokenEnv string `json:"bearerTokenEnv,omitempty"`
+	// Username is the user for basic auth
+	Username string `json:"username,omitempty"`
+	// PasswordFile is a file with the basic auth password
+	PasswordFile string `json:"passwordFile,omitempty"`
+	// PasswordEnv is an environment variable with the basic auth password
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+	// Headers are extra request headers, values starting file: or env: are
+	// read from a file or environment variable
+	Headers map[string]string `json:"headers,omitempty"`
+	// CAFile is a PEM bundle of extra CAs to trust e.g. for a TLS
+	// intercepting proxy
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile is a PEM client certificate (requires KeyFile)
+	CertFile string `json:"certFile,omitempty"`
+	// KeyFile is the PEM key for the client certificate
+	KeyFile string `json:"keyFile,omitempty"`
+
+	token    string
+	password string
+	headers  map[string]string
+	client   *grab.Client
+}
+
+// netrcMachine is the login for a host from a netrc file ("" for default)
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+// LoadConfig will read a JSON config file and the secrets and certificates it
+// refers to
+func LoadConfig(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading web config %s:%s", file, err)
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("invalid web config %s:%s", file, err)
+	}
+	if err := cfg.load(); err != nil {
+		return nil, fmt.Errorf("invalid web config %s:%s", file, err)
+	}
+	return cfg, nil
+}
+
+// load will read all the secrets and certificates so any problem is found
+// before downloading
+func (cfg *Config) load() error {
+	for _, h := range cfg.Hosts {
+		if err := h.load(); err != nil {
+			return err
+		}
+		if h.client != nil {
+			h.client.HTTPClient.CheckRedirect = cfg.checkRedirect
+		}
+	}
+	netrc := cfg.Netrc
+	if len(netrc) == 0 {
+		netrc = defaultNetrc()
+		if _, err := os.Stat(netrc); err != nil {
+			return nil
+		}
+	}
+	var err error
+	if cfg.netrc, err = readNetrc(netrc); err != nil {
+		return fmt.Errorf("problem reading netrc %s:%s", netrc, err)
+	}
+	return nil
+}
+
+func (h *HostConfig) load() error {
+	if len(h.Host) == 0 {
+		return fmt.Errorf("expecting a host for each host config")
+	}
+	var err error
+	if h.token, err = readSecret(h.BearerTokenFile, h.BearerTokenEnv); err != nil {
+		return fmt.Errorf("problem reading bearer token for %s:%s", h.Host, err)
+	}
+	if h.password, err = readSecret(h.PasswordFile, h.PasswordEnv); err != nil {
+		return fmt.Errorf("problem reading password for %s:%s", h.Host, err)
+	}
+	if len(h.token) > 0 && (len(h.Username) > 0 || len(h.password) > 0) {
+		return fmt.Errorf("expecting a bearer token or basic auth for %s, not both", h.Host)
+	}
+	if len(h.password) > 0 && len(h.Username) == 0 {
+		return fmt.Errorf("expecting a username with the password for %s", h.Host)
+	}
+	h.headers = make(map[string]string)
+	for name, value := range h.Headers {
+		switch {
+		case strings.HasPrefix(value, secretFilePrefix):
+			value, err = readSecret(strings.TrimPrefix(value, secretFilePrefix), "")
+		case strings.HasPrefix(value, secretEnvPrefix):
+			value, err = readSecret("", strings.TrimPrefix(value, secretEnvPrefix))
+		}
+		if err != nil {
+			return fmt.Errorf("problem reading header %s for %s:%s", name, h.Host, err)
+		}
+		h.headers[name] = value
+	}
+
+	if len(h.CAFile) == 0 && len(h.CertFile) == 0 && len(h.KeyFile) == 0 {
+		return nil
+	}
+	tlsConfig := &tls.Config{}
+	if len(h.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(h.CAFile)
+		if err != nil {
+			return fmt.Errorf("problem reading CA file for %s:%s", h.Host, err)
+		}
+		// the extra CAs are trusted as well as the system ones
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA file %s for %s", h.CAFile, h.Host)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(h.CertFile) > 0 || len(h.KeyFile) > 0 {
+		if len(h.CertFile) == 0 || len(h.KeyFile) == 0 {
+			return fmt.Errorf("expecting a cert file and key file for %s", h.Host)
+		}
+		cert, err := tls.LoadX509KeyPair(h.CertFile, h.KeyFile)
+		if err != nil {
+			return fmt.Errorf("problem reading client certificate for %s:%s", h.Host, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	h.client = grab.NewClient()
+	h.client.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return nil
+}
+
+// host will find the settings for a host (nil if none match)
+func (cfg *Config) host(host string) *HostConfig {
+	if cfg == nil {
+		return nil
+	}
+	name := strings.Split(host, ":")[0]
+	for _, h := range cfg.Hosts {
+		switch {
+		case h.Host == "*", h.Host == host, h.Host == name:
+			return h
+		case strings.HasPrefix(h.Host, "*.") && strings.HasSuffix(name, h.Host[1:]):
+			return h
+		}
+	}
+	return nil
+}
+
+// client will return the client to download from a host with
+func (cfg *Config) client(host string) *grab.Client {
+	if h := cfg.host(host); h != nil && h.client != nil {
+		return h.client
+	}
+	client := grab.NewClient()
+	if cfg != nil {
+		client.HTTPClient.CheckRedirect = cfg.checkRedirect
+	}
+	return client
+}
+
+// checkRedirect will stop the headers and credentials configured for one host
+// being sent to another when redirected (go only drops the Authorization
+// header and copies the others), adding any configured for the new host
+func (cfg *Config) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	// the headers are copied from the first request
+	if req.URL.Host == via[0].URL.Host {
+		return nil
+	}
+	if h := cfg.host(via[0].URL.Host); h != nil {
+		for name := range h.headers {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Del("Authorization")
+	cfg.authorize(req)
+	return nil
+}
+
+// authorize will add any credentials and headers for the host to a request
+// (checkRedirect drops them if redirected to another host)
+func (cfg *Config) authorize(req *http.Request) {
+	if cfg == nil {
+		return
+	}
+	h := cfg.host(req.URL.Host)
+	if h != nil {
+		for name, value := range h.headers {
+			req.Header.Set(name, value)
+		}
+		switch {
+		case len(h.token) > 0:
+			req.Header.Set("Authorization", "Bearer "+h.token)
+			return
+		case len(h.Username) > 0:
+			req.SetBasicAuth(h.Username, h.password)
+			return
+		}
+	}
+	if m := cfg.netrcMachine(req.URL.Hostname()); m != nil {
+		req.SetBasicAuth(m.login, m.password)
+	}
+}
+
+// netrcMachine will find the netrc login for a host (or the default)
+func (cfg *Config) netrcMachine(name string) *netrcMachine {
+	var def *netrcMachine
+	for i, m := range cfg.netrc {
+		if m.name == name {
+			return &cfg.netrc[i]
+		}
+		if len(m.name) == 0 && def == nil {
+			def = &cfg.netrc[i]
+		}
+	}
+	return def
+}
+
+// readSecret will read a secret from a file or environment variable (the file
+// takes precedence, "" if neither is set)
+func readSecret(file string, env string) (string, error) {
+	if len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if len(env) > 0 {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", env)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+func defaultNetrc() string {
+	if netrc := os.Getenv("NETRC"); len(netrc) > 0 {
+		return netrc
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// readNetrc will read the machine (and default) logins from a netrc file
+func readNetrc(file string) ([]netrcMachine, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var machines []netrcMachine
+	var m *netrcMachine
+	macro := false
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if macro || (len(fields) > 0 && fields[0] == "macdef") {
+			// macros run to the next blank line and aren't needed
+			macro = len(fields) > 0
+			continue
+		}
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			value := ""
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				machines = append(machines, netrcMachine{name: value})
+				m = &machines[len(machines)-1]
+				i++
+			case "default":
+				machines = append(machines, netrcMachine{})
+				m = &machines[len(machines)-1]
+			case "login", "password", "account":
+				if m != nil && fields[i] == "login" {
+					m.login = value
+				}
+				if m != nil && fields[i] == "password" {
+					m.password = value
+				}
+				i++
+			}
+		}
+	}
+	return machines, nil
+}
@@ -0,0 +1,154 @@
+package web
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestSaveFileWithConfig(t *testing.T) {
+	retryWait = time.Millisecond
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	assert.NilError(t, err)
+
+	dir, err := ioutil.TempDir("", "artefactor_web")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	assert.NilError(t, ioutil.WriteFile(caFile, ca, 0644))
+	keyFile := filepath.Join(dir, "key")
+	assert.NilError(t, ioutil.WriteFile(keyFile, []byte("key\n"), 0600))
+	os.Setenv("ARTEFACTOR_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("ARTEFACTOR_TEST_TOKEN")
+
+	cfg := &Config{
+		Netrc: filepath.Join(dir, "no-netrc"),
+		Hosts: []*HostConfig{{
+			Host:           u.Host,
+			BearerTokenEnv: "ARTEFACTOR_TEST_TOKEN",
+			Headers:        map[string]string{"X-Api-Key": "file:" + keyFile},
+			CAFile:         caFile,
+		}},
+	}
+	assert.ErrorContains(t, cfg.load(), "no-netrc")
+	cfg.Netrc = ""
+	assert.NilError(t, cfg.load())
+
+	download := filepath.Join(dir, "file")
+	assert.NilError(t, saveFile([]string{ts.URL + "/file"}, download, "", false, cfg))
+	saved, err := ioutil.ReadFile(download)
+	assert.NilError(t, err)
+	assert.Equal(t, string(saved), "content")
+
+	// without the CA the certificate isn't trusted
+	err = saveFile([]string{ts.URL + "/file"}, download, "", false, nil)
+	assert.ErrorContains(t, err, "certificate")
+}
+
+func TestSaveFileRedirectedToOtherHost(t *testing.T) {
+	retryWait = time.Millisecond
+	var got http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte("content"))
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	assert.NilError(t, err)
+	otherURL, err := url.Parse(other.URL)
+	assert.NilError(t, err)
+
+	dir, err := ioutil.TempDir("", "artefactor_web")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	netrc := filepath.Join(dir, ".netrc")
+	assert.NilError(t, ioutil.WriteFile(netrc, []byte{}, 0600))
+	os.Setenv("ARTEFACTOR_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("ARTEFACTOR_TEST_TOKEN")
+	os.Setenv("ARTEFACTOR_TEST_KEY", "key")
+	defer os.Unsetenv("ARTEFACTOR_TEST_KEY")
+
+	cfg := &Config{
+		Netrc: netrc,
+		Hosts: []*HostConfig{
+			{
+				Host:           originURL.Host,
+				BearerTokenEnv: "ARTEFACTOR_TEST_TOKEN",
+				Headers:        map[string]string{"X-Api-Key": "env:ARTEFACTOR_TEST_KEY"},
+			},
+			{
+				Host:    otherURL.Host,
+				Headers: map[string]string{"X-Other": "other"},
+			},
+		},
+	}
+	assert.NilError(t, cfg.load())
+
+	download := filepath.Join(dir, "file")
+	assert.NilError(t, saveFile([]string{origin.URL + "/file"}, download, "", false, cfg))
+	saved, err := ioutil.ReadFile(download)
+	assert.NilError(t, err)
+	assert.Equal(t, string(saved), "content")
+	// only the headers configured for the other host are sent to it
+	assert.Equal(t, got.Get("Authorization"), "")
+	assert.Equal(t, got.Get("X-Api-Key"), "")
+	assert.Equal(t, got.Get("X-Other"), "other")
+}
+
+func TestReadNetrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artefactor_web")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	netrc := filepath.Join(dir, ".netrc")
+	assert.NilError(t, ioutil.WriteFile(netrc, []byte(`# downloads
+machine downloads.example.com login bob password p1
+macdef init
+machine ignored.example.com
+
+machine other.example.com
+  login alice
+  password p2
+default login anon password guest
+`), 0600))
+
+	cfg := &Config{Netrc: netrc}
+	assert.NilError(t, cfg.load())
+	assert.Equal(t, len(cfg.netrc), 3)
+	for host, user := range map[string]string{
+		"downloads.example.com:443": "bob",
+		"other.example.com":         "alice",
+		"elsewhere.example.com":     "anon",
+	} {
+		req, err := http.NewRequest(http.MethodGet, "https://"+host+"/file", nil)
+		assert.NilError(t, err)
+		cfg.authorize(req)
+		username, _, ok := req.BasicAuth()
+		assert.Assert(t, ok)
+		assert.Equal(t, username, user)
+	}
+}
@@ -1,25 +1,48 @@
 package web
 
 import (
+	cryptosha256 "crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/appvia/artefactor/pkg/cache"
 	"github.com/appvia/artefactor/pkg/hashcache"
 	"github.com/appvia/artefactor/pkg/util"
 	"github.com/cavaliercoder/grab"
 	"github.com/pkg/errors"
 )
 
-// Save will save a file from the web and optionaly set executable mode
+const (
+	// partialExt is added to a file while downloading, partial downloads are
+	// kept to resume from
+	partialExt string = ".download"
+	// retries is the number of attempts to download a file
+	retries int = 5
+	// maxRetryWait limits the backoff between attempts
+	maxRetryWait = 30 * time.Second
+)
+
+// retryWait is the wait before the first retry (doubled after each attempt)
+var retryWait = 2 * time.Second
+
+// Save will save a file from the user cache or the first of the urls that works
+// (mirrors of the same file) and optionaly set executable mode (cfg and uc may
+// be nil)
 func Save(
 	c *hashcache.CheckSumCache,
-	url string,
+	urls []string,
 	fileName string,
 	dir string,
 	sha256 string,
-	binFile bool) error {
+	binFile bool,
+	cfg *Config,
+	uc *cache.Cache) error {
 
 	download := fmt.Sprintf("%s/%s", dir, fileName)
 	// Check checksum cache first...
@@ -27,30 +50,37 @@ func Save(
 		fmt.Printf("file %q in cache and matching checksum %s\n", download, sha256)
 		// Make sure we tell cache to keep this item:
 		c.Keep(download)
-		if binFile {
-			util.BinMark(c, download)
-		}
 		return nil
 	} else {
 		if c.IsCached(download) {
+			// the file is replaced once downloaded (partial downloads are kept
+			// to resume in the .download file)
 			fmt.Printf("file %q is in cache but does NOT match checksum %s\n", download, sha256)
-			// need to delete file for now and manage partial recovery logic in lib...
-			fmt.Printf("deleting file %q\n", download)
-			os.Remove(download)
 		} // else not cached...
 	}
 
-	if err := SaveNoCheck(url, download, binFile); err != nil {
-		return fmt.Errorf("download problem:%s", err)
-	}
-
-	// Save the file mode meta data if it's a binary
-	if binFile {
-		if err := util.BinMark(c, download); err != nil {
+	key := cache.SHA256Key(sha256)
+	if ok, err := uc.Get(key, download); err != nil {
+		return err
+	} else if ok {
+		if _, err := c.Update(download); err != nil {
+			return err
+		}
+		if c.IsCachedMatched(download, sha256) {
+			return setBinMode(download, binFile)
+		}
+		fmt.Printf("file %q from cache does NOT match checksum %s\n", download, sha256)
+		if err := uc.Remove(key); err != nil {
 			return err
 		}
 	}
 
+	// the checksum is verified before the download replaces any file so any
+	// url with the right content will do
+	if err := saveFile(urls, download, sha256, binFile, cfg); err != nil {
+		return fmt.Errorf("download problem:%s", err)
+	}
+
 	// Now the file is updated - update the checksum...
 	hash, err := c.Update(download)
 	if err != nil {
@@ -61,23 +91,126 @@ func Save(
 		return errors.Errorf("invalid checksum for %s", download)
 	}
 	fmt.Printf("File checksum ok for %q\n", download)
+	if err := uc.Put(key, download); err != nil {
+		fmt.Printf("unable to add %q to cache:%s\n", download, err)
+	}
 	return nil
 }
 
-// SaveNoCheck will download a file without verifying checksums
+// SaveNoCheck will download a file without verifying checksums (cfg may be nil)
 func SaveNoCheck(
 	url string,
 	download string,
 	binFile bool,
+	cfg *Config,
 ) error {
-	tmpDownload := download + ".download"
-	client := grab.NewClient()
-	req, _ := grab.NewRequest(tmpDownload, url)
+	return saveFile([]string{url}, download, "", binFile, cfg)
+}
+
+// saveFile will download a file from the first url that works (retrying and
+// resuming any partial download) and verify the checksum if specified before
+// moving it into place
+func saveFile(urls []string, download string, sha256 string, binFile bool, cfg *Config) error {
+	tmpDownload := download + partialExt
+	wait := retryWait
+	badChecksum := false
+	failures := make(map[string]error)
+	saved := false
+	for attempt := 1; attempt <= retries && len(urls) > 0 && !saved; attempt++ {
+		if attempt > 1 {
+			fmt.Printf("  retrying in %v (attempt %d of %d)\n", wait, attempt, retries)
+			time.Sleep(wait)
+			wait *= 2
+			if wait > maxRetryWait {
+				wait = maxRetryWait
+			}
+		}
+		// each url is tried in turn before waiting to try again
+		var retryURLs []string
+		for _, url := range urls {
+			// without a checksum, a partial download left by a previous run
+			// may be out of date so is only resumed when retrying
+			err := get(url, tmpDownload, sha256, len(sha256) > 0 || attempt > 1, cfg)
+			if err == nil {
+				saved = true
+				break
+			}
+			failures[url] = downloadError(url, err)
+			fmt.Printf("  download failed:%s\n", failures[url])
+			if err == grab.ErrBadChecksum {
+				// the partial download removed may have been out of date so
+				// it's only worth starting again once
+				if badChecksum {
+					continue
+				}
+				badChecksum = true
+			}
+			if canRetry(err) {
+				retryURLs = append(retryURLs, url)
+			}
+		}
+		urls = retryURLs
+	}
+	if !saved {
+		var errs []string
+		for _, err := range failures {
+			errs = append(errs, err.Error())
+		}
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, ", "))
+	}
+	if _, err := os.Stat(download); err == nil {
+		if rmErr := os.Remove(download); rmErr != nil {
+			return fmt.Errorf(
+				"can not remove %q. Trying to update from %q",
+				download,
+				tmpDownload)
+		}
+	}
+	if err := util.Mv(tmpDownload, download); err != nil {
+		return err
+	}
+	fmt.Printf("Download saved to %v \n", download)
+	return setBinMode(download, binFile)
+}
+
+// setBinMode will update the executable mode of binary files
+func setBinMode(file string, binFile bool) error {
+	if binFile {
+		if err := os.Chmod(file, 0777); err != nil {
+			return errors.Errorf("can't set executable permissions")
+		}
+	}
+	return nil
+}
+
+// get will download a url to a file, resuming a partial download when the
+// server supports ranges (a partial download failing the checksum is removed)
+func get(url string, tmpDownload string, sha256 string, resume bool, cfg *Config) error {
+	req, err := grab.NewRequest(tmpDownload, url)
+	if err != nil {
+		return err
+	}
+	client := cfg.client(req.HTTPRequest.URL.Host)
+	cfg.authorize(req.HTTPRequest)
+	req.NoResume = !resume
+	if len(sha256) > 0 {
+		sum, err := hex.DecodeString(sha256)
+		if err != nil {
+			return fmt.Errorf("invalid sha256 %q:%s", sha256, err)
+		}
+		req.SetChecksum(cryptosha256.New(), sum, true)
+	}
 
 	// start download
 	fmt.Printf("Downloading %q...\n", req.URL())
 	resp := client.Do(req)
-	fmt.Printf("  %v\n", resp.HTTPResponse.Status)
+	if resp.HTTPResponse != nil {
+		fmt.Printf("  %v\n", resp.HTTPResponse.Status)
+	}
+	if resp.DidResume {
+		fmt.Printf("  resuming from %v bytes\n", resp.BytesComplete())
+	}
 
 	// start UI loop
 	t := time.NewTicker(500 * time.Millisecond)
@@ -97,27 +230,28 @@ Loop:
 			break Loop
 		}
 	}
-	// check for errors
-	if err := resp.Err(); err != nil {
-		return err
-	}
-	if _, err := os.Stat(download); err == nil {
-		if rmErr := os.Remove(download); rmErr != nil {
-			return fmt.Errorf(
-				"can not remove %q. Trying to update from %q",
-				download,
-				resp.Filename)
-		}
+	return resp.Err()
+}
+
+// canRetry will work out if a download may work if tried again i.e. not when
+// the server refuses the request
+func canRetry(err error) bool {
+	if code, ok := err.(grab.StatusCodeError); ok {
+		return int(code) >= http.StatusInternalServerError ||
+			int(code) == http.StatusRequestTimeout ||
+			int(code) == http.StatusTooManyRequests
 	}
-	if err := util.Mv(resp.Filename, download); err != nil {
-		return err
+	return true
+}
+
+// downloadError will describe why a download failed
+func downloadError(url string, err error) error {
+	switch e := err.(type) {
+	case grab.StatusCodeError:
+		return fmt.Errorf("%s returned HTTP status %d %s", url, int(e), http.StatusText(int(e)))
 	}
-	fmt.Printf("Download saved to %v \n", download)
-	if binFile {
-		// Update the executable mode:
-		if err := os.Chmod(download, 0777); err != nil {
-			return errors.Errorf("can't set executable permissions")
-		}
+	if err == grab.ErrBadChecksum {
+		return fmt.Errorf("download from %s does not match the expected checksum", url)
 	}
-	return nil
+	return err
 }
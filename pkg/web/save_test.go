@@ -0,0 +1,124 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestSaveFileResumes(t *testing.T) {
+	retryWait = time.Millisecond
+	content := bytes.Repeat([]byte("artefactor"), 10000)
+	sum := sha256.Sum256(content)
+	gets := 0
+	ranges := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+			if len(r.Header.Get("Range")) > 0 {
+				ranges++
+			}
+			if gets == 1 {
+				// drop the connection half way through
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", "100000")
+				w.Write(content[:50000])
+				panic(http.ErrAbortHandler)
+			}
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "artefactor_web")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	download := filepath.Join(dir, "file")
+	assert.NilError(t, saveFile([]string{ts.URL + "/file"}, download, hex.EncodeToString(sum[:]), false, nil))
+	saved, err := ioutil.ReadFile(download)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(saved, content))
+	assert.Equal(t, ranges, 1)
+	_, err = os.Stat(download + partialExt)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestSaveFileErrors(t *testing.T) {
+	retryWait = time.Millisecond
+	gets := 0
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("unexpected"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "artefactor_web")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	download := filepath.Join(dir, "file")
+
+	// not found isn't retried
+	err = saveFile([]string{ts.URL + "/file"}, download, "", false, nil)
+	assert.ErrorContains(t, err, "404 Not Found")
+	assert.Equal(t, gets, 1)
+
+	// server errors are retried
+	gets = 0
+	status = http.StatusServiceUnavailable
+	err = saveFile([]string{ts.URL + "/file"}, download, "", false, nil)
+	assert.ErrorContains(t, err, "503 Service Unavailable")
+	assert.Equal(t, gets, retries)
+
+	// the checksum is verified before the file is saved (starting again once)
+	gets = 0
+	status = http.StatusOK
+	err = saveFile([]string{ts.URL + "/file"}, download, strings.Repeat("0", 64), false, nil)
+	assert.ErrorContains(t, err, "does not match the expected checksum")
+	assert.Equal(t, gets, 2)
+	_, err = os.Stat(download)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestSaveFileMirrors(t *testing.T) {
+	retryWait = time.Millisecond
+	content := []byte("artefactor")
+	sum := sha256.Sum256(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/file":
+			w.Write(content)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "artefactor_web")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	download := filepath.Join(dir, "file")
+	urls := []string{ts.URL + "/missing", ts.URL + "/down", ts.URL + "/file"}
+	assert.NilError(t, saveFile(urls, download, hex.EncodeToString(sum[:]), false, nil))
+	saved, err := ioutil.ReadFile(download)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(saved, content))
+}
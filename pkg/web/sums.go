@@ -0,0 +1,169 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// armorPrefix starts an ASCII armored key or signature
+const armorPrefix string = "-----BEGIN PGP"
+
+// bsdSumLine is a checksum in the BSD format e.g. SHA256 (file) = abc...
+var bsdSumLine = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+
+// Sums are the checksums from an upstream checksums file (e.g. SHA256SUMS) by
+// file name
+type Sums struct {
+	// sums are by the name in the file (and the base name of paths)
+	sums map[string]string
+	// ambiguous are base names of more than one path with different checksums
+	ambiguous map[string][]string
+}
+
+// LoadSums will read a checksums file from a url or local file and, when sig is
+// set, verify its detached signature with the keys in the keyring file
+func LoadSums(src string, sig string, keyring string, cfg *Config) (*Sums, error) {
+	tmpDir, err := ioutil.TempDir("", "artefactor_sums")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b, err := fetch(src, filepath.Join(tmpDir, "sums"), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading checksums %s:%s", src, err)
+	}
+	if len(sig) > 0 {
+		if len(keyring) == 0 {
+			return nil, fmt.Errorf("a keyring is required to verify signature %s", sig)
+		}
+		sigBytes, err := fetch(sig, filepath.Join(tmpDir, "sig"), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading signature %s:%s", sig, err)
+		}
+		if err := verifySignature(b, sigBytes, keyring); err != nil {
+			return nil, fmt.Errorf("invalid signature %s for checksums %s:%s", sig, src, err)
+		}
+	}
+	sums := parseSums(b)
+	if len(sums.sums) == 0 {
+		return nil, fmt.Errorf("no sha256 checksums found in %s", src)
+	}
+	return sums, nil
+}
+
+// Get will return the checksum for the first of the names found. A base name
+// of paths with different checksums isn't found
+func (s *Sums) Get(names ...string) (string, error) {
+	var ambiguous []string
+	for _, name := range names {
+		if sum, ok := s.sums[name]; ok {
+			return sum, nil
+		}
+		if paths, ok := s.ambiguous[name]; ok {
+			ambiguous = append(ambiguous, fmt.Sprintf("%s (%s)", name, strings.Join(paths, " ")))
+		}
+	}
+	if len(ambiguous) > 0 {
+		return "", fmt.Errorf(
+			"no checksum for %s, found different checksums for %s",
+			strings.Join(names, " or "), strings.Join(ambiguous, " and "))
+	}
+	return "", fmt.Errorf("no checksum for %s", strings.Join(names, " or "))
+}
+
+// IsURL will detect a url (otherwise a local file)
+func IsURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// fetch will read a url (downloading it to tmpFile) or a local file
+func fetch(src string, tmpFile string, cfg *Config) ([]byte, error) {
+	if IsURL(src) {
+		if err := SaveNoCheck(src, tmpFile, false, cfg); err != nil {
+			return nil, err
+		}
+		src = tmpFile
+	}
+	return ioutil.ReadFile(src)
+}
+
+// parseSums will read the sha256sum (hash  [*]name) and BSD formats. Entries
+// with paths can also be found by their base name (unless paths with the same
+// base name have different checksums)
+func parseSums(b []byte) *Sums {
+	sums := &Sums{
+		sums:      make(map[string]string),
+		ambiguous: make(map[string][]string),
+	}
+	byBase := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var sum, name string
+		if m := bsdSumLine.FindStringSubmatch(line); m != nil {
+			name, sum = m[1], m[2]
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			sum, name = fields[0], strings.TrimPrefix(fields[1], "*")
+			if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+				continue
+			}
+		}
+		sums.sums[name] = strings.ToLower(sum)
+		byBase[path.Base(name)] = append(byBase[path.Base(name)], name)
+	}
+	for base, names := range byBase {
+		if _, ok := sums.sums[base]; ok {
+			continue
+		}
+		sum := sums.sums[names[0]]
+		for _, name := range names[1:] {
+			if sums.sums[name] != sum {
+				sums.ambiguous[base] = names
+				break
+			}
+		}
+		if _, ok := sums.ambiguous[base]; !ok {
+			sums.sums[base] = sum
+		}
+	}
+	return sums
+}
+
+// verifySignature will check a detached signature (armored or binary) with the
+// keys in a keyring file (armored or binary)
+func verifySignature(signed []byte, sig []byte, keyring string) error {
+	keys, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		return fmt.Errorf("problem reading keyring %s:%s", keyring, err)
+	}
+	var entities openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(keys), []byte(armorPrefix)) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keys))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(keys))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid keyring %s:%s", keyring, err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte(armorPrefix)) {
+		_, err = openpgp.CheckArmoredDetachedSignature(entities, bytes.NewReader(signed), bytes.NewReader(sig))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(entities, bytes.NewReader(signed), bytes.NewReader(sig))
+	}
+	return err
+}
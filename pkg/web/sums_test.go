@@ -0,0 +1,87 @@
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"gotest.tools/assert"
+)
+
+func TestLoadSums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artefactor_sums")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("B", 64)
+	sums := []byte("# release sums\n" +
+		a + "  tool_linux_amd64.tar.gz\n" +
+		b + " *dist/tool_darwin_amd64.zip\n" +
+		"SHA256 (tool.exe) = " + a + "\n")
+	sumsFile := filepath.Join(dir, "SHA256SUMS")
+	assert.NilError(t, ioutil.WriteFile(sumsFile, sums, 0644))
+
+	s, err := LoadSums(sumsFile, "", "", nil)
+	assert.NilError(t, err)
+	sum, err := s.Get("tool_linux_amd64.tar.gz")
+	assert.NilError(t, err)
+	assert.Equal(t, sum, a)
+	sum, err = s.Get("missing", "tool_darwin_amd64.zip")
+	assert.NilError(t, err)
+	assert.Equal(t, sum, strings.ToLower(b))
+	_, err = s.Get("tool.exe")
+	assert.NilError(t, err)
+	_, err = s.Get("missing")
+	assert.ErrorContains(t, err, "no checksum for missing")
+
+	// signed sums
+	signer, err := openpgp.NewEntity("release", "", "release@example.com", nil)
+	assert.NilError(t, err)
+	var keyring bytes.Buffer
+	assert.NilError(t, signer.Serialize(&keyring))
+	keyringFile := filepath.Join(dir, "keyring.gpg")
+	assert.NilError(t, ioutil.WriteFile(keyringFile, keyring.Bytes(), 0644))
+	var sig bytes.Buffer
+	assert.NilError(t, openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(sums), nil))
+	sigFile := filepath.Join(dir, "SHA256SUMS.asc")
+	assert.NilError(t, ioutil.WriteFile(sigFile, sig.Bytes(), 0644))
+
+	_, err = LoadSums(sumsFile, sigFile, keyringFile, nil)
+	assert.NilError(t, err)
+	_, err = LoadSums(sumsFile, sigFile, "", nil)
+	assert.ErrorContains(t, err, "keyring is required")
+
+	// changed sums must not verify
+	assert.NilError(t, ioutil.WriteFile(sumsFile, append(sums, []byte(b+"  extra\n")...), 0644))
+	_, err = LoadSums(sumsFile, sigFile, keyringFile, nil)
+	assert.ErrorContains(t, err, "invalid signature")
+}
+
+func TestParseSumsAmbiguousBaseNames(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+	s := parseSums([]byte(a + "  linux/tool.tar.gz\n" +
+		b + "  darwin/tool.tar.gz\n" +
+		a + "  linux/LICENSE\n" +
+		a + "  darwin/LICENSE\n"))
+
+	sum, err := s.Get("linux/tool.tar.gz")
+	assert.NilError(t, err)
+	assert.Equal(t, sum, a)
+	// the base name could be either file
+	_, err = s.Get("tool.tar.gz")
+	assert.ErrorContains(t, err, "found different checksums for tool.tar.gz (linux/tool.tar.gz darwin/tool.tar.gz)")
+	// unless the checksums are the same
+	sum, err = s.Get("LICENSE")
+	assert.NilError(t, err)
+	assert.Equal(t, sum, a)
+	// or another name is found
+	sum, err = s.Get("tool.tar.gz", "darwin/tool.tar.gz")
+	assert.NilError(t, err)
+	assert.Equal(t, sum, b)
+}